@@ -0,0 +1,78 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// userRoles is the response of the role administration endpoints.
+// It deliberately leaves out the email address and password hash of models.User.
+type userRoles struct {
+	ID       int      `json:"id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// handleUserRoles is a HTTP handler function for the role administration endpoints, restricted to admins by the route policy:
+//
+//	GET    /admin/users/{id}/roles         lists the roles of the user
+//	PUT    /admin/users/{id}/roles/{role}  grants the role
+//	DELETE /admin/users/{id}/roles/{role}  revokes the role
+//
+// Each answers with the resulting roles of the user, or "404 Not Found" for an unknown user or path.
+// An unknown role is answered with "400 Bad Request". Admins cannot revoke their own admin role,
+// which would otherwise be an easy way to leave the API without any admin.
+func (s *Server) handleUserRoles(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "roles" {
+		writeError(w, r, errNotFound)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeError(w, r, errNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			methodNotAllowed(w, r, "GET")
+			return
+		}
+		user, err := s.stores.Users.Get(r.Context(), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, userRoles{ID: user.ID, Username: user.Username, Roles: user.Roles})
+		return
+	}
+
+	role := parts[2]
+	if !models.IsRole(role) {
+		writeError(w, r, newError(http.StatusBadRequest, codeBadRequest, "Unknown role %q", role))
+		return
+	}
+
+	var user *models.User
+	switch r.Method {
+	case "PUT":
+		user, err = s.stores.Users.GrantRole(r.Context(), id, role)
+	case "DELETE":
+		if id == userFromContext(r.Context()).ID && role == models.RoleAdmin {
+			writeError(w, r, newError(http.StatusConflict, codeConflict, "Admins cannot revoke their own admin role"))
+			return
+		}
+		user, err = s.stores.Users.RevokeRole(r.Context(), id, role)
+	default:
+		methodNotAllowed(w, r, "PUT", "DELETE")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, userRoles{ID: user.ID, Username: user.Username, Roles: user.Roles})
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// jwtCookie is the name of the cookie handleLogin stores the token in.
+const jwtCookie = "jwt"
+
+// csrfCookie is the cookie holding the CSRF token issued together with the jwt cookie, and csrfHeader the header
+// a request authenticated by the jwt cookie has to repeat it in (double submit). Other sites can make the browser
+// send the cookie, but can neither read it nor set the header.
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var errNoToken = errors.New("no token")
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+	requestIDContextKey
+	loggerContextKey
+	accessEntryContextKey
+)
+
+// withUser returns a copy of ctx carrying the authenticated user.
+func withUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// tokenClaims are the claims of an access token. Roles mirrors models.User.Roles at the time the token
+// was issued, for the benefit of other services verifying the token through the JWKS endpoint.
+type tokenClaims struct {
+	jwt.StandardClaims
+	Roles []string `json:"roles"`
+}
+
+// claimsFromContext returns the claims of the access token the request was authenticated with.
+func claimsFromContext(ctx context.Context) *tokenClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*tokenClaims)
+	return claims
+}
+
+// userFromContext returns the user put into the request context by requireAuth, or nil for anonymous requests.
+func userFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userContextKey).(*models.User)
+	return user
+}
+
+// issueToken signs a short-lived access token for the user with the current key of the KeySet.
+// The user ID is carried in the standard "sub" claim next to the "roles" of the user, and a random "jti"
+// identifies the token so that it can be put on the denylist by handleLogout.
+func (s *Server) issueToken(user *models.User) (string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(s.config.JWT.AccessTokenTTL).Unix(),
+		},
+		Roles: user.Roles,
+	}
+	return s.keys.Sign(claims)
+}
+
+// tokenFromRequest returns the token from an "Authorization: Bearer <token>" header,
+// falling back to the cookie set by handleLogin, and whether it was taken from the cookie.
+func tokenFromRequest(r *http.Request) (token string, fromCookie bool, err error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", false, errors.New("authorization header must use the Bearer scheme")
+		}
+		return strings.TrimSpace(token), false, nil
+	}
+	if cookie, err := r.Cookie(jwtCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, true, nil
+	}
+	return "", false, errNoToken
+}
+
+// checkCSRF returns errCSRFToken unless the request is safe or repeats the csrf_token cookie in the X-CSRF-Token header.
+// It is only needed for requests authenticated by the jwt cookie, which the browser sends along with requests other sites make.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return nil
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	header := r.Header.Get(csrfHeader)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return errCSRFToken
+	}
+	return nil
+}
+
+// authenticate validates the token of the request, makes sure it was not revoked,
+// and loads the user it was issued for. A token from the jwt cookie also needs a valid CSRF token, see checkCSRF.
+func (s *Server) authenticate(r *http.Request) (*models.User, *tokenClaims, error) {
+	tokenString, fromCookie, err := tokenFromRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromCookie {
+		if err := checkCSRF(r); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var claims tokenClaims
+	if err := s.keys.Parse(tokenString, &claims); err != nil {
+		return nil, nil, err
+	}
+	if claims.Id == "" {
+		return nil, nil, errors.New("token has no jti")
+	}
+	denied, err := s.stores.Tokens.IsAccessTokenDenied(r.Context(), claims.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if denied {
+		return nil, nil, errors.New("token was revoked")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, nil, errors.New("token has no valid subject")
+	}
+	user, err := s.stores.Users.Get(r.Context(), userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &claims, nil
+}
+
+// requireAuth is a middleware that only lets requests carrying a valid token through.
+// The authenticated user is put into the request context where handlers read it with userFromContext.
+// A request authenticated by the jwt cookie without the CSRF token is answered with "403 Forbidden",
+// any other request, including one with a revoked token, with "401 Unauthorized".
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, claims, err := s.authenticate(r)
+		if errors.Is(err, errCSRFToken) {
+			writeError(w, r, err)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		if entry, ok := r.Context().Value(accessEntryContextKey).(*accessEntry); ok {
+			entry.userID = user.ID
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(semconv.EnduserID(strconv.Itoa(user.ID)))
+		ctx := withUser(r.Context(), user)
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// handleJWKS is a HTTP handler function that publishes the public verification keys as a JSON Web Key Set,
+// so that other services can verify the tokens issued by this API.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, s.keys.JWKS())
+}
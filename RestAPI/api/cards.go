@@ -0,0 +1,238 @@
+package api
+
+import (
+	"RestAPI/pkg/card"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/vault"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnknownCard is returned by savedCard for a card token that does not belong to the user.
+var errUnknownCard = errors.New("unknown card token")
+
+// errNoCard is returned by payOrder when neither a card token was given nor a default card saved.
+var errNoCard = errors.New("no card token given and no default card saved")
+
+// cardUpdate is the body of PATCH /credit-cards/{id}. Fields left out keep their current value.
+type cardUpdate struct {
+	ExpiryMonth *string `json:"expiry_month"`
+	ExpiryYear  *string `json:"expiry_year"`
+	NameOnCard  *string `json:"name_on_card"`
+}
+
+// masked fills in the Masked number of the cards for the response.
+func masked(cards ...*models.CreditCard) {
+	for _, c := range cards {
+		c.Masked = card.Mask(c.Last4)
+	}
+}
+
+// handleCreditCards is a HTTP handler function for the /credit-cards collection of the authenticated user.
+// "GET" lists the saved cards, the default card first, and "POST" saves a new one through handleAddCreditCard.
+func (s *Server) handleCreditCards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		cards, err := s.stores.CreditCards.ListByUser(r.Context(), userFromContext(r.Context()).ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for i := range cards {
+			masked(&cards[i])
+		}
+		writeJSON(w, http.StatusOK, cards)
+	case "POST":
+		s.handleAddCreditCard(w, r)
+	default:
+		methodNotAllowed(w, r, "GET", "POST")
+	}
+}
+
+// handleCreditCard is a HTTP handler function for a single saved card of the authenticated user:
+//
+//	GET    /credit-cards/{id}          returns the card
+//	PATCH  /credit-cards/{id}          changes the expiry or the name on the card
+//	DELETE /credit-cards/{id}          deletes the card
+//	PUT    /credit-cards/{id}/default  makes the card the default card
+//
+// Cards of other users are answered with "404 Not Found" just like cards that do not exist.
+func (s *Server) handleCreditCard(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/credit-cards/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "default") {
+		writeError(w, r, errNotFound)
+		return
+	}
+	user := userFromContext(r.Context())
+
+	if len(parts) == 2 {
+		if r.Method != "PUT" {
+			methodNotAllowed(w, r, "PUT")
+			return
+		}
+		if err := s.stores.CreditCards.SetDefault(r.Context(), user.ID, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		s.writeCreditCard(w, r, user.ID, id)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.writeCreditCard(w, r, user.ID, id)
+	case "PATCH":
+		s.handleUpdateCreditCard(w, r, user.ID, id)
+	case "DELETE":
+		if err := s.stores.CreditCards.Delete(r.Context(), user.ID, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r, "GET", "PATCH", "DELETE")
+	}
+}
+
+// writeCreditCard answers with the card of the user.
+func (s *Server) writeCreditCard(w http.ResponseWriter, r *http.Request, userID, id int) {
+	c, err := s.stores.CreditCards.Get(r.Context(), userID, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	masked(c)
+	writeJSON(w, http.StatusOK, c)
+}
+
+// handleUpdateCreditCard changes the expiry and name of a saved card, the fields present in the body replace
+// the stored ones. The result is checked with card.ValidateUpdate, so a card can not be updated to have expired.
+func (s *Server) handleUpdateCreditCard(w http.ResponseWriter, r *http.Request, userID, id int) {
+	var req cardUpdate
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	c, err := s.stores.CreditCards.Get(r.Context(), userID, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	details := card.Details{ExpiryMonth: c.ExpiryMonth, ExpiryYear: c.ExpiryYear, Name: c.NameOnCard}
+	if req.ExpiryMonth != nil {
+		details.ExpiryMonth = *req.ExpiryMonth
+	}
+	if req.ExpiryYear != nil {
+		details.ExpiryYear = *req.ExpiryYear
+	}
+	if req.NameOnCard != nil {
+		details.Name = *req.NameOnCard
+	}
+	if err := card.ValidateUpdate(&details, time.Now()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	c.ExpiryMonth, c.ExpiryYear, c.NameOnCard = details.ExpiryMonth, details.ExpiryYear, details.Name
+	if err := s.stores.CreditCards.Update(r.Context(), c); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	masked(c)
+	writeJSON(w, http.StatusOK, c)
+}
+
+// This function handleAddCreditCard is handling the adding of a credit card for an authenticated user. It does this by:
+
+// Reading the user authenticated by the requireAuth middleware from the request context.
+// Decoding the card number, expiry, CVV and name from the JSON body of the request with decode, which validates
+// them with card.Validate, every invalid field is reported at once with "422 Unprocessable Entity".
+// Encrypting the card number with the vault under a new random card token. The CVV is only checked and then
+// dropped, it is never stored.
+// Saving the card through the CreditCardStore
+// If there are no errors, it answers with "201 Created" and the card token, brand and last four digits.
+// The first card a user saves becomes the default card.
+// The card number is never sent back. If any error occurs, it sends an error response with appropriate HTTP status code.
+func (s *Server) handleAddCreditCard(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	user := userFromContext(r.Context())
+
+	var details card.Details
+	if err := s.decode(w, r, &details); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	token, err := vault.NewToken()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// The token is the associated data, so the encrypted number only opens for the card it was stored with.
+	sealed, err := s.vault.Seal([]byte(details.Number), []byte(token))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	creditCard := &models.CreditCard{
+		UserID:      user.ID,
+		Token:       token,
+		Brand:       card.Brand(details.Number),
+		Last4:       card.Last4(details.Number),
+		ExpiryMonth: details.ExpiryMonth,
+		ExpiryYear:  details.ExpiryYear,
+		NameOnCard:  details.Name,
+		Number:      *sealed,
+	}
+
+	// Save the credit card
+	if err := s.stores.CreditCards.Create(r.Context(), creditCard); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.metrics.CardAdded()
+	masked(creditCard)
+	w.Header().Set("Location", "/credit-cards/"+strconv.Itoa(creditCard.ID))
+	writeJSON(w, http.StatusCreated, creditCard)
+}
+
+// savedCard returns the details of the card the user saved under the token, with the decrypted number,
+// ready to be charged. Tokens of other users are as unknown as tokens that do not exist.
+// Without a token it returns the default card of the user, or errNoCard if there is none.
+func (s *Server) savedCard(ctx context.Context, userID int, token string) (*payment.Card, error) {
+	var (
+		saved *models.CreditCard
+		err   error
+	)
+	if token == "" {
+		saved, err = s.stores.CreditCards.GetDefault(ctx, userID)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errNoCard
+		}
+	} else {
+		saved, err = s.stores.CreditCards.GetByToken(ctx, token)
+		if errors.Is(err, store.ErrNotFound) || (err == nil && saved.UserID != userID) {
+			return nil, errUnknownCard
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	number, err := s.vault.Open(&saved.Number, []byte(saved.Token))
+	if err != nil {
+		return nil, err
+	}
+	return &payment.Card{
+		Number:   string(number),
+		ExpMonth: saved.ExpiryMonth,
+		ExpYear:  saved.ExpiryYear,
+		Name:     saved.NameOnCard,
+	}, nil
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addCard saves a card for the user and returns the response.
+func addCard(h http.Handler, token, number string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"card_number":%q,"expiry_month":"12","expiry_year":"%d","cvv":"123","name_on_card":"Jane Doe"}`, number, time.Now().Year()+2)
+	req := httptest.NewRequest("POST", "/credit-cards", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestSavedCards saves cards in the vault and pays with their tokens.
+func TestSavedCards(t *testing.T) {
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(t, stores)
+			token := signUp(t, h, fmt.Sprintf("cards_%s_%d", name, os.Getpid()))
+			other := signUp(t, h, fmt.Sprintf("cards_other_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Paid by card", Description: "Vault test", Price: 10, Quantity: 5}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := addCard(h, token, "4242 4242 4242 4242")
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("adding a card: %d %s", rec.Code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "424242") || strings.Contains(rec.Body.String(), `"cvv"`) {
+				t.Errorf("response reveals the card number or CVV: %s", rec.Body)
+			}
+			var saved models.CreditCard
+			if err := json.Unmarshal(rec.Body.Bytes(), &saved); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(saved.Token, "card_") || saved.Brand != "visa" || saved.Last4 != "4242" {
+				t.Errorf("saved card %+v", saved)
+			}
+			stored, err := stores.CreditCards.GetByToken(context.Background(), saved.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored.Number.Ciphertext, []byte("4242424242424242")) {
+				t.Error("card number is stored in plain text")
+			}
+
+			if rec := buy(h, token, product.ID, 1, 10, saved.Token); rec.Code != http.StatusCreated {
+				t.Errorf("paying with the saved card: %d %s", rec.Code, rec.Body)
+			}
+			if rec := buy(h, other, product.ID, 1, 10, saved.Token); rec.Code != http.StatusBadRequest {
+				t.Errorf("paying with the card of another user: %d %s", rec.Code, rec.Body)
+			}
+
+			rec = addCard(h, token, payment.CardInsufficientFunds)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("adding a card: %d %s", rec.Code, rec.Body)
+			}
+			json.Unmarshal(rec.Body.Bytes(), &saved)
+			if rec := buy(h, token, product.ID, 1, 10, saved.Token); rec.Code != http.StatusPaymentRequired {
+				t.Errorf("paying with a card without funds: %d %s", rec.Code, rec.Body)
+			}
+
+			got, err := stores.Products.Get(context.Background(), product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Quantity != 4 {
+				t.Errorf("stock is %d after one paid purchase, want 4", got.Quantity)
+			}
+		})
+	}
+}
+
+func TestAddCardValidation(t *testing.T) {
+	h := newTestServer(t, store.NewMemory())
+	token := signUp(t, h, "card_validation")
+
+	body := `{"card_number":"4242 4242 4242 4241","expiry_month":"13","expiry_year":"2020","cvv":"12","name_on_card":"  "}`
+	req := httptest.NewRequest("POST", "/credit-cards", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid card: %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"card_number", "expiry_month", "cvv", "name_on_card"} {
+		if resp.Errors[field] == "" {
+			t.Errorf("no error for %s in %s", field, rec.Body)
+		}
+	}
+}
+
+// do sends a request with a JSON body as the user.
+func do(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func savedCard(t *testing.T, rec *httptest.ResponseRecorder) models.CreditCard {
+	var c models.CreditCard
+	if err := json.Unmarshal(rec.Body.Bytes(), &c); err != nil {
+		t.Fatalf("decoding card from %d %s: %v", rec.Code, rec.Body, err)
+	}
+	return c
+}
+
+// TestManageCards lists, updates, deletes and picks the default among saved cards, and pays with the default card.
+func TestManageCards(t *testing.T) {
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(t, stores)
+			owner := signUp(t, h, fmt.Sprintf("wallet_%s_%d", name, os.Getpid()))
+			other := signUp(t, h, fmt.Sprintf("wallet_other_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Default card", Description: "Wallet test", Price: 10, Quantity: 5}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec := buy(h, owner, product.ID, 1, 10, ""); rec.Code != http.StatusBadRequest {
+				t.Errorf("buying without a token or saved card: %d %s", rec.Code, rec.Body)
+			}
+
+			first := savedCard(t, addCard(h, owner, "4242424242424242"))
+			second := savedCard(t, addCard(h, owner, payment.CardInsufficientFunds))
+			if !first.Default || second.Default {
+				t.Errorf("the first card must become the default: %+v %+v", first, second)
+			}
+
+			rec := do(h, "GET", "/credit-cards", owner, "")
+			var cards []models.CreditCard
+			json.Unmarshal(rec.Body.Bytes(), &cards)
+			if rec.Code != http.StatusOK || len(cards) != 2 || cards[0].ID != first.ID || cards[0].Masked != "**** **** **** 4242" {
+				t.Fatalf("listing cards: %d %s", rec.Code, rec.Body)
+			}
+			if rec := do(h, "GET", "/credit-cards", other, ""); rec.Body.String() != "[]\n" {
+				t.Errorf("another user sees cards: %s", rec.Body)
+			}
+
+			path := fmt.Sprintf("/credit-cards/%d", first.ID)
+			for _, req := range []struct{ method, path, body string }{
+				{"GET", path, ""},
+				{"PATCH", path, `{"name_on_card": "Mallory"}`},
+				{"DELETE", path, ""},
+				{"PUT", path + "/default", ""},
+			} {
+				if rec := do(h, req.method, req.path, other, req.body); rec.Code != http.StatusNotFound {
+					t.Errorf("%s %s of another user: %d %s", req.method, req.path, rec.Code, rec.Body)
+				}
+			}
+
+			year := fmt.Sprint(time.Now().Year() + 3)
+			rec = do(h, "PATCH", path, owner, `{"expiry_month": "3", "expiry_year": "`+year+`", "name_on_card": " jane  roe "}`)
+			if c := savedCard(t, rec); rec.Code != http.StatusOK || c.ExpiryMonth != "03" || c.ExpiryYear != year || c.NameOnCard != "JANE ROE" || c.Token != first.Token {
+				t.Errorf("updating a card: %d %s", rec.Code, rec.Body)
+			}
+			if rec := do(h, "PATCH", path, owner, `{"expiry_year": "2001"}`); rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("updating a card to have expired: %d %s", rec.Code, rec.Body)
+			}
+
+			// The second card has no funds, paying without a token must charge it once it is the default.
+			if rec := do(h, "PUT", fmt.Sprintf("/credit-cards/%d/default", second.ID), owner, ""); rec.Code != http.StatusOK || !savedCard(t, rec).Default {
+				t.Fatalf("setting the default card: %d %s", rec.Code, rec.Body)
+			}
+			if rec := buy(h, owner, product.ID, 1, 10, ""); rec.Code != http.StatusPaymentRequired {
+				t.Errorf("paying with the default card without funds: %d %s", rec.Code, rec.Body)
+			}
+			if rec := do(h, "DELETE", fmt.Sprintf("/credit-cards/%d", second.ID), owner, ""); rec.Code != http.StatusNoContent {
+				t.Fatalf("deleting a card: %d %s", rec.Code, rec.Body)
+			}
+			if rec := do(h, "GET", path, owner, ""); !savedCard(t, rec).Default {
+				t.Errorf("the remaining card must become the default: %s", rec.Body)
+			}
+			if rec := buy(h, owner, product.ID, 1, 10, ""); rec.Code != http.StatusCreated {
+				t.Errorf("paying with the default card: %d %s", rec.Code, rec.Body)
+			}
+
+			// Checking out without a token pays with the default card too.
+			if rec := do(h, "POST", "/cart/items", owner, fmt.Sprintf(`{"product_id": %d, "quantity": 2}`, product.ID)); rec.Code != http.StatusOK {
+				t.Fatalf("adding to the cart: %d %s", rec.Code, rec.Body)
+			}
+			rec = do(h, "POST", "/cart/checkout", owner, "")
+			var order models.Order
+			json.Unmarshal(rec.Body.Bytes(), &order)
+			if rec.Code != http.StatusCreated || order.Status != models.OrderPaid {
+				t.Errorf("checking out with the default card: %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
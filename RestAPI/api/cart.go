@@ -0,0 +1,250 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cartCookie is the name of the cookie holding the token of an anonymous cart.
+const cartCookie = "cart"
+
+// cartItemRequest is the body of POST /cart/items.
+type cartItemRequest struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+func (req *cartItemRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.ProductID > 0, "product_id", "is required")
+	errs.Check(req.Quantity > 0, "quantity", "must be a positive integer")
+	return errs.Err()
+}
+
+// cartQuantityRequest is the body of PUT /cart/items/{product_id}.
+type cartQuantityRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+func (req *cartQuantityRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.Quantity >= 0, "quantity", "must not be negative")
+	return errs.Err()
+}
+
+// cartKey returns the key of the cart the request works on: the cart of the authenticated user, or the
+// anonymous cart named by the "cart" cookie. Without either, ok is false unless create is set, in which case
+// a new anonymous cart token is issued in the cookie. The cookie of an anonymous cart is renewed on every change.
+func (s *Server) cartKey(w http.ResponseWriter, r *http.Request, create bool) (key store.CartKey, ok bool, err error) {
+	if user := userFromContext(r.Context()); user != nil {
+		return store.CartKey{UserID: user.ID}, true, nil
+	}
+	token := ""
+	if cookie, err := r.Cookie(cartCookie); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	}
+	if !create {
+		return store.CartKey{TokenHash: hashToken(token)}, token != "", nil
+	}
+	if token == "" {
+		if token, err = randomToken(); err != nil {
+			return store.CartKey{}, false, err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(store.AnonymousCartTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return store.CartKey{TokenHash: hashToken(token)}, true, nil
+}
+
+// mergeCart moves the anonymous cart of the request, if any, into the cart of the user who just logged in
+// and deletes the cookie naming it.
+func (s *Server) mergeCart(w http.ResponseWriter, r *http.Request, userID int) error {
+	cookie, err := r.Cookie(cartCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	if err := s.stores.Carts.Merge(r.Context(), hashToken(cookie.Value), userID); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: cartCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// handleCart is a HTTP handler function for the cart at /cart.
+// "GET" returns the cart with current prices and stock, "DELETE" empties it.
+// Logged in users get their own cart, anonymous visitors the cart of their "cart" cookie,
+// which is merged into the cart of the user when they log in or sign up.
+func (s *Server) handleCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		methodNotAllowed(w, r, "GET", "DELETE")
+		return
+	}
+	key, ok, err := s.cartKey(w, r, false)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ok {
+		// Without a user or cookie there is no cart to look up.
+		writeJSON(w, http.StatusOK, models.Cart{Items: []models.CartItem{}, Available: true})
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := s.stores.Carts.Clear(r.Context(), key); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	s.writeCart(w, r, key)
+}
+
+// writeCart answers with the current contents of the cart.
+func (s *Server) writeCart(w http.ResponseWriter, r *http.Request, key store.CartKey) {
+	cart, err := s.stores.Carts.Get(r.Context(), key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cart)
+}
+
+// handleAddCartItem is a HTTP handler function for POST /cart/items that adds units of a product to the cart:
+//
+//	{"product_id": 1, "quantity": 2}
+//
+// The quantity defaults to 1 and is added to the units already in the cart. It answers with the cart.
+func (s *Server) handleAddCartItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	req := cartItemRequest{Quantity: 1}
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	key, _, err := s.cartKey(w, r, true)
+	if err == nil {
+		err = s.stores.Carts.AddItem(r.Context(), key, req.ProductID, req.Quantity)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, r, errUnknownProduct)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.writeCart(w, r, key)
+}
+
+// handleCartItem is a HTTP handler function for one product in the cart at /cart/items/{product_id}.
+// "PUT" sets the quantity in the cart to the one in the body, {"quantity": 3}, where 0 removes the product,
+// and "DELETE" removes the product. Both answer with the cart, an unknown product with "404 Not Found".
+func (s *Server) handleCartItem(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/cart/items/"))
+	if err != nil {
+		writeError(w, r, errNotFound)
+		return
+	}
+
+	var req cartQuantityRequest
+	switch r.Method {
+	case "PUT":
+		if err := s.decode(w, r, &req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case "DELETE":
+	default:
+		methodNotAllowed(w, r, "PUT", "DELETE")
+		return
+	}
+
+	key, _, err := s.cartKey(w, r, req.Quantity > 0)
+	if err == nil {
+		err = s.stores.Carts.SetItem(r.Context(), key, productID, req.Quantity)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.writeCart(w, r, key)
+}
+
+// checkoutRequest is the optional body of POST /cart/checkout. Token names the card to pay with, like in
+// payRequest, and Amount, when given, must be the total the customer was shown.
+type checkoutRequest struct {
+	Token  string   `json:"token"`
+	Amount *float64 `json:"amount"`
+}
+
+func (req *checkoutRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.Amount == nil || *req.Amount > 0, "amount", "must be positive")
+	return errs.Err()
+}
+
+// handleCheckout is a HTTP handler function for POST /cart/checkout that places an order for everything
+// in the cart of the authenticated user and empties the cart, both or neither. It answers with the order,
+// or with "400 Bad Request" when the cart is empty or a product is no longer available in the wanted quantity.
+// The order is paid right away with the card token in the body or, without one, with the default card of the user.
+// A user without a default card who sends no token gets the order awaiting payment, to be paid through
+// POST /orders/{id}/pay. So does a failed payment, which is answered like writePaymentError does, with the
+// Location of the order that is still awaiting payment.
+func (s *Server) handleCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	var req checkoutRequest
+	if err := s.decodeOptional(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user := userFromContext(r.Context())
+	pay := req.Token != ""
+	if !pay {
+		_, err := s.stores.CreditCards.GetDefault(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			writeError(w, r, err)
+			return
+		}
+		pay = err == nil
+	}
+
+	order, err := s.stores.Carts.Checkout(r.Context(), user.ID)
+	if errors.Is(err, store.ErrEmptyCart) {
+		writeError(w, r, store.ErrEmptyCart)
+		return
+	}
+	if err != nil {
+		s.writeOrderError(w, r, err)
+		return
+	}
+	if pay {
+		amount := order.Total
+		if req.Amount != nil {
+			amount = *req.Amount
+		}
+		if err := s.payOrder(r.Context(), order, req.Token, amount); err != nil {
+			w.Header().Set("Location", "/orders/"+strconv.Itoa(order.ID))
+			writePaymentError(w, r, err)
+			return
+		}
+	}
+	writeCreatedOrder(w, order)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"RestAPI/pkg/validate"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// validator is implemented by request bodies that can check their own fields.
+// Validate returns validate.Errors naming every invalid field, and may normalize the fields it checks.
+type validator interface {
+	Validate() error
+}
+
+// readBody reads the body of the request, which must not be larger than config.Server.MaxBodyBytes.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	limit := int64(s.config.Server.MaxBodyBytes)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, newError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, "The request body must not be larger than %d bytes", limit)
+	}
+	if err != nil {
+		return nil, invalidBody(err)
+	}
+	return body, nil
+}
+
+// readJSONBody reads the body of the request like readBody and checks that it is not empty and that its
+// Content-Type is one of the media types.
+func (s *Server) readJSONBody(w http.ResponseWriter, r *http.Request, mediaTypes ...string) ([]byte, error) {
+	body, err := s.readBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, newError(http.StatusBadRequest, codeInvalidBody, "The request body must not be empty")
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	for _, t := range mediaTypes {
+		if mediaType == t {
+			return body, nil
+		}
+	}
+	return nil, newError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be %s", strings.Join(mediaTypes, " or "))
+}
+
+// decode reads the JSON body of the request into v and, if v is a validator, validates it.
+// The body has to be sent as application/json, must not be larger than config.Server.MaxBodyBytes and must hold
+// exactly one JSON value without fields v does not know. Field errors are returned as validate.Errors,
+// anything else wrong with the body as an apiError, both ready for writeError.
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := s.readJSONBody(w, r, "application/json")
+	if err != nil {
+		return err
+	}
+	return decodeJSON(body, v)
+}
+
+// decodeOptional is decode for requests whose body may be left out, an empty body leaves v as it is.
+func (s *Server) decodeOptional(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := s.readBody(w, r)
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return s.decode(w, r, v)
+}
+
+// decodeJSON decodes the body into v like decode does.
+func decodeJSON(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return newError(http.StatusBadRequest, codeInvalidBody, "The request body must hold a single JSON value")
+	}
+	if v, ok := v.(validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// arrayIndex matches the indexes in the field paths of the decoder, "items.0.quantity", to name the field
+// like validators do, "items[0].quantity".
+var arrayIndex = regexp.MustCompile(`\.(\d+)`)
+
+// jsonError turns an error of the JSON decoder into the error the request is answered with.
+// A value of the wrong type and an unknown field are errors of that field, anything else means the body is not valid JSON.
+func jsonError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return validate.Errors{arrayIndex.ReplaceAllString(typeErr.Field, "[$1]"): "must be " + jsonType(typeErr.Type)}
+	}
+	// The decoder reports unknown fields with an error of no particular type.
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		return validate.Errors{strings.Trim(field, `"`): "is not a known field"}
+	}
+	return newError(http.StatusBadRequest, codeInvalidBody, "The request body is not valid JSON: %v", err)
+}
+
+// jsonType describes the JSON value a Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Ptr:
+		return jsonType(t.Elem())
+	}
+	return "an object"
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	stores := store.NewMemory()
+	h := newTestServer(t, stores)
+	token := signUp(t, h, "decoder")
+	staff := signUp(t, h, "decoder_staff")
+	user, err := stores.Users.GetByUsername(context.Background(), "decoder_staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Users.GrantRole(context.Background(), user.ID, models.RoleStaff); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name, method, path, token, contentType, body string
+		status                                       int
+		code                                         string
+		fields                                       []string
+	}{
+		{"no content type", "POST", "/orders", token, "", `{"items": [{"product_id": 1, "quantity": 1}]}`, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, nil},
+		{"form content type", "POST", "/orders", token, "application/x-www-form-urlencoded", `{"items": []}`, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, nil},
+		{"empty body", "POST", "/orders", token, "application/json", "", http.StatusBadRequest, codeInvalidBody, nil},
+		{"syntax error", "POST", "/orders", token, "application/json", `{"items": [`, http.StatusBadRequest, codeInvalidBody, nil},
+		{"two values", "POST", "/orders", token, "application/json", `{"items": []} {}`, http.StatusBadRequest, codeInvalidBody, nil},
+		{"too large", "POST", "/orders", token, "application/json", `{"items": [` + strings.Repeat(`{"product_id": 1, "quantity": 1},`, 40000) + `]}`, http.StatusRequestEntityTooLarge, codeBodyTooLarge, nil},
+		{"unknown field", "POST", "/orders", token, "application/json", `{"items": [], "coupon": "FREE"}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"coupon"}},
+		{"wrong type", "POST", "/orders", token, "application/json; charset=utf-8", `{"items": "all of them"}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"items"}},
+		{"invalid items", "POST", "/orders", token, "application/json", `{"items": [{"product_id": 1, "quantity": 1}, {"quantity": 0}]}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"items[1].product_id", "items[1].quantity"}},
+		{"invalid user", "POST", "/signup", "", "application/json", `{"username": "x!", "email": "nobody", "password": "short"}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"username", "email", "password"}},
+		{"missing login", "POST", "/login", "", "application/json", `{"username": ""}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"username", "password"}},
+		{"invalid product", "POST", "/products", staff, "application/json", `{"name": " ", "price": -1, "quantity": -2}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"name", "price", "quantity"}},
+		{"invalid cart item", "POST", "/cart/items", token, "application/json", `{"quantity": -1}`, http.StatusUnprocessableEntity, codeValidationFailed, []string{"product_id", "quantity"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.contentType != "" {
+				req.Header.Set("Content-Type", c.contentType)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			p := decodeProblem(t, rec)
+			if rec.Code != c.status || p.Code != c.code || len(p.Errors) != len(c.fields) {
+				t.Fatalf("got %d %s", rec.Code, rec.Body)
+			}
+			for _, field := range c.fields {
+				if p.Errors[field] == "" {
+					t.Errorf("no error for %s in %s", field, rec.Body)
+				}
+			}
+		})
+	}
+
+	// A merge patch is validated as the product it produces.
+	product := &models.Product{Name: "Patched", Price: 10, Quantity: 1}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("PATCH", fmt.Sprintf("/products/%d", product.ID), strings.NewReader(`{"price": -5}`))
+	req.Header.Set("Authorization", "Bearer "+staff)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if p := decodeProblem(t, rec); rec.Code != http.StatusUnprocessableEntity || p.Errors["price"] == "" {
+		t.Errorf("patching a negative price: %d %s", rec.Code, rec.Body)
+	}
+}
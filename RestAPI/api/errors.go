@@ -0,0 +1,133 @@
+package api
+
+import (
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes identify the kind of every error response. Clients should switch on them rather than on the
+// status or the detail text: a code never changes its meaning, while details are for humans and may be reworded.
+const (
+	codeBadRequest           = "bad_request"
+	codeInvalidBody          = "invalid_body"
+	codeInvalidQuery         = "invalid_query"
+	codeBodyTooLarge         = "body_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeValidationFailed     = "validation_failed"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeInvalidRefresh       = "invalid_refresh_token"
+	codeForbidden            = "forbidden"
+	codeInvalidCSRFToken     = "invalid_csrf_token"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeUnknownProduct       = "unknown_product"
+	codeOutOfStock           = "out_of_stock"
+	codeEmptyCart            = "empty_cart"
+	codeInvalidTransition    = "invalid_transition"
+	codeAmountMismatch       = "amount_mismatch"
+	codeUnknownCard          = "unknown_card"
+	codeNoCard               = "no_card"
+	codeCardDeclined         = "card_declined"
+	codePaymentFailed        = "payment_failed"
+	codeKeyInProgress        = "idempotency_key_in_progress"
+	codeKeyMismatch          = "idempotency_key_mismatch"
+	codeKeyFailed            = "idempotency_key_failed"
+	codeInternal             = "internal_error"
+)
+
+// apiError is an error that knows how it is answered: with its status, its stable code and a detail
+// that is safe to show to the client. Fields names every invalid field of a request that failed validation.
+type apiError struct {
+	Status int
+	Code   string
+	Detail string
+	Fields map[string]string
+}
+
+func (e *apiError) Error() string { return e.Detail }
+
+// newError returns an apiError with the detail formatted like fmt.Sprintf.
+func newError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errNotFound     = newError(http.StatusNotFound, codeNotFound, "Not found")
+	errUnauthorized = newError(http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+	errForbidden    = newError(http.StatusForbidden, codeForbidden, "Forbidden")
+	errCSRFToken    = newError(http.StatusForbidden, codeInvalidCSRFToken, "Requests authenticated by the jwt cookie must send the csrf_token cookie in the X-CSRF-Token header")
+
+	errInvalidCredentials = newError(http.StatusUnauthorized, codeInvalidCredentials, "Incorrect username or password")
+	errUnknownProduct     = newError(http.StatusBadRequest, codeUnknownProduct, "Unknown product")
+)
+
+// invalidBody is the error for a request body that could not be read or decoded.
+func invalidBody(err error) *apiError {
+	return newError(http.StatusBadRequest, codeInvalidBody, "Invalid request body: %v", err)
+}
+
+// problem is the body of every error response, an RFC 7807 problem details object with the code of the error,
+// the ID of the request it answers and, for validation errors, what is wrong with each invalid field.
+// The type is always "about:blank", the problems are told apart by their code.
+type problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Code      string            `json:"code"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// toAPIError maps the domain errors of the stores and of field validation to the apiError they are answered with.
+// Any other error is internal: it is answered with "500 Internal Server Error" and a detail that reveals nothing
+// about it, and internal reports so, so the caller can log the real error.
+func toAPIError(err error) (e *apiError, internal bool) {
+	var fields validate.Errors
+	switch {
+	case errors.As(err, &e):
+		return e, false
+	case errors.As(err, &fields):
+		e = newError(http.StatusUnprocessableEntity, codeValidationFailed, "The request has invalid fields")
+		e.Fields = fields
+		return e, false
+	case errors.Is(err, store.ErrNotFound):
+		return errNotFound, false
+	case errors.Is(err, store.ErrInvalidTransition):
+		return newError(http.StatusConflict, codeInvalidTransition, "%v", err), false
+	case errors.Is(err, store.ErrConflict):
+		return newError(http.StatusConflict, codeConflict, "The request conflicts with the current state of the resource"), false
+	case errors.Is(err, store.ErrInvalidCursor):
+		return newError(http.StatusBadRequest, codeInvalidQuery, "%v", err), false
+	case errors.Is(err, store.ErrEmptyCart):
+		return newError(http.StatusBadRequest, codeEmptyCart, "Cart is empty"), false
+	}
+	return newError(http.StatusInternalServerError, codeInternal, "An internal error occurred"), true
+}
+
+// writeError answers the request with the problem details of err, see toAPIError.
+// Internal errors are logged together with the request ID the client is given, so a report can be traced back.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, internal := toAPIError(err)
+	if internal {
+		loggerFromContext(r.Context()).Error("internal error", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Status),
+		Status:    e.Status,
+		Detail:    e.Detail,
+		Code:      e.Code,
+		RequestID: requestIDFromContext(r.Context()),
+		Errors:    e.Fields,
+	})
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// brokenProducts fails to read any product like a database that lost a table would.
+type brokenProducts struct{ store.ProductStore }
+
+func (brokenProducts) Get(ctx context.Context, id int) (*models.Product, error) {
+	return nil, errors.New(`pq: relation "products" does not exist`)
+}
+
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder) problem {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type %q, want application/problem+json", ct)
+	}
+	var p problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decoding problem from %d %s: %v", rec.Code, rec.Body, err)
+	}
+	if p.Status != rec.Code || p.RequestID == "" || p.RequestID != rec.Header().Get("X-Request-ID") {
+		t.Errorf("problem %+v answered with %d and X-Request-ID %q", p, rec.Code, rec.Header().Get("X-Request-ID"))
+	}
+	return p
+}
+
+func TestErrorResponses(t *testing.T) {
+	stores := store.NewMemory()
+	stores.Products = brokenProducts{stores.Products}
+	var logged strings.Builder
+	h := newLoggingTestServer(t, stores, slog.New(slog.NewJSONHandler(&logged, nil)))
+	token := signUp(t, h, "problems")
+
+	req := httptest.NewRequest("GET", "/no/such/route", nil)
+	req.Header.Set("X-Request-ID", "trace-42")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if p := decodeProblem(t, rec); rec.Code != http.StatusNotFound || p.Code != codeNotFound || p.RequestID != "trace-42" {
+		t.Errorf("unknown route: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "DELETE", "/cart/checkout", token, "")
+	if p := decodeProblem(t, rec); rec.Code != http.StatusMethodNotAllowed || p.Code != codeMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("wrong method: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "POST", "/orders", token, "{")
+	if p := decodeProblem(t, rec); rec.Code != http.StatusBadRequest || p.Code != codeInvalidBody {
+		t.Errorf("invalid body: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "POST", "/credit-cards", token, `{"card_number": "4242424242424241"}`)
+	if p := decodeProblem(t, rec); rec.Code != http.StatusUnprocessableEntity || p.Code != codeValidationFailed || p.Errors["card_number"] == "" || p.Errors["cvv"] == "" {
+		t.Errorf("invalid card: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "GET", "/orders/1", "not-a-token", "")
+	if p := decodeProblem(t, rec); rec.Code != http.StatusUnauthorized || p.Code != codeUnauthorized {
+		t.Errorf("invalid token: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "POST", "/signup", "", `{"username": "problems", "email": "other@example.com", "password": "password"}`)
+	if p := decodeProblem(t, rec); rec.Code != http.StatusConflict || p.Code != codeConflict {
+		t.Errorf("taken username: %d %s", rec.Code, rec.Body)
+	}
+
+	logged.Reset()
+	rec = do(h, "GET", "/products/1", token, "")
+	p := decodeProblem(t, rec)
+	if rec.Code != http.StatusInternalServerError || p.Code != codeInternal || strings.Contains(rec.Body.String(), "pq:") {
+		t.Errorf("internal error is not masked: %d %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logged.String(), `"request_id":"`+p.RequestID+`"`) || !strings.Contains(logged.String(), `relation \"products\" does not exist`) {
+		t.Errorf("internal error is not logged with the request ID: %q", logged.String())
+	}
+}
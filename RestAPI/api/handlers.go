@@ -1,276 +1,364 @@
 package api
 
 import (
-	"RestAPI/pkg/database"
 	"RestAPI/pkg/models"
-	"database/sql"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
+	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/golang-jwt/jwt"
-	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// The handleProducts function is a HTTP handler function that routes requests to the appropriate function based on the request method.
-// It starts by checking the request method, it could be "POST", "PUT", "DELETE" and "GET",
-// if the request method is "POST" it will call the createProduct(w, r) function,
-// if the request method is "PUT" it will call the handleUpdateProduct(w, r) function,
-// if the request method is "DELETE" it will call the handleDeleteProduct(w, r) function,
+// The handleProducts function is a HTTP handler function for the /products collection that routes requests
+// to the appropriate function based on the request method.
+// if the request method is "POST" it will call the s.createProduct(w, r) function,
 // and if the request method is "GET" it will call the handleGetProducts(w, r) function.
-func handleProducts(w http.ResponseWriter, r *http.Request) {
+// Any other method is answered with "405 Method Not Allowed" and an Allow header listing the supported ones.
+func (s *Server) handleProducts(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		createProduct(w, r)
+		s.createProduct(w, r)
+	case "GET":
+		s.handleGetProducts(w, r)
+	default:
+		methodNotAllowed(w, r, "GET", "POST")
+	}
+}
+
+// The handleProduct function is a HTTP handler function for a single product resource at /products/{id}.
+// It takes the product ID from the URL path, an ID that is not a number can never match a product so it is answered with "404 Not Found".
+// Then it routes the request based on the request method:
+// "GET" calls handleGetProduct, "PUT" calls handleUpdateProduct, "PATCH" calls handlePatchProduct
+// and "DELETE" calls handleDeleteProduct. Any other method is answered with "405 Method Not Allowed".
+func (s *Server) handleProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/products/"))
+	if err != nil {
+		writeError(w, r, errNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.handleGetProduct(w, r, id)
 	case "PUT":
-		handleUpdateProduct(w, r)
+		s.handleUpdateProduct(w, r, id)
+	case "PATCH":
+		s.handlePatchProduct(w, r, id)
 	case "DELETE":
-		handleDeleteProduct(w, r)
-	case "GET":
-		handleGetProducts(w, r)
+		s.handleDeleteProduct(w, r, id)
+	default:
+		methodNotAllowed(w, r, "GET", "PUT", "PATCH", "DELETE")
+	}
+}
+
+// methodNotAllowed answers with "405 Method Not Allowed" and sets the Allow header to the given methods.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, newError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method %s is not allowed", r.Method))
+}
+
+// handleGetProduct is a HTTP handler function that returns the product with the given ID as a JSON object,
+// or "404 Not Found" if there is no such product.
+func (s *Server) handleGetProduct(w http.ResponseWriter, r *http.Request, id int) {
+	product, err := s.stores.Products.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	writeJSON(w, http.StatusOK, product)
 }
 
 // This function is a handler for HTTP requests to create a new product.
-// It creates a new product by decoding a JSON object from the request body, inserting it into a PostgreSQL database,
+// It creates a new product by decoding a JSON object from the request body, saving it through the ProductStore,
 // and returning the product's ID and other details in the response body.
 // The function starts by checking if the request method is "POST", and if not,
 // it returns an error with a status code of "405 Method Not Allowed".
 // Then, it creates a new Product struct variable and decodes the request body into that
-// struct using json.NewDecoder. If there is an error with decoding, it returns an error with a status code of "400 Bad Request".
-// It then constructs a connection string to a PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables, and
-// opens a connection to the database using sql.Open. If there is an error connecting to the database, it returns an error with a status code of "500 Internal Server Error".
-// It then perform a "ping" to the database to check the connection,
-// if it fails returns an error with a status code of "500 Internal Server Error"
-// Then it creates an SQL query to insert the product details into the "products" table and retrieve the newly-assigned ID.
-//  It uses the product's name, description, and price in the query.
+// struct using decode. If there is an error with decoding, it returns an error with a status code of "400 Bad Request",
+// and a product with invalid fields is answered with "422 Unprocessable Entity" listing all of them.
+// It then asks the ProductStore to create the product, which fills in the newly-assigned ID.
+// If the store fails it returns an error with a status code of "500 Internal Server Error".
 // Finally, it sets the "Content-Type" header of the response to "application/json" and writes the product's
 // ID and other details to the response body using json.NewEncoder
 
 // It also sets the status code of the response to "201 Created" if there is no error.
-func createProduct(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createProduct(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "POST")
 		return
 	}
 
 	var product models.Product
-	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := s.decode(w, r, &product); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	user := userFromContext(r.Context())
+	product.CreatedBy, product.UpdatedBy = user.ID, user.ID
 
-	query := `
-		INSERT INTO products (name, description, price)
-		VALUES ($1, $2, $3)
-		RETURNING id
-	`
-	var id int
-	if err := database.GetDb().QueryRow(query, product.Name, product.Description, product.Price).Scan(&id); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.stores.Products.Create(r.Context(), &product); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	product.ID = id
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(product); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	writeJSON(w, http.StatusCreated, product)
 }
 
 // This  function handleUpdateProduct which is a HTTP handler function that
-// updates an existing product in a PostgreSQL database.
-// It starts by decoding a JSON object from the request body, this JSON object should contain the updated product details.
-// If there is an error with decoding, it returns an error with a status code of "400 Bad Request".
-// It then constructs a connection string to a PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables, and opens a connection
-// to the database using sql.Open. If there is an error connecting to the database, it returns an error with a status code of "500 Internal Server Error".
-// It then perform a "ping" to the database to check the connection,
-// if it fails returns an error with a status code of "500 Internal Server Error"
-// Then it creates an SQL query to update the product details in the "products" table using the ID, Name
-// , Description, and Price fields of the product struct in the request body. It uses the db.Exec to execute the query
-// If there is an error executing the query, it returns an error with a
+// replaces an existing product through the ProductStore.
+// It starts by decoding a JSON object from the request body, this JSON object should contain the complete updated product details.
+// If there is an error with decoding, it returns an error with a status code of "400 Bad Request",
+// and invalid fields are answered with "422 Unprocessable Entity".
+// Then it asks the ProductStore to replace the Name, Description, Price and Quantity
+// of the product with the ID from the URL path, any ID in the body is ignored.
+// If the product does not exist it returns "404 Not Found", and any other store error is returned with a
 // status code of "500 Internal Server Error"
-// If everything goes well it sets the
-//
-//	status code of the response to "200 OK"
-//
-// It is worth noting that, the ID field must be present in the request body and must match
-// an existing product ID in the database in order to update the product correctly.
-func handleUpdateProduct(w http.ResponseWriter, r *http.Request) {
+// If everything goes well it returns the updated product with a status code of "200 OK"
+func (s *Server) handleUpdateProduct(w http.ResponseWriter, r *http.Request, id int) {
 	var product models.Product
-	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := s.decode(w, r, &product); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	fmt.Println("DB CONNECTED")
-	query := `
-		UPDATE products
-		SET name = $2, description = $3, price = $4
-		WHERE id = $1
-	`
-	if _, err := database.GetDb().Exec(query, product.ID, product.Name, product.Description, product.Price); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	existing, err := s.stores.Products.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	product.ID = id
+	product.CreatedBy = existing.CreatedBy
+	product.UpdatedBy = userFromContext(r.Context()).ID
+	if err := s.stores.Products.Update(r.Context(), &product); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, product)
 }
 
-// This function handleDeleteProduct which is a HTTP handler function that delete an existing
-//  product from a PostgreSQL database.
-
-// It starts by decoding a JSON object from the request body, this JSON object should contain
-//  the ID of the product that needs to be deleted. If there is an error with decoding, it returns an error with a status code of "400 Bad Request".
-
-// It then constructs a connection string to a PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables,
-//  and opens a connection to the database using sql.Open. If there is an error connecting to the database,
-//  it returns an error with a status code of "500 Internal Server Error".
-
-// It then perform a "ping" to the database to check the connection,
-// if it fails returns an error with a status code of "500 Internal Server Error"
-
-// Then it creates an SQL query to delete the product from the "products" table using the ID of the product struct in the request body.
-// It uses the db.Exec to execute the query
-// If there is an error executing the query, it returns an error with a status code of "500 Internal Server Error"
-// If everything goes well it sets the status code of the response to "200 OK"
-
-// It is worth noting that, the ID field must be present in the request body and must match an existing product ID in the database in order to delete the product correctly.
+// This function handlePatchProduct which is a HTTP handler function that partially updates an existing product.
+// The request body is a JSON Merge Patch (RFC 7386): fields present in it replace the stored ones,
+// fields set to null are reset to their zero value and fields left out keep their current value.
+// It loads the current product (answering "404 Not Found" if there is none), applies the patch to its JSON form,
+// and saves the result through the ProductStore the same way handleUpdateProduct does.
+// The patch is sent as application/merge-patch+json or application/json. A body that is not valid JSON is
+// answered with "400 Bad Request", and a patch that produces an invalid product with "422 Unprocessable Entity".
+func (s *Server) handlePatchProduct(w http.ResponseWriter, r *http.Request, id int) {
+	patch, err := s.readJSONBody(w, r, "application/merge-patch+json", "application/json")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-func handleDeleteProduct(w http.ResponseWriter, r *http.Request) {
-	var product models.Product
-	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	product, err := s.stores.Products.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	current, err := json.Marshal(product)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	patched, err := mergePatch(current, patch)
+	if err != nil {
+		writeError(w, r, invalidBody(err))
 		return
 	}
 
-	query := "DELETE FROM products WHERE id = $1"
-	if _, err := database.GetDb().Exec(query, product.ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var updated models.Product
+	if err := decodeJSON(patched, &updated); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	updated.ID = id
+	updated.CreatedBy = product.CreatedBy
+	updated.UpdatedBy = userFromContext(r.Context()).ID
+	if err := s.stores.Products.Update(r.Context(), &updated); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, updated)
 }
 
-// handleGetProducts is a HTTP handler function that retrieves a list of products from a PostgreSQL database,
-// and returns the product details in the response body as a JSON object. It starts by constructing a
-// connection string to the PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables,
-// and opens a connection to the database using sql.Open. It then checks the connection by pinging the database,
-// if it fails returns an error with a status code of "500 Internal Server Error"
+// This function handleDeleteProduct which is a HTTP handler function that delete an existing
+//  product through the ProductStore.
+
+// It asks the ProductStore to delete the product with the ID from the URL path.
+// If no such product exists it returns "404 Not Found", any other store error is returned with a status code of "500 Internal Server Error"
+// If everything goes well it sets the status code of the response to "204 No Content"
+func (s *Server) handleDeleteProduct(w http.ResponseWriter, r *http.Request, id int) {
+	if err := s.stores.Products.Delete(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-// It then creates an SQL query to select all products from the "products" table,
-//  and executes that query using the db.Query method. If there is an error executing the query,
-// it returns an error with a status code of "500 Internal Server Error"
+	w.WriteHeader(http.StatusNoContent)
+}
 
-// It then scans the query results row by row, and creates a new Product struct variable for each row, with ID, Name, Description,
-// and Price fields populated from the corresponding columns in the current row.
+// handleGetProducts is a HTTP handler function that retrieves one page of products from the ProductStore,
+// and returns the product details in the response body as a JSON object.
+// The page is selected with the query parameters parsed by parseProductQuery. Invalid parameters
+// are answered with "400 Bad Request", and if the store fails it returns an error with a status code of "500 Internal Server Error"
 
-// It then set the "Content-Type" header of the response to "application/json" and write the array
-//  of product struct in the response body using json.NewEncoder
+// It then set the "Content-Type" header of the response to "application/json" and write a productList
+// envelope in the response body using json.NewEncoder. Its next_cursor is passed back as the cursor
+// parameter to fetch the following page, and is null on the last page.
 
-func handleGetProducts(w http.ResponseWriter, r *http.Request) {
-	query := "SELECT id, name, description, price FROM products"
-	rows, err := database.GetDb().Query(query)
+func (s *Server) handleGetProducts(w http.ResponseWriter, r *http.Request) {
+	query, err := parseProductQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, newError(http.StatusBadRequest, codeInvalidQuery, "%v", err))
 		return
 	}
-	defer rows.Close()
 
-	var products []models.Product
-	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		products = append(products, p)
+	page, err := s.stores.Products.List(r.Context(), query)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	list := productList{Products: page.Products, Total: page.Total}
+	if page.Next != nil {
+		next := page.Next.Encode()
+		list.NextCursor = &next
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(products); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	writeJSON(w, http.StatusOK, list)
+}
+
+// productList is the response envelope of GET /products.
+type productList struct {
+	Products   []models.Product `json:"products"`
+	NextCursor *string          `json:"next_cursor"`
+	Total      int              `json:"total"`
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parseProductQuery turns the query parameters of GET /products into a store.ProductQuery:
+//
+//	limit        page size, 20 by default and at most 100
+//	cursor       next_cursor of the previous page
+//	min_price    only products costing at least this much
+//	max_price    only products costing at most this much
+//	name_prefix  only products whose name starts with this
+//	sort         id, name or price, prefixed with "-" for descending order; id by default
+func parseProductQuery(values url.Values) (store.ProductQuery, error) {
+	query := store.ProductQuery{Limit: defaultPageSize, Sort: store.SortByID, NamePrefix: values.Get("name_prefix")}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return query, fmt.Errorf("limit must be a number between 1 and %d", maxPageSize)
+		}
+		query.Limit = limit
+	}
+	for name, target := range map[string]**float64{"min_price": &query.MinPrice, "max_price": &query.MaxPrice} {
+		if v := values.Get(name); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return query, fmt.Errorf("%s must be a number", name)
+			}
+			*target = &price
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		query.Descending = strings.HasPrefix(v, "-")
+		query.Sort = strings.TrimPrefix(v, "-")
+		switch query.Sort {
+		case store.SortByID, store.SortByName, store.SortByPrice:
+		default:
+			return query, fmt.Errorf("sort must be one of id, name or price, optionally prefixed with -")
+		}
 	}
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := store.DecodeCursor(v)
+		if err != nil {
+			return query, err
+		}
+		query.Cursor = cursor
+	}
+	return query, nil
 }
 
 // This function handleSignUp which is a HTTP handler function that allows new users to sign up for an account.
 // It starts by decoding a JSON object from the request body, this JSON object should contain the new user details
-// such as the username, email, and password. If there is an error with decoding, it returns an error with a status code of "400 Bad Request".
+// such as the username, email, and password. If there is an error with decoding, it returns an error with a status code of "400 Bad Request",
+// and if User.Validate rejects the details it answers "422 Unprocessable Entity" naming every invalid field.
 
 // It then creates a salted and hashed version of the user's password using the bcrypt library,
 // which is a widely-used library for password hashing. This is done to protect against password
 // cracking attacks by making it computationally infeasible to recover the original plaintext password from
 // the hashed version stored in the database.
 
-// Then it creates a connection string to a PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables,
-// and opens a connection to the database using sql.Open. If there is an error connecting to the database,
-//  it returns an error with a status code of "500 Internal Server Error".
-
-// It then Inserts the new user into the database with an INSERT INTO statement, using the db.Exec method.
-// It performs a check for the presence of email in the database and returns an error with a status code of "400 Bad Request
+// It then saves the new user with the customer role through the UserStore, which fills in the new user's ID.
+// If the username or the email is already registered the store reports a conflict and it returns an error with a status code of "409 Conflict".
 
-// It then generates a JSON web token(JWT) for the authenticated user with a signing method of HS256 and
-// claims such as the "sub"(subject) and "exp"(expiration) set to the user's ID and 24 hours respectively.
+// It then starts a session for the new user by calling startSession, which returns
+// an access token and a refresh token in a JSON object with a header of "201 Created".
 
-// It signs the JWT with a secret key and sets the JWT as an HTTP cookie, with the token
-// string as the value, it expires after 24 hours and path is set to '/'
-
-func handleSignUp(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleSignUp(w http.ResponseWriter, r *http.Request) {
 	var newuser models.User
-	if err := json.NewDecoder(r.Body).Decode(&newuser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := s.decode(w, r, &newuser); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	fmt.Println("IN SIGN UP")
 	// Validate the user data and hash the password
 	// You can use the bcrypt library to hash the password before storing it in the database.
 	// https://godoc.org/golang.org/x/crypto/bcrypt
+	// Hashing is slow on purpose, the span shows how much of the request it takes.
+	_, span := tracer.Start(r.Context(), "bcrypt.GenerateFromPassword")
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newuser.Password), bcrypt.DefaultCost)
+	span.End()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	newuser.Password = string(hashedPassword)
+	// Every new user starts out as a plain customer, whatever roles the request asked for
+	newuser.Roles = []string{models.RoleCustomer}
 	// Insert the new user into the database
-	_, err = database.GetDb().Exec("INSERT INTO users (username, email, password) SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM users WHERE email=$2)", newuser.Username, newuser.Email, newuser.Password)
-	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
-		http.Error(w, "Email already exists", http.StatusBadRequest)
+	err = s.stores.Users.Create(r.Context(), &newuser)
+	if errors.Is(err, store.ErrConflict) {
+		writeError(w, r, newError(http.StatusConflict, codeConflict, "Username or email already exists"))
 		return
 	}
 	if err != nil {
-		http.Error(w, "Email already exists", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	// Generate a JWT for the new user
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["sub"] = newuser.ID
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
+	s.metrics.Signup()
 
-	// Sign the JWT with a secret key
-	key := []byte("my-secret-key")
-	tokenString, err := token.SignedString(key)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	// Generate the tokens for the new user
+	s.startSession(w, r, &newuser)
+}
 
+// dummyHash is a bcrypt hash with the default cost that login compares the password against for unknown usernames.
+var dummyHash = []byte("$2a$10$elNYic5cCBcK/bvpH0d9M.OAbDg7uhNWGNgqQ7p4p3/D7EO5q0keO")
+
+// loginRequest is the body of POST /login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (req *loginRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.Username != "", "username", "is required")
+	errs.Check(req.Password != "", "password", "is required")
+	return errs.Err()
 }
 
 // This function handleLogin which is a HTTP handler function that allows existing users to log in to their account.
@@ -279,253 +367,120 @@ func handleSignUp(w http.ResponseWriter, r *http.Request) {
 // the login details such as the username and password. If there is an error with decoding,
 //  it returns an error with a status code of "400 Bad Request".
 
-// Then it creates a connection string to a PostgreSQL database using the "host", "port", "user", "password", and "dbname" variables
-// , and opens a connection to the database using sql.Open. If there is an error connecting to the database, it returns an error
-// with a status code of "500 Internal Server Error".
-
-// It queries the user's data from the database using the db.QueryRow method, with the username and password as
-//  the query parameters. It scans the row returned by the query for the password, which is then stored in the storedPassword variable.
+// It looks the user up by username through the UserStore. An unknown username is answered with "401 Unauthorized"
+// after comparing the password against a dummy hash, so that it takes as long as a wrong password,
+// and any other store error with a status code of "500 Internal Server Error".
 
 // The function then compares the hashed password stored in the database with the plain text password provided
 // by the user using the bcrypt library's CompareHashAndPassword method. If the hashed password doesn't match the provided password,
 // then it returns an error with a status code of "401 Unauthorized".
 
-// It then generates a JSON web token(JWT) for the authenticated user with a signing method of HS256 and
-// claims such as the "sub"(subject) and "exp"(expiration) set to the user's ID and 24 hours respectively.
-
-// It signs the JWT with a secret key and sets the JWT as an HTTP cookie, with the token string as the value,
-//  it expires after 24 hours and path is set to '/'
-// It then returns the token in a JSON object with a header of "201 Created"
+// It then starts a session for the authenticated user by calling startSession, which sets the access token
+// as the "jwt" cookie and returns it together with a refresh token in a JSON object with a header of "201 Created"
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	var newuser models.User
-	if err := json.NewDecoder(r.Body).Decode(&newuser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var login loginRequest
+	if err := s.decode(w, r, &login); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	var storedPassword string
-	database.GetDb().QueryRow("SELECT password FROM users WHERE username=$1", newuser.Username).Scan(&storedPassword)
-	// if err != nil {
-	// 	if err == sql.ErrNoRows {
-	// 		http.Error(w, "Incorrect username or password", http.StatusUnauthorized)
-	// 	} else {
-	// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	// 	}
-	// 	return
-	// }
-
-	// Compare the hashed password with the provided password
-	if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(newuser.Password)); err != nil {
-		http.Error(w, "Incorrect username or password", http.StatusUnauthorized)
-		return
-	}
-
-	// Generate a JWT for the authenticated user
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["sub"] = newuser.ID
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-
-	// Sign the JWT with a secret key
-	key := []byte("my-secret-key")
-	tokenString, err := token.SignedString(key)
+	user, err := s.stores.Users.GetByUsername(r.Context(), login.Username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Set the JWT as an HTTP cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "jwt",
-		Value:   tokenString,
-		Expires: time.Now().Add(time.Hour * 24),
-		Path:    "/",
-	})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
-}
-
-// This function handleAddCreditCard is handling the adding of a credit card for an authenticated user. It does this by:
-
-// Extracting the JWT token from the request's Authorization header and validating it using the jwt library.
-// Extracting the user ID from the claims of the parsed JWT and storing it in a variable.
-// Decoding the JSON body of the request into a CreditCard struct
-// Setting the user_id of the creditCard struct to the authenticated user's ID
-// Connecting to the PostgreSQL database using the sql package and executing an insert statement
-// to insert the credit card to the credit_cards table of the database same as previously
-// If there are no errors, it sends the added card in JSON format as the response.
-// If any error occurs, it sends an error response with appropriate HTTP status code.
-func handleAddCreditCard(w http.ResponseWriter, r *http.Request) {
-	// Get the authenticated user ID from the request context
-	tokenString := r.Header.Get("Authorization")
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// verify the signing algorithm and secret key
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		if errors.Is(err, store.ErrNotFound) {
+			// Hash the password all the same, so the time of the answer does not tell whether the username exists.
+			_, span := tracer.Start(r.Context(), "bcrypt.CompareHashAndPassword")
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(login.Password))
+			span.End()
+			s.metrics.Login(false)
+			writeError(w, r, errInvalidCredentials)
+		} else {
+			writeError(w, r, err)
 		}
-		return []byte("my-secret-key"), nil
-	})
-	if err != nil {
-		http.Error(w, "Invalid JWT", http.StatusUnauthorized)
-		return
-	}
-
-	// extract the user ID from the JWT
-	userID, ok := token.Claims.(jwt.MapClaims)["user_id"]
-	if !ok {
-		http.Error(w, "Invalid JWT", http.StatusUnauthorized)
 		return
 	}
 
-	var creditCard models.CreditCard
-	if err := json.NewDecoder(r.Body).Decode(&creditCard); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	fmt.Print(userID)
-	// Set the user ID of the credit card to the authenticated user's ID
-	creditCard.UserID = 1
-
-	// Connect to the database and insert the credit card
-
-	_, err = database.GetDb().Exec("INSERT INTO credit_cards (user_id, card_number, expiry_month, expiry_year, cvv, name_on_card) VALUES ($1, $2, $3, $4, $5, $6)", creditCard.UserID, creditCard.CardNumber, creditCard.ExpiryMonth, creditCard.ExpiryYear, creditCard.CVV, creditCard.NameOnCard)
+	// Compare the hashed password with the provided password
+	_, span := tracer.Start(r.Context(), "bcrypt.CompareHashAndPassword")
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(login.Password))
+	span.End()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.metrics.Login(false)
+		writeError(w, r, errInvalidCredentials)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(creditCard)
-}
+	s.metrics.Login(true)
 
-// func createCharge(productID, token string) error {
-// 	// Set your secret key: remember to change this to your live secret key in production
-// 	// See your keys here: https://dashboard.stripe.com/account/apikeys
-// 	stripe.Key = "sk_test_4eC39HqLyjWDarjtT1zdp7dc"
-
-// 	// Get the product details
-// 	product, err := getProduct(productID)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	// Convert the price to cents
-// 	priceInCents := product.Price * 100
-
-// 	// Create the charge
-// 	chargeParams := &stripe.ChargeParams{
-// 		Amount:   stripe.Float64(priceInCents),
-// 		Currency: stripe.String("usd"),
-// 		Source:   &stripe.SourceParams{Token: token},
-// 		Metadata: map[string]string{"product_id": productID},
-// 	}
-// 	chargeParams.SetDescription(product.Name)
-// 	_, err = charge.New(chargeParams)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	return nil
-// }
-
-// The getProduct Method is used by handle Purchase
-// it queries the database and get all products based on product id
-func getProduct(productID string) (*models.Product, error) {
-	// Connect to the database
-	var err error
-	// Execute the SELECT statement
-	row := database.GetDb().QueryRow("SELECT * FROM products WHERE product_id = $1", productID)
-
-	// Scan the result into a product struct
-	var product models.Product
-	err = row.Scan(&product.ID, &product.Name, &product.Quantity, &product.Price)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("Product not found")
-		}
-		return nil, err
-	}
-
-	return &product, nil
-}
-
-// The updateProduct Method is used by handle Purchase
-// // it queries the database and update the products
-func updateProduct(product *models.Product) error {
-	// Connect to the database
-	var err error
-
-	// Execute the UPDATE statement
-	_, err = database.GetDb().Exec("UPDATE products SET name = $1, quantity = $2, price = $3 WHERE product_id = $4", product.Name, product.Quantity, product.Price, product.ID)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Generate the tokens for the authenticated user
+	s.startSession(w, r, user)
 }
 
 // This handlePurchase function appears to handle a request to purchase a product. It does this by:
 
-// Getting the product ID, payment token and amount from the request body.
-// It creates a charge by calling createCharge function which uses Stripe Library
-//
-
-// It get the product from database by calling getProduct function
-
-// If the product is available, it deducts the quantity from the inventory
-// and updates the product in the database by calling updateProduct function.
-// At the end it returns a success response to the user.
-func handlePurchase(w http.ResponseWriter, r *http.Request) {
+// Getting the product ID, quantity, payment token and amount from the request body.
+// The token is a card token of the payment provider or of a saved card, without one the default card is charged.
+// It places an order for the requested quantity (1 unless the "quantity" parameter says otherwise)
+// through the OrderStore, which checks and decrements the stock in one transaction so that
+// concurrent buyers can never take more units than there are.
+// It then charges the order total to the payment token through the payment gateway, after checking
+// that the amount the customer agreed to is still the total. When the payment fails the order is
+// cancelled again, which puts the units back in stock.
+// At the end it returns the paid order to the user.
+func (s *Server) handlePurchase(w http.ResponseWriter, r *http.Request) {
 	// Get the product ID and the payment details from the request body
-	productID := r.FormValue("productID")
-	if productID == "" {
-		http.Error(w, "Missing productID parameter", http.StatusBadRequest)
+	productID, err := strconv.Atoi(r.FormValue("productID"))
+	if err != nil {
+		writeError(w, r, newError(http.StatusBadRequest, codeBadRequest, "Missing productID parameter"))
 		return
 	}
+	quantity := 1
+	if v := r.FormValue("quantity"); v != "" {
+		if quantity, err = strconv.Atoi(v); err != nil || quantity < 1 {
+			writeError(w, r, newError(http.StatusBadRequest, codeBadRequest, "quantity must be a positive integer"))
+			return
+		}
+	}
+	// Without a token the default card of the user is charged, so there has to be one
 	token := r.FormValue("token")
 	if token == "" {
-		http.Error(w, "Missing token parameter", http.StatusBadRequest)
-		return
-	}
-	amount := r.FormValue("amount")
-	if amount == "" {
-		http.Error(w, "Missing amount parameter", http.StatusBadRequest)
-		return
+		_, err := s.stores.CreditCards.GetDefault(r.Context(), userFromContext(r.Context()).ID)
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNoCard
+		}
+		if err != nil {
+			writePaymentError(w, r, err)
+			return
+		}
 	}
-
-	// Create a charge using the Stripe API
-	// _, err := createCharge(productID, token)
-	// if err != nil {
-	// 	http.Error(w, err.Error(), http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// Get the product from the database
-	product, err := getProduct(productID)
+	amount, err := strconv.ParseFloat(r.FormValue("amount"), 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, newError(http.StatusBadRequest, codeBadRequest, "Missing amount parameter"))
 		return
 	}
 
-	// Check the availability of the product
-	if product.Quantity <= 0 {
-		http.Error(w, "Product out of stock", http.StatusBadRequest)
+	// Deduct the quantity from the inventory and record the order
+	order := &models.Order{
+		UserID: userFromContext(r.Context()).ID,
+		Items:  []models.OrderItem{{ProductID: productID, Quantity: quantity}},
+	}
+	if err := s.stores.Orders.Create(r.Context(), order); err != nil {
+		s.writeOrderError(w, r, err)
 		return
 	}
 
-	// Deduct the quantity from the inventory
-	product.Quantity--
-
-	// Update the product in the database
-	err = updateProduct(product)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Charge the order through the payment gateway
+	if err := s.payOrder(r.Context(), order, token, amount); err != nil {
+		s.cancelUnpaid(r.Context(), order)
+		writePaymentError(w, r, err)
 		return
 	}
+	writeCreatedOrder(w, order)
+}
 
-	// Return a success response
-	fmt.Fprintf(w, "Product purchased successfully")
+// writeJSON sets the "Content-Type" header to "application/json", writes the status code
+// and encodes v as the response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
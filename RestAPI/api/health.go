@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds every readiness check, so that a database that hangs fails the probe instead of stalling it.
+const readinessTimeout = 2 * time.Second
+
+// errShuttingDown is the readiness failure of a server that was told to drain.
+var errShuttingDown = errors.New("the server is shutting down")
+
+// ReadinessCheck reports whether a dependency the server needs to answer requests, such as the database,
+// is usable. The error says what is wrong and is shown in the /readyz response, so it must not carry secrets.
+type ReadinessCheck func(ctx context.Context) error
+
+// namedCheck is a ReadinessCheck with the name /readyz reports it under.
+type namedCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+// AddReadinessCheck makes /readyz run the check under the name. It has to be called before the server answers requests.
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.checks = append(s.checks, namedCheck{name, check})
+}
+
+// Drain makes /readyz fail from now on, so that load balancers stop sending requests to a server that is shutting down.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// checkResult is the outcome of one readiness check in the /readyz response.
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse is the body of /healthz and /readyz.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// handleHealthz is a HTTP handler function for GET /healthz, the liveness probe. It answers "200 OK" as long as
+// the process is able to answer at all, without looking at the database, so that an unavailable database does not
+// get the process restarted.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReadyz is a HTTP handler function for GET /readyz, the readiness probe. It runs every readiness check,
+// each within readinessTimeout, and answers "200 OK" when all of them pass and the server is not shutting down,
+// and "503 Service Unavailable" otherwise. Either way the body lists the result of every check:
+//
+//	{"status": "unavailable", "checks": {"database": {"status": "ok"}, "migrations": {"status": "failing", "error": "at version 11, want 12"}, "shutdown": {"status": "ok"}}}
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+	resp := healthResponse{Status: "ready", Checks: map[string]checkResult{}}
+	status := http.StatusOK
+	report := func(name string, err error) {
+		if err == nil {
+			resp.Checks[name] = checkResult{Status: "ok"}
+			return
+		}
+		resp.Checks[name] = checkResult{Status: "failing", Error: err.Error()}
+		resp.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+		loggerFromContext(r.Context()).Warn("readiness check failed", "check", name, "error", err)
+	}
+
+	for _, c := range s.checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		report(c.name, c.check(ctx))
+		cancel()
+	}
+	var shutdown error
+	if s.draining.Load() {
+		shutdown = errShuttingDown
+	}
+	report("shutdown", shutdown)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	s := testServer(t, store.NewMemory(), slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+	var migrationsErr error
+	s.AddReadinessCheck("database", func(ctx context.Context) error { return nil })
+	s.AddReadinessCheck("migrations", func(ctx context.Context) error { return migrationsErr })
+	h := s.Router()
+
+	ready := func(wantStatus int, want map[string]string) {
+		t.Helper()
+		rec := do(h, "GET", "/readyz", "", "")
+		var resp healthResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != wantStatus || len(resp.Checks) != len(want) {
+			t.Fatalf("got %d %+v, want %d", rec.Code, resp, wantStatus)
+		}
+		for name, status := range want {
+			if resp.Checks[name].Status != status {
+				t.Errorf("%s is %+v, want %s", name, resp.Checks[name], status)
+			}
+		}
+	}
+
+	if rec := do(h, "GET", "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("healthz: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(h, "POST", "/readyz", "", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /readyz: %d %s", rec.Code, rec.Body)
+	}
+	ready(http.StatusOK, map[string]string{"database": "ok", "migrations": "ok", "shutdown": "ok"})
+
+	migrationsErr = errors.New("at version 11, want 12")
+	ready(http.StatusServiceUnavailable, map[string]string{"database": "ok", "migrations": "failing", "shutdown": "ok"})
+
+	migrationsErr = nil
+	s.Drain()
+	ready(http.StatusServiceUnavailable, map[string]string{"database": "ok", "migrations": "ok", "shutdown": "failing"})
+	if rec := do(h, "GET", "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("healthz while draining: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader names the header clients put a unique key into, to make retrying a request safe.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKeyLength is the longest key accepted, long enough for any UUID or random token.
+	maxIdempotencyKeyLength = 255
+	// idempotencyStoreTimeout limits storing the response to a key once the request is done. The request context
+	// is not used for that because it is cancelled when the client gives up, which is exactly when it will retry.
+	idempotencyStoreTimeout = 5 * time.Second
+)
+
+// isMutating reports whether requests with the method change something and can carry an Idempotency-Key.
+func isMutating(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// responseRecorder buffers a response so it can be stored before it is sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// writeStoredResponse sends a recorded or stored response to the client.
+func writeStoredResponse(w http.ResponseWriter, response *models.StoredResponse) {
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(response.Body)
+}
+
+// requestHash returns the hex encoded SHA-256 hash of the method, path, query and body of the request,
+// which tells a retry of the request apart from a different request reusing the same key.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent is a middleware that makes mutating requests sent with an Idempotency-Key header safe to retry.
+// The first response to a key is stored for the authenticated user and replayed to every retry with
+// an "Idempotent-Replayed: true" header, so a purchase retried after a timeout does not charge twice.
+// A retry arriving while the first request is still processed is answered with "409 Conflict", and the
+// same key sent with a different method, path or body with "422 Unprocessable Entity".
+// Server errors (5xx) are stored like every other response, since the handler may have charged a card or placed
+// an order before it failed. When not even that response can be stored, or the handler panics, the key is
+// marked failed and retries are answered with "409 Conflict" until it expires: the key is never given up early.
+// Anonymous requests and requests without the header are passed on as they are.
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		user := userFromContext(r.Context())
+		if key == "" || user == nil || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, newError(http.StatusBadRequest, codeBadRequest, "Idempotency-Key must not be longer than %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := s.readBody(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		stored, err := s.stores.Idempotency.Claim(r.Context(), user.ID, key, requestHash(r, body))
+		switch {
+		case errors.Is(err, store.ErrKeyInProgress):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, newError(http.StatusConflict, codeKeyInProgress, "A request with this Idempotency-Key is still being processed"))
+			return
+		case errors.Is(err, store.ErrKeyMismatch):
+			writeError(w, r, newError(http.StatusUnprocessableEntity, codeKeyMismatch, "Idempotency-Key was already used for a different request"))
+			return
+		case errors.Is(err, store.ErrKeyFailed):
+			writeError(w, r, newError(http.StatusConflict, codeKeyFailed,
+				"The request with this Idempotency-Key failed and may have been processed, check its outcome before sending it with a new key"))
+			return
+		case err != nil:
+			writeError(w, r, err)
+			return
+		case stored != nil:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeStoredResponse(w, stored)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+		defer cancel()
+		completed := false
+		defer func() {
+			// Also runs when the handler panics, so that retries are told about the failure instead of waiting for it.
+			if !completed {
+				if err := s.stores.Idempotency.Fail(ctx, user.ID, key); err != nil {
+					loggerFromContext(r.Context()).Error("marking idempotency key as failed was unsuccessful", "idempotency_key", key, "error", err)
+				}
+			}
+		}()
+
+		rec := &responseRecorder{header: http.Header{}}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		response := &models.StoredResponse{StatusCode: rec.status, Header: rec.header, Body: rec.body.Bytes()}
+		if err := s.stores.Idempotency.Complete(ctx, user.ID, key, response); err != nil {
+			loggerFromContext(r.Context()).Error("storing idempotent response failed", "idempotency_key", key, "error", err)
+		} else {
+			completed = true
+		}
+		writeStoredResponse(w, response)
+	})
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buyWithKey is buy with an Idempotency-Key header.
+func buyWithKey(h http.Handler, token, key string, productID, quantity int, amount float64) *httptest.ResponseRecorder {
+	form := url.Values{
+		"productID": {fmt.Sprint(productID)},
+		"quantity":  {fmt.Sprint(quantity)},
+		"token":     {payment.TokenVisa},
+		"amount":    {fmt.Sprint(amount)},
+	}
+	req := httptest.NewRequest("POST", "/buy", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func orderID(t *testing.T, rec *httptest.ResponseRecorder) int {
+	var order models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil {
+		t.Fatalf("decoding order from %d %s: %v", rec.Code, rec.Body, err)
+	}
+	return order.ID
+}
+
+// TestIdempotentRetry retries a purchase with the same key and checks that it is charged and taken out of stock once.
+func TestIdempotentRetry(t *testing.T) {
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(t, stores)
+			token := signUp(t, h, fmt.Sprintf("retry_%s_%d", name, os.Getpid()))
+			other := signUp(t, h, fmt.Sprintf("retry_other_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Retried", Description: "Idempotency test", Price: 10, Quantity: 5}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+			key := fmt.Sprintf("key-%s-%d", name, os.Getpid())
+
+			first := buyWithKey(h, token, key, product.ID, 1, 10)
+			if first.Code != http.StatusCreated {
+				t.Fatalf("first request: %d %s", first.Code, first.Body)
+			}
+			retry := buyWithKey(h, token, key, product.ID, 1, 10)
+			if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "true" {
+				t.Fatalf("retry: %d %v %s", retry.Code, retry.Header(), retry.Body)
+			}
+			if retry.Header().Get("Location") != first.Header().Get("Location") || orderID(t, retry) != orderID(t, first) {
+				t.Errorf("retry answered with a different order: %s, want %s", retry.Body, first.Body)
+			}
+
+			if rec := buyWithKey(h, token, key, product.ID, 2, 20); rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("key reused for a different request: %d %s", rec.Code, rec.Body)
+			}
+			if rec := buyWithKey(h, other, key, product.ID, 1, 10); rec.Code != http.StatusCreated || orderID(t, rec) == orderID(t, first) {
+				t.Errorf("same key of another user: %d %s", rec.Code, rec.Body)
+			}
+
+			got, err := stores.Products.Get(context.Background(), product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Quantity != 3 {
+				t.Errorf("stock is %d after two purchases, want 3", got.Quantity)
+			}
+		})
+	}
+}
+
+// TestIdempotentConcurrentDuplicates sends the same request many times at once and checks that it is processed
+// once, while the duplicates are either told to retry or answered with the stored response.
+func TestIdempotentConcurrentDuplicates(t *testing.T) {
+	const duplicates = 20
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(t, stores)
+			token := signUp(t, h, fmt.Sprintf("duplicate_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Duplicated", Description: "Idempotency test", Price: 10, Quantity: duplicates}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+			key := fmt.Sprintf("concurrent-%s-%d", name, os.Getpid())
+
+			var (
+				wg     sync.WaitGroup
+				mu     sync.Mutex
+				orders = map[int]bool{}
+			)
+			for i := 0; i < duplicates; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := buyWithKey(h, token, key, product.ID, 1, 10)
+					mu.Lock()
+					defer mu.Unlock()
+					switch rec.Code {
+					case http.StatusCreated:
+						orders[orderID(t, rec)] = true
+					case http.StatusConflict:
+					default:
+						t.Errorf("unexpected response %d %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(orders) != 1 {
+				t.Errorf("placed %d different orders, want 1", len(orders))
+			}
+			got, err := stores.Products.Get(context.Background(), product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Quantity != duplicates-1 {
+				t.Errorf("stock is %d, want %d", got.Quantity, duplicates-1)
+			}
+		})
+	}
+}
+
+// incompleteIdempotency cannot store responses, like a database that went away while the request was processed.
+type incompleteIdempotency struct{ store.IdempotencyStore }
+
+func (incompleteIdempotency) Complete(ctx context.Context, userID int, key string, response *models.StoredResponse) error {
+	return errors.New("connection reset by peer")
+}
+
+// TestIdempotentFailure checks that a key whose request failed is never processed a second time:
+// a server error is replayed, and a response that could not be stored rejects every retry.
+func TestIdempotentFailure(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		broken bool
+		status int
+		code   string
+	}{
+		{"server error", false, http.StatusBadGateway, codePaymentFailed},
+		{"response not stored", true, http.StatusConflict, codeKeyFailed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			stores := store.NewMemory()
+			if c.broken {
+				stores.Idempotency = incompleteIdempotency{stores.Idempotency}
+			}
+			s := testServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+			user := &models.User{Username: "retrier", Email: "retrier@example.com", Password: "hash", Roles: []string{models.RoleCustomer}}
+			if err := stores.Users.Create(context.Background(), user); err != nil {
+				t.Fatal(err)
+			}
+			calls := 0
+			h := s.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The order was placed and charged before the failure.
+				calls++
+				writeError(w, r, newError(http.StatusBadGateway, codePaymentFailed, "The payment could not be processed, please try again later"))
+			}))
+			send := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", "/buy", strings.NewReader(""))
+				req = req.WithContext(withUser(req.Context(), user))
+				req.Header.Set("Idempotency-Key", "failing")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				return rec
+			}
+
+			if rec := send(); rec.Code != http.StatusBadGateway {
+				t.Fatalf("first request: %d %s", rec.Code, rec.Body)
+			}
+			rec := send()
+			var p problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != c.status || p.Code != c.code {
+				t.Errorf("retry: %d %s, want %d with code %s", rec.Code, rec.Body, c.status, c.code)
+			}
+			if calls != 1 {
+				t.Errorf("the request was processed %d times", calls)
+			}
+		})
+	}
+}
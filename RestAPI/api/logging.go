@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// accessEntry collects what the access log line of a request reports that only handlers further in learn,
+// such as the authenticated user, which requireAuth fills in.
+type accessEntry struct {
+	userID int
+}
+
+// statusWriter remembers the status and counts the bytes of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// loggerFromContext returns the logger of the request, which adds the request ID to every line,
+// or the default logger outside of accessLog.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// accessLog is a middleware that logs one line for every request once it was answered, with the method,
+// the route pattern of the mux that served it, the status, the latency, the size of the response and the
+// authenticated user. Responses with a 5xx status are logged as errors. The request is counted in the metrics as well.
+// Handlers log through loggerFromContext, which attaches the ID withRequestID gave the request to their lines too,
+// and the trace ID when the request is traced.
+func (s *Server) accessLog(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := s.logger.With("request_id", requestIDFromContext(r.Context()))
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		entry := &accessEntry{}
+		ctx := context.WithValue(r.Context(), loggerContextKey, logger)
+		ctx = context.WithValue(ctx, accessEntryContextKey, entry)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		_, route := mux.Handler(r)
+		s.metrics.ObserveRequest(r.Method, route, sw.status, latency)
+		level := slog.LevelInfo
+		if sw.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Duration("latency", latency),
+			slog.Int("bytes", sw.bytes),
+		}
+		if entry.userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", entry.userID))
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var logged strings.Builder
+	stores := store.NewMemory()
+	h := newLoggingTestServer(t, stores, slog.New(slog.NewJSONHandler(&logged, nil)))
+	token := signUp(t, h, "logged")
+	user, err := stores.Users.GetByUsername(context.Background(), "logged")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged.Reset()
+	req := httptest.NewRequest("GET", "/orders/42", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Request-ID", "trace-7")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("X-Request-ID") != "trace-7" {
+		t.Errorf("X-Request-ID %q, want the one of the request", rec.Header().Get("X-Request-ID"))
+	}
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(logged.String()))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%v in %q", err, scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1: %s", len(lines), logged.String())
+	}
+	line := lines[0]
+	for key, want := range map[string]interface{}{
+		"msg":        "request",
+		"level":      "INFO",
+		"request_id": "trace-7",
+		"method":     "GET",
+		"route":      "/orders/",
+		"path":       "/orders/42",
+		"status":     float64(http.StatusNotFound),
+		"bytes":      float64(rec.Body.Len()),
+		"user_id":    float64(user.ID),
+	} {
+		if line[key] != want {
+			t.Errorf("%s is %v, want %v", key, line[key], want)
+		}
+	}
+	if _, ok := line["latency"]; !ok {
+		t.Error("no latency logged")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	stores := store.NewMemory()
+	m := metrics.New()
+	h := testServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)), m).Router()
+	token := signUp(t, h, "counted")
+	product := &models.Product{Name: "Scarce", Price: 1, Quantity: 1}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"wrong password", "password"} {
+		do(h, "POST", "/login", "", fmt.Sprintf(`{"username": "counted", "password": %q}`, password))
+	}
+	if rec := do(h, "POST", "/orders", token, fmt.Sprintf(`{"items": [{"product_id": %d, "quantity": 2}]}`, product.ID)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("ordering more than in stock: %d %s", rec.Code, rec.Body)
+	}
+	if rec := buy(h, token, product.ID, 1, product.Price, payment.TokenVisa); rec.Code != http.StatusCreated {
+		t.Fatalf("buying: %d %s", rec.Code, rec.Body)
+	}
+	if rec := addCard(h, token, "4242424242424242"); rec.Code != http.StatusCreated {
+		t.Fatalf("adding a card: %d %s", rec.Code, rec.Body)
+	}
+	do(h, "GET", "/orders/999", token, "")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`restapi_http_requests_total{method="POST",route="/signup",status="201"} 1`,
+		`restapi_http_requests_total{method="POST",route="/login",status="401"} 1`,
+		`restapi_http_requests_total{method="GET",route="/orders/",status="404"} 1`,
+		`restapi_http_request_duration_seconds_count{method="POST",route="/buy",status="201"} 1`,
+		`restapi_signups_total 1`,
+		`restapi_logins_total{result="failed"} 1`,
+		`restapi_logins_total{result="succeeded"} 1`,
+		`restapi_out_of_stock_rejections_total 1`,
+		`restapi_purchases_total 1`,
+		`restapi_cards_added_total 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("no %s in\n%s", want, rec.Body)
+		}
+	}
+}
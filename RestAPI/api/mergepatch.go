@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+// mergePatch applies a JSON Merge Patch document (RFC 7386) to the target JSON document and returns the result.
+func mergePatch(target, patch []byte) ([]byte, error) {
+	var t, p interface{}
+	if err := json.Unmarshal(target, &t); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(t, p))
+}
+
+// mergeValue implements the MergePatch function of RFC 7386 section 2 on decoded JSON values:
+// a patch object is merged into the target member by member, with null removing the member,
+// and any other patch value replaces the target as a whole.
+func mergeValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergeValue(targetObject[name], value)
+	}
+	return targetObject
+}
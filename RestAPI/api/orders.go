@@ -0,0 +1,220 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// orderRequest is the body of POST /orders.
+type orderRequest struct {
+	Items []struct {
+		ProductID int `json:"product_id"`
+		Quantity  int `json:"quantity"`
+	} `json:"items"`
+}
+
+func (req *orderRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(len(req.Items) > 0, "items", "must list at least one product")
+	for i, item := range req.Items {
+		errs.Check(item.ProductID > 0, fmt.Sprintf("items[%d].product_id", i), "is required")
+		errs.Check(item.Quantity > 0, fmt.Sprintf("items[%d].quantity", i), "must be a positive integer")
+	}
+	return errs.Err()
+}
+
+// handleOrders is a HTTP handler function for the order history of the authenticated user at /orders.
+// "GET" lists the orders of the user, newest first, and "POST" places a new order.
+func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		orders, err := s.stores.Orders.ListByUser(r.Context(), userFromContext(r.Context()).ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, orders)
+	case "POST":
+		s.handleCreateOrder(w, r)
+	default:
+		methodNotAllowed(w, r, "GET", "POST")
+	}
+}
+
+// handleCreateOrder places an order for the products and quantities listed in the request body:
+//
+//	{"items": [{"product_id": 1, "quantity": 2}, {"product_id": 3, "quantity": 1}]}
+//
+// A product listed twice is ordered once with the quantities added up. The order is answered with "201 Created".
+func (s *Server) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req orderRequest
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	order := &models.Order{UserID: userFromContext(r.Context()).ID}
+	index := map[int]int{}
+	for _, item := range req.Items {
+		if i, ok := index[item.ProductID]; ok {
+			order.Items[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.ProductID] = len(order.Items)
+		order.Items = append(order.Items, models.OrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	s.placeOrder(w, r, order)
+}
+
+// placeOrder stores the order and answers with it.
+func (s *Server) placeOrder(w http.ResponseWriter, r *http.Request, order *models.Order) {
+	if err := s.stores.Orders.Create(r.Context(), order); err != nil {
+		s.writeOrderError(w, r, err)
+		return
+	}
+	writeCreatedOrder(w, order)
+}
+
+// writeCreatedOrder answers with the newly placed order and "201 Created".
+func writeCreatedOrder(w http.ResponseWriter, order *models.Order) {
+	w.Header().Set("Location", "/orders/"+strconv.Itoa(order.ID))
+	writeJSON(w, http.StatusCreated, order)
+}
+
+// writeOrderError answers with "400 Bad Request" when an order could not be placed because a product
+// does not exist or has not enough units in stock, and like writeError otherwise.
+// Orders rejected for lack of stock are counted in the metrics.
+func (s *Server) writeOrderError(w http.ResponseWriter, r *http.Request, err error) {
+	var outOfStock *store.OutOfStockError
+	switch {
+	case errors.As(err, &outOfStock):
+		s.metrics.OutOfStock()
+		writeError(w, r, newError(http.StatusBadRequest, codeOutOfStock, "Product out of stock: %v", outOfStock))
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, r, errUnknownProduct)
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// statusRequest is the body of POST /orders/{id}/status.
+type statusRequest struct {
+	Status string `json:"status"`
+}
+
+func (req *statusRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.Status != "", "status", "is required")
+	errs.Check(models.IsOrderStatus(req.Status), "status", "is not a known order status")
+	return errs.Err()
+}
+
+// handleOrder is a HTTP handler function for a single order and its lifecycle:
+//
+//	GET  /orders/{id}         returns the order
+//	GET  /orders/{id}/events  returns the status history of the order, oldest first
+//	POST /orders/{id}/pay     pays for the order, see handlePayOrder, owner only
+//	POST /orders/{id}/cancel  cancels the order, puts its items back in stock and refunds the payment, owner only
+//	POST /orders/{id}/status  moves the order to the status in the body, staff only
+//
+// Customers only see their own orders, orders of other users are answered with "404 Not Found" just like
+// orders that do not exist. Staff may see every order and change its status, but only the customer who placed
+// an order pays for or cancels it, so staff never charge a customer's saved card; they are answered with
+// "403 Forbidden". A status change the order lifecycle does not allow, such as cancelling an order that was
+// already shipped, is answered with "409 Conflict".
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		writeError(w, r, errNotFound)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch action {
+	case "", "events":
+		if r.Method != "GET" {
+			methodNotAllowed(w, r, "GET")
+			return
+		}
+	case "pay", "cancel", "status":
+		if r.Method != "POST" {
+			methodNotAllowed(w, r, "POST")
+			return
+		}
+	default:
+		writeError(w, r, errNotFound)
+		return
+	}
+
+	user := userFromContext(r.Context())
+	order, err := s.stores.Orders.Get(r.Context(), id)
+	if err == nil && order.UserID != user.ID && !can(user, manageOrders) {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, order)
+	case "events":
+		events, err := s.stores.Orders.Events(r.Context(), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	case "pay", "cancel":
+		if order.UserID != user.ID {
+			writeError(w, r, errForbidden)
+			return
+		}
+		if action == "pay" {
+			s.handlePayOrder(w, r, order)
+			return
+		}
+		s.transitionOrder(w, r, order, models.OrderCancelled)
+	case "status":
+		if !can(user, manageOrders) {
+			writeError(w, r, errForbidden)
+			return
+		}
+		var req statusRequest
+		if err := s.decode(w, r, &req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		s.transitionOrder(w, r, order, req.Status)
+	}
+}
+
+// transitionOrder moves the order to the given status on behalf of the authenticated user and answers with the order.
+// The status is checked and changed by the store while the order is locked, so of two concurrent requests
+// cancelling the same order only one succeeds. A paid order that was cancelled or refunded is then paid back
+// through the payment gateway. When that fails the order keeps its new status and stays marked RefundPending,
+// the failure is logged and RetryRefunds pays it back later.
+func (s *Server) transitionOrder(w http.ResponseWriter, r *http.Request, order *models.Order, status string) {
+	order, err := s.stores.Orders.Transition(r.Context(), order.ID, status, userFromContext(r.Context()).ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if order.RefundPending {
+		if err := s.refundOrder(r.Context(), order); err != nil {
+			loggerFromContext(r.Context()).Error("refund failed, retrying later", "order_id", order.ID, "payment_id", order.PaymentID, "error", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, order)
+}
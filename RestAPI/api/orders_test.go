@@ -0,0 +1,380 @@
+package api
+
+import (
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// paidOrder buys two units of a new product with the test card and returns the paid order.
+func paidOrder(t *testing.T, s *Server, h http.Handler, token string) models.Order {
+	t.Helper()
+	product := &models.Product{Name: "Refundable", Price: 2.5, Quantity: 5}
+	if err := s.stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+	rec := buy(h, token, product.ID, 2, 5, payment.TokenVisa)
+	var order models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("buying: %d %s", rec.Code, rec.Body)
+	}
+	return order
+}
+
+// TestConcurrentCancel cancels the same paid order many times at once and checks that it is paid back exactly once.
+func TestConcurrentCancel(t *testing.T) {
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := testServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+			h := s.Router()
+			fake := s.payments.(*payment.Fake)
+			token := signUp(t, h, fmt.Sprintf("canceller_%s_%d", name, os.Getpid()))
+			order := paidOrder(t, s, h, token)
+
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				cancelled int
+			)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := do(h, "POST", "/orders/"+strconv.Itoa(order.ID)+"/cancel", token, "")
+					mu.Lock()
+					defer mu.Unlock()
+					switch rec.Code {
+					case http.StatusOK:
+						cancelled++
+					case http.StatusConflict:
+					default:
+						t.Errorf("unexpected response %d %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if cancelled != 1 {
+				t.Errorf("the order was cancelled %d times", cancelled)
+			}
+			if captured, refunded := fake.Captured(order.PaymentID); refunded != captured {
+				t.Errorf("refunded %d of %d", refunded, captured)
+			}
+		})
+	}
+}
+
+// TestRetryRefunds cancels a paid order while the payment provider fails, and pays it back later with RetryRefunds.
+func TestRetryRefunds(t *testing.T) {
+	s := testServer(t, testStores(t)["memory"], slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+	h := s.Router()
+	fake := s.payments.(*payment.Fake)
+	token := signUp(t, h, "refunded")
+	order := paidOrder(t, s, h, token)
+
+	fake.FailNextRefund()
+	rec := do(h, "POST", "/orders/"+strconv.Itoa(order.ID)+"/cancel", token, "")
+	var cancelled models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &cancelled); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("cancelling: %d %s", rec.Code, rec.Body)
+	}
+	if cancelled.Status != models.OrderCancelled || !cancelled.RefundPending {
+		t.Errorf("cancelled order is %s with refund_pending %t, want cancelled with a pending refund", cancelled.Status, cancelled.RefundPending)
+	}
+	if _, refunded := fake.Captured(order.PaymentID); refunded != 0 {
+		t.Errorf("refunded %d although the provider failed", refunded)
+	}
+
+	// The second call finds nothing to do and must not pay back twice.
+	for i := 0; i < 2; i++ {
+		if err := s.RetryRefunds(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if captured, refunded := fake.Captured(order.PaymentID); captured == 0 || refunded != captured {
+		t.Errorf("refunded %d of %d", refunded, captured)
+	}
+	got, err := s.stores.Orders.Get(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RefundPending {
+		t.Error("the order is still waiting for its refund")
+	}
+}
+
+// TestUnclearCapture fails the capture of a purchase without a clear answer of the provider, once after the money
+// was captured and once before, and checks that the order is cancelled and RetryRefunds settles the payment.
+func TestUnclearCapture(t *testing.T) {
+	for _, captured := range []bool{true, false} {
+		t.Run(fmt.Sprintf("captured=%t", captured), func(t *testing.T) {
+			s := testServer(t, testStores(t)["memory"], slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+			h := s.Router()
+			fake := s.payments.(*payment.Fake)
+			token := signUp(t, h, "uncaptured")
+			product := &models.Product{Name: "Uncaptured", Price: 2.5, Quantity: 5}
+			if err := s.stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+
+			fake.FailNextCapture(captured)
+			if rec := buy(h, token, product.ID, 2, 5, payment.TokenVisa); rec.Code != http.StatusBadGateway {
+				t.Fatalf("buying: got %d %s, want 502", rec.Code, rec.Body)
+			}
+			orders, err := s.stores.Orders.ListRefundPending(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != 1 || orders[0].Status != models.OrderCancelled {
+				t.Fatalf("orders waiting for a refund: %+v, want the cancelled order", orders)
+			}
+			order := orders[0]
+			if got, err := s.stores.Products.Get(context.Background(), product.ID); err != nil || got.Quantity != 5 {
+				t.Errorf("product after the failed capture: %+v, %v, want 5 in stock", got, err)
+			}
+
+			if err := s.RetryRefunds(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got, refunded := fake.Captured(order.PaymentID); refunded != got {
+				t.Errorf("refunded %d of %d", refunded, got)
+			}
+			if got, err := s.stores.Orders.Get(context.Background(), order.ID); err != nil || got.RefundPending {
+				t.Errorf("order after retrying refunds: %+v, %v, want the refund done", got, err)
+			}
+		})
+	}
+}
+
+// TestConcurrentPay pays the same order many times at once, with the same card and with another one,
+// and checks that it is paid and captured exactly once.
+func TestConcurrentPay(t *testing.T) {
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := testServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+			h := s.Router()
+			fake := s.payments.(*payment.Fake)
+			token := signUp(t, h, fmt.Sprintf("payer_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Paid once", Price: 2.5, Quantity: 5}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+			rec := do(h, "POST", "/orders", token, fmt.Sprintf(`{"items":[{"product_id":%d,"quantity":2}]}`, product.ID))
+			var order models.Order
+			if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || rec.Code != http.StatusCreated {
+				t.Fatalf("ordering: %d %s", rec.Code, rec.Body)
+			}
+
+			var (
+				wg   sync.WaitGroup
+				mu   sync.Mutex
+				paid int
+			)
+			for i := 0; i < 10; i++ {
+				card := payment.TokenVisa
+				if i%2 == 1 {
+					card = "tok_mastercard"
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					body := fmt.Sprintf(`{"token":%q,"amount":5}`, card)
+					rec := do(h, "POST", "/orders/"+strconv.Itoa(order.ID)+"/pay", token, body)
+					mu.Lock()
+					defer mu.Unlock()
+					switch rec.Code {
+					case http.StatusOK:
+						paid++
+					case http.StatusConflict:
+					default:
+						t.Errorf("unexpected response %d %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := stores.Orders.Get(context.Background(), order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paid != 1 || got.Status != models.OrderPaid {
+				t.Fatalf("paid %d times, the order is %s", paid, got.Status)
+			}
+			if captured, _ := fake.Captured(got.PaymentID); captured != 500 {
+				t.Errorf("captured %d of the payment the order records, want 500", captured)
+			}
+			events, err := stores.Orders.Events(context.Background(), order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 2 {
+				t.Errorf("recorded %d events, want the placement and one payment", len(events))
+			}
+		})
+	}
+}
+
+// contextGateway is the Fake gateway recording whether the context of every Void was still usable.
+type contextGateway struct {
+	*payment.Fake
+	mu       sync.Mutex
+	voidErrs []error
+}
+
+func (g *contextGateway) Void(ctx context.Context, id string) error {
+	g.mu.Lock()
+	g.voidErrs = append(g.voidErrs, ctx.Err())
+	g.mu.Unlock()
+	return g.Fake.Void(ctx, id)
+}
+
+// TestVoidOutlivesRequest pays for a cancelled order with a request whose client already went away,
+// and checks that the authorization is still voided.
+func TestVoidOutlivesRequest(t *testing.T) {
+	s := testServer(t, testStores(t)["memory"], slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+	gateway := &contextGateway{Fake: payment.NewFake()}
+	s.payments = gateway
+	h := s.Router()
+	token := signUp(t, h, "gone")
+	product := &models.Product{Name: "Abandoned", Price: 2.5, Quantity: 5}
+	if err := s.stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+	rec := do(h, "POST", "/orders", token, fmt.Sprintf(`{"items":[{"product_id":%d,"quantity":2}]}`, product.ID))
+	var order models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("ordering: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(h, "POST", "/orders/"+strconv.Itoa(order.ID)+"/cancel", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("cancelling: %d %s", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("POST", "/orders/"+strconv.Itoa(order.ID)+"/pay", strings.NewReader(`{"token":"tok_visa","amount":5}`)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("paying a cancelled order: %d %s", rec.Code, rec.Body)
+	}
+	if len(gateway.voidErrs) != 1 || gateway.voidErrs[0] != nil {
+		t.Errorf("voided with context errors %v, want one void with a live context", gateway.voidErrs)
+	}
+}
+
+// TestOrderOwnership checks who may see, pay, cancel and move on the order of a customer.
+func TestOrderOwnership(t *testing.T) {
+	stores := testStores(t)["memory"]
+	s := testServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+	h := s.Router()
+	owner := signUp(t, h, "owner")
+	other := signUp(t, h, "other")
+	staff := signUp(t, h, "clerk")
+	user, err := stores.Users.GetByUsername(context.Background(), "clerk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Users.GrantRole(context.Background(), user.ID, models.RoleStaff); err != nil {
+		t.Fatal(err)
+	}
+
+	paid := "/orders/" + strconv.Itoa(paidOrder(t, s, h, owner).ID)
+	rec := do(h, "POST", "/orders", owner, `{"items":[{"product_id":1,"quantity":1}]}`)
+	var pending models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("ordering: %d %s", rec.Code, rec.Body)
+	}
+	unpaid := "/orders/" + strconv.Itoa(pending.ID)
+
+	for _, c := range []struct {
+		name, token, method, path, body string
+		status                          int
+	}{
+		{"other customer sees", other, "GET", paid, "", http.StatusNotFound},
+		{"other customer pays", other, "POST", unpaid + "/pay", `{"token":"tok_visa","amount":2.5}`, http.StatusNotFound},
+		{"other customer cancels", other, "POST", paid + "/cancel", "", http.StatusNotFound},
+		{"staff sees", staff, "GET", paid, "", http.StatusOK},
+		{"staff pays", staff, "POST", unpaid + "/pay", `{"token":"tok_visa","amount":2.5}`, http.StatusForbidden},
+		{"staff cancels", staff, "POST", paid + "/cancel", "", http.StatusForbidden},
+		{"customer moves on", owner, "POST", paid + "/status", `{"status":"fulfilled"}`, http.StatusForbidden},
+		{"staff moves on", staff, "POST", paid + "/status", `{"status":"fulfilled"}`, http.StatusOK},
+		{"owner cancels", owner, "POST", paid + "/cancel", "", http.StatusOK},
+		{"owner pays", owner, "POST", unpaid + "/pay", `{"token":"tok_visa","amount":2.5}`, http.StatusOK},
+	} {
+		if rec := do(h, c.method, c.path, c.token, c.body); rec.Code != c.status {
+			t.Errorf("%s: got %d %s, want %d", c.name, rec.Code, rec.Body, c.status)
+		}
+	}
+}
+
+// TestExpirePendingOrders checks that an order waiting too long for its payment is cancelled and restocked,
+// and that paid orders and orders placed within the TTL are left alone.
+func TestExpirePendingOrders(t *testing.T) {
+	s := testServer(t, testStores(t)["memory"], slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New())
+	h := s.Router()
+	token := signUp(t, h, "forgetful")
+	paid := paidOrder(t, s, h, token)
+	product := &models.Product{Name: "Reserved", Price: 2.5, Quantity: 5}
+	if err := s.stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+	rec := do(h, "POST", "/orders", token, fmt.Sprintf(`{"items":[{"product_id":%d,"quantity":2}]}`, product.ID))
+	var order models.Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("ordering: %d %s", rec.Code, rec.Body)
+	}
+	status := func(id int) string {
+		t.Helper()
+		got, err := s.stores.Orders.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Status
+	}
+
+	if err := s.ExpirePendingOrders(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(order.ID); got != models.OrderPendingPayment {
+		t.Fatalf("an order placed within the TTL is %s", got)
+	}
+
+	s.config.Payment.PendingOrderTTL = time.Nanosecond
+	if err := s.ExpirePendingOrders(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(order.ID); got != models.OrderCancelled {
+		t.Errorf("the expired order is %s, want cancelled", got)
+	}
+	if got := status(paid.ID); got != models.OrderPaid {
+		t.Errorf("the paid order is %s", got)
+	}
+	if got, err := s.stores.Products.Get(context.Background(), product.ID); err != nil || got.Quantity != 5 {
+		t.Errorf("stock is %+v, %v after expiring, want 5", got, err)
+	}
+	events, err := s.stores.Orders.Events(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := events[len(events)-1]; last.To != models.OrderCancelled || last.ActorID != 0 {
+		t.Errorf("recorded %+v, want a cancellation without actor", last)
+	}
+	if rec := do(h, "POST", "/orders/"+strconv.Itoa(order.ID)+"/pay", token, `{"token":"tok_visa","amount":5}`); rec.Code != http.StatusConflict {
+		t.Errorf("paying the expired order: %d %s", rec.Code, rec.Body)
+	}
+}
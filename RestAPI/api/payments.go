@@ -0,0 +1,238 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
+	"RestAPI/pkg/vault"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// paymentTimeout bounds the calls to the payment gateway that must not be cut short by the client going away,
+// such as refunds and undoing a payment that could not be completed.
+const paymentTimeout = 30 * time.Second
+
+// errAmountMismatch is returned by payOrder when the amount the customer agreed to pay differs from the order total.
+var errAmountMismatch = errors.New("amount does not match the order total")
+
+// payRequest is the body of POST /orders/{id}/pay. Token is the card token issued by the payment provider
+// or the token of a saved card, and Amount the total the customer was shown, which must still be the total of the order.
+type payRequest struct {
+	Token  string  `json:"token"`
+	Amount float64 `json:"amount"`
+}
+
+func (req *payRequest) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(req.Amount > 0, "amount", "is required and must be positive")
+	return errs.Err()
+}
+
+// payOrder charges the total of the order to the card and marks the order as paid. The source is either
+// a card token of the payment provider or the token of a card the customer saved in the vault,
+// and when it is empty the default card of the customer is charged.
+// The amount is only authorized until the order could be marked as paid, and released again when that fails,
+// so a customer is never charged for an order that stays unpaid. A capture that fails without a clear refusal
+// of the provider cancels the order with a pending refund instead, since the money may have been captured. The order is only marked as paid while it is
+// still awaiting payment, which the store checks under a lock: of two concurrent payments the second gets
+// ErrInvalidTransition and its authorization is voided. Paid orders are counted as purchases in the metrics.
+func (s *Server) payOrder(ctx context.Context, order *models.Order, source string, amount float64) error {
+	total := payment.Cents(order.Total)
+	if payment.Cents(amount) != total {
+		return fmt.Errorf("%w: %.2f is not %.2f", errAmountMismatch, amount, order.Total)
+	}
+
+	req := payment.AuthorizeRequest{
+		Amount:      total,
+		Currency:    s.config.Payment.Currency,
+		Source:      source,
+		Description: "Order " + strconv.Itoa(order.ID),
+		// Retrying the same order with the same card returns the first authorization instead of a second one.
+		IdempotencyKey: fmt.Sprintf("order-%d-%s", order.ID, hashToken(source)[:16]),
+	}
+	if source == "" || vault.IsToken(source) {
+		card, err := s.savedCard(ctx, order.UserID, source)
+		if err != nil {
+			return err
+		}
+		req.Source, req.Card = "", card
+	}
+	auth, err := s.payments.Authorize(ctx, req)
+	if err != nil {
+		return err
+	}
+	paid, err := s.stores.Orders.MarkPaid(ctx, order.ID, auth.ID, order.UserID)
+	if err != nil {
+		// A concurrent payment with the same card got the same authorization through the idempotency key and
+		// marked the order as paid with it first. Capturing it is up to that payment, voiding it here would fail it.
+		if current, getErr := s.stores.Orders.Get(ctx, order.ID); getErr == nil && current.PaymentID == auth.ID {
+			return err
+		}
+		s.voidPayment(ctx, order, auth.ID)
+		return err
+	}
+	if err := s.payments.Capture(ctx, auth.ID, total); err != nil {
+		if payment.Rejected(err) {
+			// The order is paid as far as the store is concerned, but no money moved. Put it back.
+			s.cancelUnpaid(ctx, order)
+			s.voidPayment(ctx, order, auth.ID)
+			return err
+		}
+		// The capture may have gone through, with only the answer lost. Cancelling the paid order leaves it
+		// marked RefundPending, and RetryRefunds pays back or releases whatever the provider holds.
+		s.cancelUncaptured(ctx, order)
+		return err
+	}
+	*order = *paid
+	s.metrics.Purchase()
+	return nil
+}
+
+// voidPayment releases the authorization of a payment that was not captured. It runs to the end even when the client
+// went away, because the money would stay reserved on the card otherwise. A failure is logged, the provider
+// releases the authorization on its own once it expires.
+func (s *Server) voidPayment(ctx context.Context, order *models.Order, authID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), paymentTimeout)
+	defer cancel()
+
+	if err := s.payments.Void(ctx, authID); err != nil {
+		loggerFromContext(ctx).Error("voiding payment failed", "order_id", order.ID, "payment_id", authID, "error", err)
+	}
+}
+
+// cancelUnpaid cancels an order whose payment failed and puts its items back in stock. Nothing was captured,
+// so nothing is refunded either. Like voidPayment it runs to the end when the client went away and logs a failure.
+// An order that is no longer open, such as one cancelled already, is left as it is.
+func (s *Server) cancelUnpaid(ctx context.Context, order *models.Order) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), paymentTimeout)
+	defer cancel()
+
+	cancelled, err := s.stores.Orders.Transition(ctx, order.ID, models.OrderCancelled, order.UserID)
+	if err == nil && cancelled.RefundPending {
+		err = s.stores.Orders.SetRefunded(ctx, order.ID)
+	}
+	if err != nil && !errors.Is(err, store.ErrInvalidTransition) {
+		loggerFromContext(ctx).Error("cancelling unpaid order failed", "order_id", order.ID, "error", err)
+	}
+}
+
+// cancelUncaptured cancels a paid order whose capture failed without a clear answer and puts its items back in stock.
+// The order stays marked RefundPending, so RetryRefunds settles the payment. A failure is logged like in cancelUnpaid.
+func (s *Server) cancelUncaptured(ctx context.Context, order *models.Order) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), paymentTimeout)
+	defer cancel()
+
+	if _, err := s.stores.Orders.Transition(ctx, order.ID, models.OrderCancelled, order.UserID); err != nil && !errors.Is(err, store.ErrInvalidTransition) {
+		loggerFromContext(ctx).Error("cancelling uncaptured order failed", "order_id", order.ID, "error", err)
+	}
+}
+
+// writePaymentError answers with "400 Bad Request" for an amount that does not match the order, an unknown saved card
+// or no card at all, "402 Payment Required" for a declined card, "409 Conflict" for an order that is not awaiting payment
+// and "502 Bad Gateway" when the payment provider failed. What the provider said is logged, not shown to the client.
+func writePaymentError(w http.ResponseWriter, r *http.Request, err error) {
+	var declined *payment.DeclineError
+	switch {
+	case errors.Is(err, errAmountMismatch):
+		err = newError(http.StatusBadRequest, codeAmountMismatch, "%v", err)
+	case errors.Is(err, errUnknownCard):
+		err = newError(http.StatusBadRequest, codeUnknownCard, "%v", err)
+	case errors.Is(err, errNoCard):
+		err = newError(http.StatusBadRequest, codeNoCard, "%v", err)
+	case errors.As(err, &declined):
+		err = newError(http.StatusPaymentRequired, codeCardDeclined, "%v", declined)
+	case errors.Is(err, store.ErrInvalidTransition), errors.Is(err, store.ErrNotFound):
+	default:
+		loggerFromContext(r.Context()).Error("payment failed", "error", err)
+		err = newError(http.StatusBadGateway, codePaymentFailed, "The payment could not be processed, please try again later")
+	}
+	writeError(w, r, err)
+}
+
+// handlePayOrder pays for an order awaiting payment with the card token and amount in the body:
+//
+//	{"token": "tok_visa", "amount": 12.50}
+//
+// Without a token the default card of the customer is charged. A declined card leaves the order awaiting payment, so it can be paid with another card.
+// An order that is not awaiting payment is answered with "409 Conflict".
+func (s *Server) handlePayOrder(w http.ResponseWriter, r *http.Request, order *models.Order) {
+	var req payRequest
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.payOrder(r.Context(), order, req.Token, req.Amount); err != nil {
+		writePaymentError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// refundOrder pays the total of an order marked RefundPending back and clears the mark. It runs to the end
+// even when the client that cancelled the order went away, since the order is cancelled by then either way.
+// The idempotency key is the same on every attempt, so a refund that reached the provider but was not
+// recorded as done is not paid out a second time when RetryRefunds tries again.
+// A payment whose capture failed in payOrder may never have been captured. The provider refuses to refund it,
+// and it is voided instead, which releases the authorization.
+func (s *Server) refundOrder(ctx context.Context, order *models.Order) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), paymentTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf("refund-order-%d-%s", order.ID, order.PaymentID)
+	if err := s.payments.Refund(ctx, order.PaymentID, payment.Cents(order.Total), key); err != nil {
+		if !payment.Rejected(err) || s.payments.Void(ctx, order.PaymentID) != nil {
+			return err
+		}
+	}
+	if err := s.stores.Orders.SetRefunded(ctx, order.ID); err != nil {
+		return err
+	}
+	order.RefundPending = false
+	return nil
+}
+
+// RetryRefunds pays back the orders still marked RefundPending because paying them back failed when they were
+// cancelled or refunded. Orders that fail again are logged and stay marked for the next call.
+// It is meant to be called periodically.
+func (s *Server) RetryRefunds(ctx context.Context) error {
+	orders, err := s.stores.Orders.ListRefundPending(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		order := &orders[i]
+		if err := s.refundOrder(ctx, order); err != nil {
+			s.logger.Error("refund failed, retrying later", "order_id", order.ID, "payment_id", order.PaymentID, "error", err)
+			continue
+		}
+		s.logger.Info("refunded order", "order_id", order.ID, "payment_id", order.PaymentID)
+	}
+	return nil
+}
+
+// ExpirePendingOrders cancels the orders that waited longer than the configured PendingOrderTTL for their payment,
+// which puts their items back in stock. An order paid or cancelled in the meantime is left as it is.
+// It is meant to be called periodically.
+func (s *Server) ExpirePendingOrders(ctx context.Context) error {
+	orders, err := s.stores.Orders.ListPendingPayment(ctx, time.Now().Add(-s.config.Payment.PendingOrderTTL))
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		// No one asked for the cancellation, the event records no actor.
+		if _, err := s.stores.Orders.Transition(ctx, order.ID, models.OrderCancelled, 0); err != nil {
+			if !errors.Is(err, store.ErrInvalidTransition) {
+				s.logger.Error("expiring unpaid order failed", "order_id", order.ID, "error", err)
+			}
+			continue
+		}
+		s.logger.Info("cancelled unpaid order", "order_id", order.ID, "placed_at", order.CreatedAt)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"errors"
+	"net/http"
+)
+
+// permission is what a route requires of the caller.
+type permission string
+
+const (
+	// anyone lets anonymous requests through.
+	anyone permission = ""
+	// optional lets anonymous requests through but authenticates requests that carry a token,
+	// for routes that behave differently for logged in users.
+	optional permission = "optional"
+	// authenticated requires a valid token but no particular role.
+	authenticated permission = "authenticated"
+	// manageCatalog allows creating, changing and deleting products.
+	manageCatalog permission = "catalog:manage"
+	// manageOrders allows seeing every order and moving orders through their lifecycle.
+	manageOrders permission = "orders:manage"
+	// manageRoles allows granting and revoking roles.
+	manageRoles permission = "roles:manage"
+)
+
+// rolePermissions lists the permissions every role grants on top of authenticated.
+var rolePermissions = map[string][]permission{
+	models.RoleCustomer: {},
+	models.RoleStaff:    {manageCatalog, manageOrders},
+	models.RoleAdmin:    {manageCatalog, manageOrders, manageRoles},
+}
+
+// routePolicies maps every route pattern of the Router to the permission each method requires.
+// The "*" entry applies to every method without an entry of its own, and routes that are not listed are public.
+var routePolicies = map[string]map[string]permission{
+	"/products":      {"GET": anyone, "HEAD": anyone, "*": manageCatalog},
+	"/products/":     {"GET": anyone, "HEAD": anyone, "*": manageCatalog},
+	"/buy":           {"*": authenticated},
+	"/orders":        {"*": authenticated},
+	"/orders/":       {"*": authenticated},
+	"/cart":          {"*": optional},
+	"/cart/items":    {"*": optional},
+	"/cart/items/":   {"*": optional},
+	"/cart/checkout": {"*": authenticated},
+	"/credit-cards":  {"*": authenticated},
+	"/credit-cards/": {"*": authenticated},
+	"/logout":        {"*": authenticated},
+	"/admin/users/":  {"*": manageRoles},
+}
+
+// requiredPermission looks up what the route requires for the method.
+func requiredPermission(route, method string) permission {
+	methods := routePolicies[route]
+	if p, ok := methods[method]; ok {
+		return p
+	}
+	return methods["*"]
+}
+
+// can reports whether one of the roles of the user grants the permission.
+func can(user *models.User, p permission) bool {
+	if p == anyone || p == optional || p == authenticated {
+		return true
+	}
+	for _, role := range user.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enforce is a middleware that applies the policy of the route to every request.
+// Public requests are passed on as they are, and so are requests without a token on optional routes. Anything else has to be authenticated through requireAuth
+// (which answers "401 Unauthorized" otherwise) and is answered with "403 Forbidden" unless the roles of
+// the user grant the required permission. Roles are read from the stored user rather than from the token,
+// so revoking a role takes effect immediately.
+func (s *Server) enforce(route string, next http.Handler) http.Handler {
+	authorized := s.requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !can(userFromContext(r.Context()), requiredPermission(route, r.Method)) {
+			writeError(w, r, errForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := requiredPermission(route, r.Method)
+		if p == anyone {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, _, err := tokenFromRequest(r); p == optional && errors.Is(err, errNoToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authorized.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"RestAPI/pkg/auth"
+	"RestAPI/pkg/config"
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/migrate"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/vault"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// testStores returns the stores to run a test against: always the in-memory stores, and additionally
+// Postgres when TEST_DATABASE_URL points at a scratch database the test may migrate and write to.
+func testStores(t *testing.T) map[string]*store.Stores {
+	stores := map[string]*store.Stores{"memory": store.NewMemory()}
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		return stores
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stores["postgres"] = store.NewPostgres(db)
+	return stores
+}
+
+func newTestServer(t *testing.T, stores *store.Stores) http.Handler {
+	return newLoggingTestServer(t, stores, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newLoggingTestServer is newTestServer with the server logging through the logger.
+func newLoggingTestServer(t *testing.T, stores *store.Stores, logger *slog.Logger) http.Handler {
+	return testServer(t, stores, logger, metrics.New()).Router()
+}
+
+// testServer returns a Server with test keys and vault and the fake payment gateway.
+func testServer(t *testing.T, stores *store.Stores, logger *slog.Logger, m *metrics.Metrics) *Server {
+	cfg := config.Default()
+	cfg.JWT.SigningKey = "0123456789abcdef0123456789abcdef"
+	cfg.Vault.MasterKeys = map[string]string{"test": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}
+	cfg.Vault.CurrentKey = "test"
+	keys, err := auth.NewKeySet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vault.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(cfg, stores, keys, payment.NewFake(), v, logger, m)
+}
+
+// signUp registers a new user and returns its access token.
+func signUp(t *testing.T, h http.Handler, username string) string {
+	body := fmt.Sprintf(`{"username":%q,"email":"%s@example.com","password":"password"}`, username, username)
+	req := httptest.NewRequest("POST", "/signup", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body)
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens.Token
+}
+
+func buy(h http.Handler, token string, productID, quantity int, amount float64, card string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"productID": {fmt.Sprint(productID)},
+		"quantity":  {fmt.Sprint(quantity)},
+		"token":     {card},
+		"amount":    {fmt.Sprint(amount)},
+	}
+	req := httptest.NewRequest("POST", "/buy", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestConcurrentPurchase fires many parallel /buy requests at a product with little stock
+// and checks that exactly as many units are sold as there were, and never more.
+func TestConcurrentPurchase(t *testing.T) {
+	const (
+		stock   = 10
+		buyers  = 50
+		perSale = 3
+	)
+	for name, stores := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(t, stores)
+			token := signUp(t, h, fmt.Sprintf("buyer_%s_%d", name, os.Getpid()))
+			product := &models.Product{Name: "Last units", Description: "Concurrency test", Price: 100, Quantity: stock}
+			if err := stores.Products.Create(context.Background(), product); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				sold     int
+				rejected int
+			)
+			for i := 0; i < buyers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := buy(h, token, product.ID, perSale, perSale*product.Price, payment.TokenVisa)
+					mu.Lock()
+					defer mu.Unlock()
+					switch rec.Code {
+					case http.StatusCreated:
+						sold += perSale
+					case http.StatusBadRequest:
+						rejected++
+					default:
+						t.Errorf("unexpected response %d %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := stores.Products.Get(context.Background(), product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Quantity < 0 {
+				t.Fatalf("stock went negative: %d", got.Quantity)
+			}
+			if want := stock / perSale * perSale; sold != want {
+				t.Errorf("sold %d units, want %d", sold, want)
+			}
+			if got.Quantity != stock-sold {
+				t.Errorf("quantity is %d after selling %d of %d", got.Quantity, sold, stock)
+			}
+			if rejected != buyers-stock/perSale {
+				t.Errorf("%d purchases were rejected, want %d", rejected, buyers-stock/perSale)
+			}
+		})
+	}
+}
+
+func TestPurchaseRejectsInvalidQuantity(t *testing.T) {
+	stores := store.NewMemory()
+	h := newTestServer(t, stores)
+	token := signUp(t, h, "buyer")
+	product := &models.Product{Name: "Product", Price: 1, Quantity: 5}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, quantity := range []int{0, -1} {
+		if rec := buy(h, token, product.ID, quantity, 1, payment.TokenVisa); rec.Code != http.StatusBadRequest {
+			t.Errorf("quantity %d: got %d, want 400", quantity, rec.Code)
+		}
+	}
+	if rec := buy(h, token, product.ID, 6, 6, payment.TokenVisa); rec.Code != http.StatusBadRequest {
+		t.Errorf("buying more than in stock: got %d, want 400", rec.Code)
+	}
+	if rec := buy(h, token, product.ID, 5, 5, payment.TokenVisa); rec.Code != http.StatusCreated {
+		t.Errorf("buying the whole stock: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestFailedPaymentRestocks checks that a purchase that can not be paid for leaves the stock as it was.
+func TestFailedPaymentRestocks(t *testing.T) {
+	stores := store.NewMemory()
+	h := newTestServer(t, stores)
+	token := signUp(t, h, "buyer")
+	product := &models.Product{Name: "Product", Price: 2.5, Quantity: 5}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		amount float64
+		card   string
+		want   int
+	}{
+		{"declined card", 5, payment.TokenDeclined, http.StatusPaymentRequired},
+		{"insufficient funds", 5, payment.TokenInsufficientFunds, http.StatusPaymentRequired},
+		{"amount below the total", 4.99, payment.TokenVisa, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := buy(h, token, product.ID, 2, tt.amount, tt.card); rec.Code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+	got, err := stores.Products.Get(context.Background(), product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Quantity != 5 {
+		t.Errorf("quantity is %d after failed payments, want 5", got.Quantity)
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxRequestIDLength bounds the X-Request-ID a client may choose, longer IDs are replaced by a new one.
+const maxRequestIDLength = 128
+
+// requestIDFromContext returns the ID of the request, or "" outside of withRequestID.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// validRequestID reports whether a client chosen request ID can be used as it is:
+// not too long and only printable ASCII, so it can be logged and sent back safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID is a middleware that gives every request an ID, the X-Request-ID header of the request
+// or a new random one, puts it into the request context and sends it back in the X-Request-ID header.
+// Error responses carry it too, so clients can quote it when reporting a problem.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
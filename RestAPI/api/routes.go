@@ -1,15 +1,70 @@
 package api
 
 import (
+	"RestAPI/pkg/auth"
+	"RestAPI/pkg/config"
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/vault"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 )
 
-func Router() *http.ServeMux {
+// Server holds the dependencies shared by every handler.
+// The stores are injected through NewServer so handlers can be exercised against
+// the in-memory implementation without a running Postgres.
+type Server struct {
+	config   *config.Config
+	stores   *store.Stores
+	keys     *auth.KeySet
+	payments payment.Gateway
+	vault    *vault.Vault
+	logger   *slog.Logger
+	metrics  *metrics.Metrics
+	// checks are run by /readyz, which fails once draining is set.
+	checks   []namedCheck
+	draining atomic.Bool
+}
+
+// NewServer returns a Server whose handlers read and write through the given stores,
+// sign and verify tokens with the given keys, charge orders through the payment gateway,
+// encrypt saved card numbers with the vault, log through the logger and count requests and business events in metrics.
+func NewServer(config *config.Config, stores *store.Stores, keys *auth.KeySet, payments payment.Gateway, vault *vault.Vault, logger *slog.Logger, metrics *metrics.Metrics) *Server {
+	return &Server{config: config, stores: stores, keys: keys, payments: payments, vault: vault, logger: logger, metrics: metrics}
+}
+
+// Router registers every handler of the Server on a new ServeMux.
+// Every route is wrapped by enforce, which applies the permissions listed for it in routePolicies,
+// then by idempotent, which replays the stored response to retried requests, and the whole mux by cors,
+// accessLog, traced and withRequestID. Paths no route matches are answered with a "404 Not Found" problem like every other error.
+func (s *Server) Router() http.Handler {
 	r := http.NewServeMux()
-	r.HandleFunc("/login", handleLogin)
-	r.HandleFunc("/signup", handleSignUp)
-	r.HandleFunc("/products", handleProducts)
-	r.HandleFunc("/buy", handlePurchase)
-	r.HandleFunc("/credit-cards", handleAddCreditCard)
-	return r
+	handle := func(pattern string, handler http.HandlerFunc) {
+		r.Handle(pattern, s.enforce(pattern, s.idempotent(handler)))
+	}
+	handle("/healthz", s.handleHealthz)
+	handle("/readyz", s.handleReadyz)
+	handle("/login", s.handleLogin)
+	handle("/signup", s.handleSignUp)
+	handle("/token/refresh", s.handleRefreshToken)
+	handle("/logout", s.handleLogout)
+	handle("/.well-known/jwks.json", s.handleJWKS)
+	handle("/products", s.handleProducts)
+	handle("/products/", s.handleProduct)
+	handle("/buy", s.handlePurchase)
+	handle("/orders", s.handleOrders)
+	handle("/orders/", s.handleOrder)
+	handle("/cart", s.handleCart)
+	handle("/cart/items", s.handleAddCartItem)
+	handle("/cart/items/", s.handleCartItem)
+	handle("/cart/checkout", s.handleCheckout)
+	handle("/credit-cards", s.handleCreditCards)
+	handle("/credit-cards/", s.handleCreditCard)
+	handle("/admin/users/", s.handleUserRoles)
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errNotFound)
+	})
+	return withRequestID(s.traced(r, s.accessLog(r, s.cors(r))))
 }
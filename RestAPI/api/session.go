@@ -0,0 +1,201 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/validate"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// tokenResponse is the body returned by signup, login and token refresh.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	// CSRFToken is the value of the csrf_token cookie, which requests authenticated by the jwt cookie
+	// have to send in the X-CSRF-Token header.
+	CSRFToken string `json:"csrf_token"`
+}
+
+// refreshRequest is the body of POST /token/refresh and of POST /logout.
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// randomToken returns 32 random bytes encoded as URL safe base64.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash under which a refresh token is stored.
+// Refresh tokens are random, so a plain hash is enough to make a leaked table useless.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken returns a fresh refresh token and the record to store for it.
+func (s *Server) newRefreshToken() (string, *models.RefreshToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &models.RefreshToken{
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(s.config.JWT.RefreshTokenTTL),
+	}, nil
+}
+
+// startSession issues an access token and the first refresh token of a new family for the user,
+// sets the access token as the "jwt" cookie and writes both with "201 Created".
+// An anonymous cart the visitor filled before logging in is merged into the cart of the user.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	refreshToken, record, err := s.newRefreshToken()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if record.FamilyID, err = randomToken(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	record.UserID = user.ID
+	if err := s.stores.Tokens.CreateRefreshToken(r.Context(), record); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.mergeCart(w, r, user.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.writeTokens(w, r, user, refreshToken, http.StatusCreated)
+}
+
+// writeTokens issues an access token for the user and writes it together with the refresh token.
+// The access token is also set as the jwt cookie, next to a new csrf_token cookie, see checkCSRF.
+// Both cookies are Secure and SameSite=Strict, so browsers neither send them over plain HTTP nor along with
+// requests started by other sites.
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, user *models.User, refreshToken string, status int) {
+	tokenString, err := s.issueToken(user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	expires := time.Now().Add(s.config.JWT.AccessTokenTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     jwtCookie,
+		Value:    tokenString,
+		Expires:  expires,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Scripts of the site read the CSRF token from the cookie, so it is not HttpOnly.
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrfToken,
+		Expires:  expires,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, status, tokenResponse{
+		Token:        tokenString,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.config.JWT.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		CSRFToken:    csrfToken,
+	})
+}
+
+// handleRefreshToken is a HTTP handler function that exchanges a refresh token for a new access token and a new refresh token.
+// Refresh tokens are single use: the presented one is marked as used and the new one joins its family.
+// An unknown or expired refresh token is answered with "401 Unauthorized". Presenting a refresh token that
+// was already used means it was copied, so the whole family is revoked and the legitimate holder has to log in again.
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	var req refreshRequest
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.RefreshToken == "" {
+		writeError(w, r, validate.Errors{"refresh_token": "is required"})
+		return
+	}
+
+	refreshToken, next, err := s.newRefreshToken()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = s.stores.Tokens.RotateRefreshToken(r.Context(), hashToken(req.RefreshToken), next)
+	if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrTokenReused) {
+		writeError(w, r, newError(http.StatusUnauthorized, codeInvalidRefresh, "Invalid refresh token"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user, err := s.stores.Users.Get(r.Context(), next.UserID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.writeTokens(w, r, user, refreshToken, http.StatusOK)
+}
+
+// handleLogout is a HTTP handler function that ends the session of the authenticated user.
+// The access token the request was made with is put on the denylist until it expires, and if the body
+// carries the refresh token of the session its whole family is revoked as well. It clears the "jwt" and "csrf_token" cookies
+// and answers with "204 No Content".
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	var req refreshRequest
+	if err := s.decodeOptional(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	claims := claimsFromContext(r.Context())
+	if err := s.stores.Tokens.DenyAccessToken(r.Context(), claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.RefreshToken != "" {
+		if err := s.stores.Tokens.RevokeRefreshFamily(r.Context(), hashToken(req.RefreshToken)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: jwtCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteStrictMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: "", Path: "/", MaxAge: -1, Secure: true, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestCookieCSRF checks that requests authenticated by the jwt cookie alone can not change anything
+// unless they repeat the CSRF token, as a form posted by another site could not.
+func TestCookieCSRF(t *testing.T) {
+	stores := store.NewMemory()
+	h := newTestServer(t, stores)
+	product := &models.Product{Name: "Target", Price: 5, Quantity: 10}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/signup", strings.NewReader(`{"username":"victim","email":"victim@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var tokens tokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	jwtC, csrfC := cookies[jwtCookie], cookies[csrfCookie]
+	if jwtC == nil || csrfC == nil || csrfC.Value != tokens.CSRFToken {
+		t.Fatalf("cookies %v, csrf_token %q", rec.Result().Cookies(), tokens.CSRFToken)
+	}
+	for _, c := range []*http.Cookie{jwtC, csrfC} {
+		if !c.Secure || c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("cookie %s is not Secure and SameSite=Strict: %v", c.Name, c)
+		}
+	}
+	if !jwtC.HttpOnly || csrfC.HttpOnly {
+		t.Error("only the jwt cookie should be HttpOnly")
+	}
+
+	buyWithCookies := func(csrf string) *httptest.ResponseRecorder {
+		form := url.Values{"productID": {fmt.Sprint(product.ID)}, "token": {payment.TokenVisa}, "amount": {"5"}}
+		req := httptest.NewRequest("POST", "/buy", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(jwtC)
+		req.AddCookie(csrfC)
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, csrf := range []string{"", "guessed"} {
+		rec := buyWithCookies(csrf)
+		if p := decodeProblem(t, rec); rec.Code != http.StatusForbidden || p.Code != codeInvalidCSRFToken {
+			t.Errorf("buying with the cookie and CSRF token %q: %d %s", csrf, rec.Code, rec.Body)
+		}
+	}
+	if rec := buyWithCookies(tokens.CSRFToken); rec.Code != http.StatusCreated {
+		t.Errorf("buying with the cookie and the CSRF token: %d %s", rec.Code, rec.Body)
+	}
+
+	// Reading needs no CSRF token, and neither do requests with the Authorization header.
+	req = httptest.NewRequest("GET", "/orders", nil)
+	req.AddCookie(jwtC)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("listing orders with the cookie: %d %s", rec.Code, rec.Body)
+	}
+	if rec := buy(h, tokens.Token, product.ID, 1, 5, payment.TokenVisa); rec.Code != http.StatusCreated {
+		t.Errorf("buying with the Authorization header: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(h, "POST", "/logout", tokens.Token, "")
+	cleared := map[string]bool{}
+	for _, c := range rec.Result().Cookies() {
+		cleared[c.Name] = c.MaxAge < 0 && c.Secure && c.SameSite == http.SameSiteStrictMode
+	}
+	if rec.Code != http.StatusNoContent || !cleared[jwtCookie] || !cleared[csrfCookie] {
+		t.Errorf("logout: %d, cleared %v", rec.Code, cleared)
+	}
+}
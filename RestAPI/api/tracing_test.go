@@ -0,0 +1,104 @@
+package api
+
+import (
+	"RestAPI/pkg/store"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	// The tracer of the package keeps the first provider installed, so the recorder stays for the remaining tests.
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	stores := store.NewMemory()
+	h := newTestServer(t, stores)
+	token := signUp(t, h, "traced")
+	user, err := stores.Users.GetByUsername(context.Background(), "traced")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest("GET", "/orders/42", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "GET /orders/" {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans for the request", len(spans))
+	}
+	span := spans[0]
+	if span.SpanContext().TraceID().String() != traceID || span.Parent().SpanID().String() != spanID {
+		t.Errorf("span %s is not a child of the caller's span", span.SpanContext().SpanID())
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	for key, want := range map[attribute.Key]string{
+		"http.request.method":       "GET",
+		"http.route":                "/orders/",
+		"url.path":                  "/orders/42",
+		"http.response.status_code": strconv.Itoa(http.StatusNotFound),
+		"enduser.id":                strconv.Itoa(user.ID),
+	} {
+		if got := attrs[key].Emit(); got != want {
+			t.Errorf("%s is %q, want %q", key, got, want)
+		}
+	}
+	if span.Status().Code == codes.Error {
+		t.Error("a 404 marked the span as failed")
+	}
+
+	// Signing up hashed the password within the span of the request.
+	var signup, hash sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "POST /signup":
+			signup = span
+		case "bcrypt.GenerateFromPassword":
+			hash = span
+		}
+	}
+	if signup == nil || hash == nil || hash.Parent().SpanID() != signup.SpanContext().SpanID() {
+		t.Error("no bcrypt span within the signup")
+	}
+
+	// An unknown username is compared against a dummy hash, so it takes as long as a wrong password.
+	if rec := do(h, "POST", "/login", "", `{"username": "unknown", "password": "secret123"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login of an unknown user: %d %s", rec.Code, rec.Body)
+	}
+	var login, compare sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "POST /login":
+			login = span
+		case "bcrypt.CompareHashAndPassword":
+			compare = span
+		}
+	}
+	if login == nil || compare == nil || compare.Parent().SpanID() != login.SpanContext().SpanID() {
+		t.Error("no bcrypt span within the login of an unknown user")
+	}
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/vault"
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// runRotateCardKeys implements the "rotate-card-keys" subcommand. After a new master key was added to
+// VAULT_MASTER_KEYS and made VAULT_CURRENT_KEY, it rewraps the data key of every saved card number with it.
+// Once it has run, the old master keys can be removed from the configuration.
+func runRotateCardKeys(ctx context.Context, logger *slog.Logger, cards store.CreditCardStore, v *vault.Vault) error {
+	stale, err := cards.ListNotWrappedBy(ctx, v.CurrentKeyID())
+	if err != nil {
+		return err
+	}
+	for _, card := range stale {
+		number, err := v.Rewrap(&card.Number)
+		if err != nil {
+			return fmt.Errorf("rotate-card-keys: card %d: %w", card.ID, err)
+		}
+		if err := cards.SetNumber(ctx, card.ID, *number); err != nil {
+			return err
+		}
+	}
+	logger.Info("rewrapped card numbers", "count", len(stale), "key_id", v.CurrentKeyID())
+	return nil
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"RestAPI/pkg/migrate"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// runMigrate implements the "migrate" subcommand:
+//
+//	migrate up        apply every pending migration (the default)
+//	migrate down [n]  roll back the last n migrations, 1 if n is omitted
+//	migrate status    list every migration and when it was applied
+func runMigrate(ctx context.Context, logger *slog.Logger, db *sql.DB, args []string) error {
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			logger.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: invalid step count %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			logger.Info("reverted migration", "version", m.Version, "name", m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("migrate: unknown action %q, expected up, down or status", action)
+	}
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/store"
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// runGrantRole implements the "grant-role <username> <role>" subcommand.
+// It is how the first admin is created, after that admins grant roles through /admin/users/{id}/roles.
+func runGrantRole(ctx context.Context, logger *slog.Logger, users store.UserStore, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: grant-role <username> <role>")
+	}
+	username, role := args[0], args[1]
+	if !models.IsRole(role) {
+		return fmt.Errorf("grant-role: unknown role %q", role)
+	}
+
+	user, err := users.GetByUsername(ctx, username)
+	if err != nil {
+		return fmt.Errorf("grant-role: %s: %w", username, err)
+	}
+	if user, err = users.GrantRole(ctx, user.ID, role); err != nil {
+		return err
+	}
+	logger.Info("granted role", "username", user.Username, "role", role, "roles", user.Roles)
+	return nil
+}
@@ -2,18 +2,282 @@ package cmd
 
 import (
 	"RestAPI/api"
+	"RestAPI/pkg/auth"
 	"RestAPI/pkg/config"
 	"RestAPI/pkg/database"
-	"log"
+	"RestAPI/pkg/logging"
+	"RestAPI/pkg/metrics"
+	"RestAPI/pkg/migrate"
+	"RestAPI/pkg/payment"
+	"RestAPI/pkg/store"
+	"RestAPI/pkg/tracing"
+	"RestAPI/pkg/vault"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Exit codes of the process.
+const (
+	// exitOK means the server shut down cleanly or the subcommand succeeded.
+	exitOK = 0
+	// exitFailure means the server could not start, stopped serving on its own, or a subcommand failed.
+	exitFailure = 1
+	// exitShutdownTimeout means in-flight requests were still running when the shutdown deadline passed
+	// and their connections were closed forcibly.
+	exitShutdownTimeout = 2
+)
+
+// refundRetryInterval is how often the server retries the refunds of cancelled orders that could not be paid back.
+const refundRetryInterval = time.Minute
+
+// pendingOrderSweepInterval is how often the server looks for orders that waited too long for their payment.
+const pendingOrderSweepInterval = time.Minute
+
+// Run starts the API server and exits the process with one of the exit codes above.
+// Started as "RestAPI migrate ...", "RestAPI grant-role ..." or "RestAPI rotate-card-keys" it only runs that subcommand instead.
+// The server always brings the schema up to date before it starts listening.
 func Run() {
-	config := config.NewConfig()
-	database.InitDb(config)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	config, args, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		// There is no configuration to build the logger from yet.
+		slog.Error("loading configuration", "error", err)
+		return exitFailure
+	}
+	logger := logging.New(config, os.Stderr)
+	// Whatever still logs through the log package or the default slog logger ends up in the same format.
+	slog.SetDefault(logger)
 
-	r := api.Router()
-	log.Fatal(http.ListenAndServe(":8080", r))
-	defer database.GetDb().Close()
+	shutdownTracing, err := tracing.Setup(context.Background(), config)
+	if err != nil {
+		logger.Error("setting up tracing", "error", err)
+		return exitFailure
+	}
+	// Runs after the servers stopped, so the spans of the last requests are exported too.
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("exporting the remaining spans", "error", err)
+		}
+	}()
+
+	keys, err := auth.NewKeySet(config)
+	if err != nil {
+		logger.Error("loading signing keys", "error", err)
+		return exitFailure
+	}
+	payments, err := payment.NewGateway(config)
+	if err != nil {
+		logger.Error("creating payment gateway", "error", err)
+		return exitFailure
+	}
+	vault, err := vault.New(config)
+	if err != nil {
+		logger.Error("opening card vault", "error", err)
+		return exitFailure
+	}
+	db, err := database.InitDb(config, logger)
+	if err != nil {
+		logger.Error("connecting to database", "error", err)
+		return exitFailure
+	}
+	// Every return path below closes the pool, which waits for the connections in use to be returned.
+	defer db.Close()
+
+	ctx := context.Background()
+	if len(args) > 0 && args[0] == "migrate" {
+		return exitCode(logger, runMigrate(ctx, logger, db, args[1:]))
+	}
+	if err := runMigrate(ctx, logger, db, []string{"up"}); err != nil {
+		logger.Error("migrating database", "error", err)
+		return exitFailure
+	}
+
+	stores := store.NewPostgres(db)
+	if len(args) > 0 && args[0] == "grant-role" {
+		return exitCode(logger, runGrantRole(ctx, logger, stores.Users, args[1:]))
+	}
+	if len(args) > 0 && args[0] == "rotate-card-keys" {
+		return exitCode(logger, runRotateCardKeys(ctx, logger, stores.CreditCards, vault))
+	}
+
+	m := metrics.New()
+	if err := m.RegisterDB(db, config.Database.Name); err != nil {
+		logger.Error("registering database metrics", "error", err)
+		return exitFailure
+	}
+	apiServer := api.NewServer(config, stores, keys, payments, vault, logger, m)
+	if err := addReadinessChecks(apiServer, logger, db); err != nil {
+		logger.Error("adding readiness checks", "error", err)
+		return exitFailure
+	}
+	server := &http.Server{
+		Addr:              config.Server.ListenAddr,
+		Handler:           apiServer.Router(),
+		ReadTimeout:       config.Server.ReadTimeout,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+	}
+	jobs, stopJobs := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	// Runs before the pool is closed: a job in the middle of a run finishes it, so it never finds the database gone.
+	defer running.Wait()
+	defer stopJobs()
+	start := func(name string, interval time.Duration, job func(context.Context) error) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			every(jobs, logger, name, interval, job)
+		}()
+	}
+	start("retrying refunds", refundRetryInterval, apiServer.RetryRefunds)
+	if config.Payment.PendingOrderTTL > 0 {
+		start("expiring unpaid orders", pendingOrderSweepInterval, apiServer.ExpirePendingOrders)
+	}
+
+	servers := []*http.Server{server}
+	if config.Server.AdminListenAddr != "" {
+		servers = append(servers, adminServer(config, m))
+	}
+	return serve(logger, config, apiServer.Drain, servers...)
+}
+
+// addReadinessChecks makes /readyz check that the database answers a ping and that its schema is at the
+// version of the newest migration this binary knows.
+func addReadinessChecks(server *api.Server, logger *slog.Logger, db *sql.DB) error {
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+	server.AddReadinessCheck("database", func(ctx context.Context) error {
+		if err := db.PingContext(ctx); err != nil {
+			// The error names hosts and addresses, which /readyz does not show.
+			logger.Warn("database ping failed", "error", err)
+			return errors.New("the database does not answer")
+		}
+		return nil
+	})
+	server.AddReadinessCheck("migrations", func(ctx context.Context) error {
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			logger.Warn("reading the schema version failed", "error", err)
+			return errors.New("the schema version could not be read")
+		}
+		if latest := migrator.Latest(); version != latest {
+			return fmt.Errorf("at version %d, want %d", version, latest)
+		}
+		return nil
+	})
+	return nil
+}
+
+// every runs the job once per interval until ctx is done. Failures are logged and the job runs again at the next interval.
+func every(ctx context.Context, logger *slog.Logger, name string, interval time.Duration, job func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job(ctx); err != nil {
+				logger.Error(name, "error", err)
+			}
+		}
+	}
+}
+
+// adminServer returns the server for operators, kept apart from the API so that it can be left unexposed.
+// It serves the Prometheus metrics at /metrics.
+func adminServer(config *config.Config, m *metrics.Metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	return &http.Server{
+		Addr:              config.Server.AdminListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+	}
+}
+
+// serve runs the servers until one of them fails or the process receives SIGINT or SIGTERM.
+// On a signal it calls drain, keeps serving for config.Server.DrainDelay, then stops accepting connections and gives
+// in-flight requests config.Server.ShutdownTimeout to finish.
+// A second signal during that time restores the default behaviour and kills the process immediately.
+func serve(logger *slog.Logger, config *config.Config, drain func(), servers ...*http.Server) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			logger.Info("listening", "addr", server.Addr)
+			errc <- server.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		logger.Error("server stopped", "error", err)
+		for _, server := range servers {
+			server.Close()
+		}
+		return exitFailure
+	case <-ctx.Done():
+	}
+	stop()
+	drain()
+	if config.Server.DrainDelay > 0 {
+		logger.Info("draining, failing readiness before shutdown", "delay", config.Server.DrainDelay)
+		time.Sleep(config.Server.DrainDelay)
+	}
+
+	logger.Info("shutting down, waiting for in-flight requests", "timeout", config.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+	code := exitOK
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("shutdown", "addr", server.Addr, "error", err)
+			server.Close()
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = exitShutdownTimeout
+			} else if code == exitOK {
+				code = exitFailure
+			}
+		}
+	}
+	if code == exitOK {
+		logger.Info("server stopped")
+	}
+	return code
+}
 
+// exitCode logs err, if any, and turns it into an exit code.
+func exitCode(logger *slog.Logger, err error) int {
+	if err != nil {
+		logger.Error("command failed", "error", err)
+		return exitFailure
+	}
+	return exitOK
 }
@@ -0,0 +1,201 @@
+// Package auth holds the key material used to sign and verify the API's JSON web tokens.
+package auth
+
+import (
+	"RestAPI/pkg/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Key is one signing or verification key identified by its key ID.
+// signKey is nil for keys that are only used for verification.
+type Key struct {
+	ID        string
+	Algorithm string
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet signs tokens with its current key and verifies tokens signed by any of its keys.
+// Keeping the previous public keys in the set lets a new signing key be rolled out
+// without invalidating tokens that were issued with the old one.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet builds the KeySet described by the JWT settings of config.
+func NewKeySet(config *config.Config) (*KeySet, error) {
+	material := []byte(config.JWT.SigningKey)
+	if config.JWT.SigningKeyFile != "" {
+		var err error
+		if material, err = os.ReadFile(config.JWT.SigningKeyFile); err != nil {
+			return nil, fmt.Errorf("auth: read signing key: %w", err)
+		}
+	}
+	if len(material) == 0 {
+		return nil, errors.New("auth: no signing key configured, set JWT_SIGNING_KEY or JWT_SIGNING_KEY_FILE")
+	}
+
+	signing, err := newSigningKey(config.JWT.Algorithm, config.JWT.KeyID, material)
+	if err != nil {
+		return nil, err
+	}
+	ks := &KeySet{signing: signing, keys: map[string]*Key{signing.ID: signing}}
+
+	for kid, path := range config.JWT.VerificationKeys {
+		if _, ok := ks.keys[kid]; ok {
+			return nil, fmt.Errorf("auth: key id %q is configured twice", kid)
+		}
+		material, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth: read verification key %q: %w", kid, err)
+		}
+		key, err := newVerificationKey(kid, material)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[kid] = key
+	}
+	return ks, nil
+}
+
+func newSigningKey(alg, kid string, material []byte) (*Key, error) {
+	if alg == HS256 {
+		if len(material) < 32 {
+			return nil, errors.New("auth: HS256 signing key must be at least 32 bytes long")
+		}
+		if kid == "" {
+			kid = "default"
+		}
+		return &Key{ID: kid, Algorithm: HS256, signKey: material, verifyKey: material}, nil
+	}
+
+	private, err := parsePrivateKey(material)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("auth: unsupported private key type %T", private)
+	}
+	if got := algorithmFor(signer.Public()); got != alg {
+		return nil, fmt.Errorf("auth: signing key is a %s key but JWT_ALGORITHM is %q", got, alg)
+	}
+	if kid == "" {
+		if kid, err = thumbprint(signer.Public()); err != nil {
+			return nil, err
+		}
+	}
+	return &Key{ID: kid, Algorithm: alg, signKey: private, verifyKey: signer.Public()}, nil
+}
+
+func newVerificationKey(kid string, material []byte) (*Key, error) {
+	block, _ := pem.Decode(material)
+	if block == nil {
+		return nil, fmt.Errorf("auth: verification key %q is not PEM encoded", kid)
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		// Accept a private key as well and only keep its public half.
+		private, perr := parsePrivateKey(material)
+		signer, ok := private.(crypto.Signer)
+		if perr != nil || !ok {
+			return nil, fmt.Errorf("auth: verification key %q: %w", kid, err)
+		}
+		public = signer.Public()
+	}
+	alg := algorithmFor(public)
+	if alg == "" {
+		return nil, fmt.Errorf("auth: verification key %q has an unsupported type %T", kid, public)
+	}
+	return &Key{ID: kid, Algorithm: alg, verifyKey: public}, nil
+}
+
+// parsePrivateKey accepts PKCS#8, PKCS#1 (RSA) and SEC 1 (EC) PEM blocks.
+func parsePrivateKey(material []byte) (interface{}, error) {
+	block, _ := pem.Decode(material)
+	if block == nil {
+		return nil, errors.New("auth: signing key is not PEM encoded")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+// algorithmFor returns the JWT algorithm used with the given public key, or "" if it is not supported.
+func algorithmFor(public crypto.PublicKey) string {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return ES256
+		}
+	case ed25519.PublicKey:
+		return EdDSA
+	}
+	return ""
+}
+
+// thumbprint derives a stable key ID from the DER encoding of the public key.
+func thumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Sign returns the signed token for claims, with the ID of the signing key in its "kid" header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(ks.signing.Algorithm), claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.signKey)
+}
+
+// Parse verifies tokenString and decodes its claims into claims.
+// The key is chosen by the "kid" header, tokens without one are checked against the signing key.
+// The algorithm of the token must match the algorithm of that key, so a public key can never be
+// abused as an HMAC secret.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		key := ks.signing
+		if kid, ok := token.Header["kid"].(string); ok {
+			if key, ok = ks.keys[kid]; !ok {
+				return nil, fmt.Errorf("unknown key id %q", kid)
+			}
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	})
+	return err
+}
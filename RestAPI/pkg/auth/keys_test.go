@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"RestAPI/pkg/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const hmacSecret = "0123456789abcdef0123456789abcdef"
+
+// testKeys are generated once, RSA keys take a while.
+var testKeys = map[string]crypto.Signer{}
+
+func testKey(t *testing.T, alg string) crypto.Signer {
+	t.Helper()
+	if key, ok := testKeys[alg]; ok {
+		return key
+	}
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch alg {
+	case RS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys[alg] = key
+	return key
+}
+
+func privatePEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func publicPEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func writeKey(t *testing.T, pem string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, []byte(pem), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// keySet returns the KeySet signing with a new key of the algorithm under the key ID.
+func keySet(t *testing.T, alg, kid string, verificationKeys map[string]string) *KeySet {
+	t.Helper()
+	c := config.Default()
+	c.JWT.Algorithm, c.JWT.KeyID, c.JWT.VerificationKeys = alg, kid, verificationKeys
+	c.JWT.SigningKey = hmacSecret
+	if alg != HS256 {
+		c.JWT.SigningKey = privatePEM(t, testKey(t, alg))
+	}
+	ks, err := NewKeySet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func claims() *jwt.StandardClaims {
+	return &jwt.StandardClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+}
+
+// forge signs a token with the given method, key ID and key, as an attacker would.
+func forge(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims())
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, alg := range []string{HS256, RS256, ES256, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			ks := keySet(t, alg, "", nil)
+			signed, err := ks.Sign(claims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got jwt.StandardClaims
+			if err := ks.Parse(signed, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Subject != "42" {
+				t.Errorf("parsed subject %q", got.Subject)
+			}
+			token, _, err := new(jwt.Parser).ParseUnverified(signed, &jwt.StandardClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["alg"] != alg || token.Header["kid"] != ks.signing.ID || ks.signing.ID == "" {
+				t.Errorf("header %v, want alg %s and kid %q", token.Header, alg, ks.signing.ID)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	ks := keySet(t, RS256, "current", nil)
+	rsaKey := testKey(t, RS256).(*rsa.PrivateKey)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		token string
+		error string
+	}{
+		// The public key is no secret: used as HMAC secret it would let anyone sign tokens.
+		{"HS256 with the public key as secret", forge(t, jwt.SigningMethodHS256, "current", []byte(publicPEM(t, rsaKey))), "unexpected signing method"},
+		{"HS256 without kid", forge(t, jwt.SigningMethodHS256, "", []byte(publicPEM(t, rsaKey))), "unexpected signing method"},
+		{"alg none", forge(t, jwt.SigningMethodNone, "current", jwt.UnsafeAllowNoneSignatureType), "unexpected signing method"},
+		{"unknown kid", forge(t, jwt.SigningMethodRS256, "retired", rsaKey), `unknown key id "retired"`},
+		{"signed by another key", forge(t, jwt.SigningMethodRS256, "current", other), "verification error"},
+		{"tampered", func() string {
+			signed, _ := ks.Sign(claims())
+			parts := strings.Split(signed, ".")
+			parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1"}`))
+			return strings.Join(parts, ".")
+		}(), "verification error"},
+	} {
+		if err := ks.Parse(c.token, &jwt.StandardClaims{}); err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("%s: %v, want an error containing %q", c.name, err, c.error)
+		}
+	}
+}
+
+// TestVerificationKeys rotates from an ES256 key to an EdDSA one: tokens of the old key stay valid,
+// but new tokens are only ever signed with the new key.
+func TestVerificationKeys(t *testing.T) {
+	old := keySet(t, ES256, "old", nil)
+	issued, err := old.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key may be configured by its public or its private half, only the public half is kept.
+	for name, material := range map[string]string{
+		"public key":  publicPEM(t, testKey(t, ES256)),
+		"private key": privatePEM(t, testKey(t, ES256)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ks := keySet(t, EdDSA, "new", map[string]string{"old": writeKey(t, material)})
+			if err := ks.Parse(issued, &jwt.StandardClaims{}); err != nil {
+				t.Errorf("a token of the old key was rejected: %v", err)
+			}
+			if key := ks.keys["old"]; key == nil || key.signKey != nil || key.Algorithm != ES256 {
+				t.Errorf("verification key %+v", key)
+			}
+
+			signed, err := ks.Sign(claims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := new(jwt.Parser).ParseUnverified(signed, &jwt.StandardClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["kid"] != "new" || token.Header["alg"] != EdDSA {
+				t.Errorf("signed with %v, want the new key", token.Header)
+			}
+			if err := old.Parse(signed, &jwt.StandardClaims{}); err == nil {
+				t.Error("the new token verifies with the old key")
+			}
+		})
+	}
+}
+
+func TestNewKeySetErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, alg, key string
+		verify         map[string]string
+		error          string
+	}{
+		{"short HMAC secret", HS256, "secret", nil, "at least 32 bytes"},
+		{"RSA key for ES256", ES256, privatePEM(t, testKey(t, RS256)), nil, "is a RS256 key but JWT_ALGORITHM is \"ES256\""},
+		{"EC key for RS256", RS256, privatePEM(t, testKey(t, ES256)), nil, "is a ES256 key but JWT_ALGORITHM is \"RS256\""},
+		{"Ed25519 key for ES256", ES256, privatePEM(t, testKey(t, EdDSA)), nil, "is a EdDSA key"},
+		{"P-384 key", ES256, privatePEM(t, testKey(t, "ES384")), nil, "JWT_ALGORITHM is \"ES256\""},
+		{"not PEM", RS256, "-----BEGIN nothing", nil, "not PEM encoded"},
+		{"kid configured twice", HS256, hmacSecret, map[string]string{"default": writeKey(t, publicPEM(t, testKey(t, RS256)))}, "configured twice"},
+		{"verification key not PEM", HS256, hmacSecret, map[string]string{"old": writeKey(t, "garbage")}, "not PEM encoded"},
+		{"verification key missing", HS256, hmacSecret, map[string]string{"old": filepath.Join(t.TempDir(), "missing.pem")}, "read verification key"},
+		{"unsupported verification key", HS256, hmacSecret, map[string]string{"old": writeKey(t, publicPEM(t, testKey(t, "ES384")))}, "unsupported type"},
+	} {
+		cfg := config.Default()
+		cfg.JWT.Algorithm, cfg.JWT.SigningKey, cfg.JWT.VerificationKeys = c.alg, c.key, c.verify
+		_, err := NewKeySet(cfg)
+		if err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("%s: %v, want an error containing %q", c.name, err, c.error)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, ecKey, edKey := testKey(t, RS256), testKey(t, ES256).(*ecdsa.PrivateKey), testKey(t, EdDSA)
+	ks := keySet(t, HS256, "", map[string]string{
+		"a-rsa": writeKey(t, publicPEM(t, rsaKey)),
+		"b-ec":  writeKey(t, publicPEM(t, ecKey)),
+		"c-ed":  writeKey(t, publicPEM(t, edKey)),
+	})
+	keys := ks.JWKS().Keys
+	// The HMAC secret is never published.
+	if len(keys) != 3 || keys[0].KeyID != "a-rsa" || keys[1].KeyID != "b-ec" || keys[2].KeyID != "c-ed" {
+		t.Fatalf("JWKS lists %+v", keys)
+	}
+
+	decode := func(s string) []byte {
+		t.Helper()
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	public := rsaKey.Public().(*rsa.PublicKey)
+	if k := keys[0]; k.KeyType != "RSA" || k.Algorithm != RS256 || k.Use != "sig" ||
+		new(big.Int).SetBytes(decode(k.N)).Cmp(public.N) != 0 || new(big.Int).SetBytes(decode(k.E)).Int64() != int64(public.E) {
+		t.Errorf("RSA key %+v", k)
+	}
+	if k := keys[1]; k.KeyType != "EC" || k.Algorithm != ES256 || k.Curve != "P-256" || len(decode(k.X)) != 32 || len(decode(k.Y)) != 32 ||
+		new(big.Int).SetBytes(decode(k.X)).Cmp(ecKey.X) != 0 || new(big.Int).SetBytes(decode(k.Y)).Cmp(ecKey.Y) != 0 {
+		t.Errorf("EC key %+v", k)
+	}
+	if k := keys[2]; k.KeyType != "OKP" || k.Algorithm != EdDSA || k.Curve != "Ed25519" || string(decode(k.X)) != string(edKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 key %+v", k)
+	}
+}
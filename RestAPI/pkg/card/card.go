@@ -0,0 +1,72 @@
+// Package card knows about the numbers of payment cards.
+package card
+
+import "strconv"
+
+// Card brands returned by Brand.
+const (
+	Visa       = "visa"
+	Mastercard = "mastercard"
+	Amex       = "amex"
+	Discover   = "discover"
+	Diners     = "diners"
+	JCB        = "jcb"
+	UnionPay   = "unionpay"
+	Unknown    = "unknown"
+)
+
+// brandRange is a range of issuer identification numbers, the leading digits of a card number.
+// Prefixes are compared on as many digits as low has.
+type brandRange struct {
+	low, high string
+	brand     string
+}
+
+// brandRanges is checked in order, so narrower ranges have to come before broader ones they overlap with.
+var brandRanges = []brandRange{
+	{"4", "4", Visa},
+	{"51", "55", Mastercard},
+	{"2221", "2720", Mastercard},
+	{"34", "34", Amex},
+	{"37", "37", Amex},
+	{"6011", "6011", Discover},
+	{"644", "649", Discover},
+	{"65", "65", Discover},
+	{"300", "305", Diners},
+	{"36", "36", Diners},
+	{"38", "39", Diners},
+	{"3528", "3589", JCB},
+	{"62", "62", UnionPay},
+}
+
+// Brand returns the brand of the card number, one of the constants above. The number must consist of digits only.
+func Brand(number string) string {
+	for _, r := range brandRanges {
+		if len(number) < len(r.low) {
+			continue
+		}
+		prefix, err := strconv.Atoi(number[:len(r.low)])
+		if err != nil {
+			return Unknown
+		}
+		low, _ := strconv.Atoi(r.low)
+		high, _ := strconv.Atoi(r.high)
+		if prefix >= low && prefix <= high {
+			return r.brand
+		}
+	}
+	return Unknown
+}
+
+// Last4 returns the last four digits of the card number, which are safe to show.
+func Last4(number string) string {
+	if len(number) < 4 {
+		return number
+	}
+	return number[len(number)-4:]
+}
+
+// Mask returns how a card is shown to its owner, with every digit but the last four hidden.
+func Mask(last4 string) string {
+	return "**** **** **** " + last4
+}
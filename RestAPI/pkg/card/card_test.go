@@ -0,0 +1,93 @@
+package card
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrand(t *testing.T) {
+	for number, want := range map[string]string{
+		"4242424242424242": Visa,
+		"5555555555554444": Mastercard,
+		"2223003122003222": Mastercard,
+		"378282246310005":  Amex,
+		"6011111111111117": Discover,
+		"6445644564456445": Discover,
+		"30569309025904":   Diners,
+		"3566002020360505": JCB,
+		"6200000000000005": UnionPay,
+		"9999999999999995": Unknown,
+	} {
+		if got := Brand(number); got != want {
+			t.Errorf("Brand(%s) = %s, want %s", number, got, want)
+		}
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	for number, want := range map[string]bool{
+		"4242424242424242": true,
+		"4242424242424241": false,
+		"378282246310005":  true,
+		"79927398713":      true,
+		"79927398710":      false,
+		"4242x42424242424": false,
+		"":                 false,
+	} {
+		if got := Luhn(number); got != want {
+			t.Errorf("Luhn(%q) = %v, want %v", number, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2026, time.June, 15, 0, 0, 0, 0, time.UTC)
+	valid := Details{Number: "4242 4242 4242 4242", ExpiryMonth: "6", ExpiryYear: "26", CVV: "123", Name: "  jane   o'neil-doe "}
+	d := valid
+	if err := Validate(&d, now); err != nil {
+		t.Fatalf("valid card: %v", err)
+	}
+	want := Details{Number: "4242424242424242", ExpiryMonth: "06", ExpiryYear: "2026", CVV: "123", Name: "JANE O'NEIL-DOE"}
+	if d != want {
+		t.Errorf("normalized to %+v, want %+v", d, want)
+	}
+
+	for name, tc := range map[string]struct {
+		change func(*Details)
+		field  string
+	}{
+		"missing number":        {func(d *Details) { d.Number = "" }, "card_number"},
+		"too short":             {func(d *Details) { d.Number = "42424242424" }, "card_number"},
+		"too long":              {func(d *Details) { d.Number = "42424242424242424242" }, "card_number"},
+		"letters":               {func(d *Details) { d.Number = "4242a24242424242" }, "card_number"},
+		"checksum":              {func(d *Details) { d.Number = "4242424242424241" }, "card_number"},
+		"visa length":           {func(d *Details) { d.Number = "424242424242424" }, "card_number"},
+		"amex length":           {func(d *Details) { d.Number = "3782822463100050"; d.CVV = "1234" }, "card_number"},
+		"amex cvv":              {func(d *Details) { d.Number = "378282246310005" }, "cvv"},
+		"visa cvv":              {func(d *Details) { d.CVV = "1234" }, "cvv"},
+		"missing cvv":           {func(d *Details) { d.CVV = "" }, "cvv"},
+		"month 0":               {func(d *Details) { d.ExpiryMonth = "0" }, "expiry_month"},
+		"month 13":              {func(d *Details) { d.ExpiryMonth = "13" }, "expiry_month"},
+		"three digit year":      {func(d *Details) { d.ExpiryYear = "202" }, "expiry_year"},
+		"expired last month":    {func(d *Details) { d.ExpiryMonth = "05" }, "expiry_year"},
+		"expired last year":     {func(d *Details) { d.ExpiryMonth = "12"; d.ExpiryYear = "2025" }, "expiry_year"},
+		"too far in the future": {func(d *Details) { d.ExpiryYear = "2099" }, "expiry_year"},
+		"missing name":          {func(d *Details) { d.Name = " " }, "name_on_card"},
+		"digits in name":        {func(d *Details) { d.Name = "R2D2" }, "name_on_card"},
+		"long name":             {func(d *Details) { d.Name = strings.Repeat("a", MaxNameLength+1) }, "name_on_card"},
+	} {
+		d := valid
+		tc.change(&d)
+		err := Validate(&d, now)
+		errs, ok := err.(FieldErrors)
+		if !ok || errs[tc.field] == "" || len(errs) != 1 {
+			t.Errorf("%s: got %v, want one error for %s", name, err, tc.field)
+		}
+	}
+
+	d = Details{Number: "1234", ExpiryMonth: "x", ExpiryYear: "", CVV: "", Name: ""}
+	if errs, _ := Validate(&d, now).(FieldErrors); len(errs) != 5 {
+		t.Errorf("every field invalid: got %v", errs)
+	}
+}
@@ -0,0 +1,222 @@
+package card
+
+import (
+	"RestAPI/pkg/validate"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxNameLength is the longest name on card accepted, the size of the name_on_card column.
+const MaxNameLength = 50
+
+// maxExpiryYears is how many years ahead an expiry date may lie, cards are issued for a few years at most.
+const maxExpiryYears = 20
+
+// Details are the fields of a card as entered by the customer, named like the JSON fields they are read from.
+type Details struct {
+	Number      string `json:"card_number"`
+	ExpiryMonth string `json:"expiry_month"`
+	ExpiryYear  string `json:"expiry_year"`
+	CVV         string `json:"cvv"`
+	Name        string `json:"name_on_card"`
+}
+
+// FieldErrors maps the JSON name of every invalid field to what is wrong with it.
+type FieldErrors = validate.Errors
+
+// rules are the number and CVV lengths of a brand.
+type rules struct {
+	lengths    []int
+	cvvLengths []int
+}
+
+// between returns the lengths from min to max.
+func between(min, max int) []int {
+	var lengths []int
+	for n := min; n <= max; n++ {
+		lengths = append(lengths, n)
+	}
+	return lengths
+}
+
+// brandRules holds the rules of every brand, numbers of an Unknown brand only have to have 12 to 19 digits.
+var brandRules = map[string]rules{
+	Visa:       {lengths: []int{13, 16, 19}, cvvLengths: []int{3}},
+	Mastercard: {lengths: []int{16}, cvvLengths: []int{3}},
+	Amex:       {lengths: []int{15}, cvvLengths: []int{4}},
+	Discover:   {lengths: between(16, 19), cvvLengths: []int{3}},
+	Diners:     {lengths: between(14, 19), cvvLengths: []int{3}},
+	JCB:        {lengths: between(16, 19), cvvLengths: []int{3}},
+	UnionPay:   {lengths: between(16, 19), cvvLengths: []int{3}},
+	Unknown:    {lengths: between(12, 19), cvvLengths: []int{3, 4}},
+}
+
+func contains(lengths []int, n int) bool {
+	for _, l := range lengths {
+		if l == n {
+			return true
+		}
+	}
+	return false
+}
+
+// describe lists lengths for an error message: "15", "13, 16 or 19", "16 to 19".
+func describe(lengths []int) string {
+	if len(lengths) > 2 && lengths[len(lengths)-1]-lengths[0] == len(lengths)-1 {
+		return fmt.Sprintf("%d to %d", lengths[0], lengths[len(lengths)-1])
+	}
+	s := make([]string, len(lengths))
+	for i, l := range lengths {
+		s[i] = strconv.Itoa(l)
+	}
+	if len(s) == 1 {
+		return s[0]
+	}
+	return strings.Join(s[:len(s)-1], ", ") + " or " + s[len(s)-1]
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Luhn reports whether the digits of number pass the Luhn checksum every card number carries in its last digit.
+func Luhn(number string) bool {
+	if !isDigits(number) {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// NormalizeName trims the name, collapses runs of white space into one space and upper-cases it,
+// the way names are embossed on cards.
+func NormalizeName(name string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(name), " "))
+}
+
+// Validate normalizes d in place and checks every field, returning FieldErrors listing all invalid fields at once.
+// Spaces and dashes are removed from the number, the month is zero-padded to two digits, a two digit year gets
+// its century and the name is normalized with NormalizeName. The number has to pass the Luhn checksum and have
+// a length, and the CVV a length, that fits the brand. The card must not have expired at now: it is valid
+// through the last day of its expiry month.
+func Validate(d *Details, now time.Time) error {
+	errs := FieldErrors{}
+	checkNumber(d, errs)
+	checkCVV(d, errs)
+	checkExpiry(d, errs, now)
+	checkName(d, errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks the details as they are entered at the current time, see the Validate function.
+func (d *Details) Validate() error {
+	return Validate(d, time.Now())
+}
+
+// ValidateUpdate is Validate for a saved card, of which only the expiry and the name can change.
+// The number and CVV of d are ignored.
+func ValidateUpdate(d *Details, now time.Time) error {
+	errs := FieldErrors{}
+	checkExpiry(d, errs, now)
+	checkName(d, errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkNumber(d *Details, errs FieldErrors) {
+	d.Number = strings.NewReplacer(" ", "", "-", "").Replace(d.Number)
+	brand := Brand(d.Number)
+	r := brandRules[brand]
+	switch {
+	case d.Number == "":
+		errs["card_number"] = "is required"
+	case !isDigits(d.Number) || len(d.Number) < 12 || len(d.Number) > 19:
+		errs["card_number"] = "must consist of 12 to 19 digits"
+	case !contains(r.lengths, len(d.Number)):
+		errs["card_number"] = fmt.Sprintf("must have %s digits for %s cards", describe(r.lengths), brand)
+	case !Luhn(d.Number):
+		errs["card_number"] = "is not a valid card number"
+	}
+}
+
+// checkCVV checks the CVV against the brand of the number, so it has to run after checkNumber.
+func checkCVV(d *Details, errs FieldErrors) {
+	brand := Brand(d.Number)
+	r := brandRules[brand]
+	d.CVV = strings.TrimSpace(d.CVV)
+	switch {
+	case d.CVV == "":
+		errs["cvv"] = "is required"
+	case !isDigits(d.CVV) || !contains(r.cvvLengths, len(d.CVV)):
+		if brand == Unknown {
+			errs["cvv"] = "must be 3 or 4 digits"
+		} else {
+			errs["cvv"] = fmt.Sprintf("must be %s digits for %s cards", describe(r.cvvLengths), brand)
+		}
+	}
+}
+
+func checkExpiry(d *Details, errs FieldErrors, now time.Time) {
+	d.ExpiryMonth = strings.TrimSpace(d.ExpiryMonth)
+	month, err := strconv.Atoi(d.ExpiryMonth)
+	if !isDigits(d.ExpiryMonth) || err != nil || month < 1 || month > 12 {
+		errs["expiry_month"] = "must be a month from 01 to 12"
+	} else {
+		d.ExpiryMonth = fmt.Sprintf("%02d", month)
+	}
+	d.ExpiryYear = strings.TrimSpace(d.ExpiryYear)
+	year, err := strconv.Atoi(d.ExpiryYear)
+	switch {
+	case !isDigits(d.ExpiryYear) || err != nil || (len(d.ExpiryYear) != 2 && len(d.ExpiryYear) != 4):
+		errs["expiry_year"] = "must be a year of 2 or 4 digits"
+	case len(d.ExpiryYear) == 2:
+		year += 2000
+		d.ExpiryYear = strconv.Itoa(year)
+	}
+	if errs["expiry_month"] == "" && errs["expiry_year"] == "" {
+		if year < now.Year() || (year == now.Year() && time.Month(month) < now.Month()) {
+			errs["expiry_year"] = "card has expired"
+		} else if year > now.Year()+maxExpiryYears {
+			errs["expiry_year"] = "lies too far in the future"
+		}
+	}
+}
+
+func checkName(d *Details, errs FieldErrors) {
+	d.Name = NormalizeName(d.Name)
+	switch {
+	case d.Name == "":
+		errs["name_on_card"] = "is required"
+	case utf8.RuneCountInString(d.Name) > MaxNameLength:
+		errs["name_on_card"] = fmt.Sprintf("must not be longer than %d characters", MaxNameLength)
+	case strings.IndexFunc(d.Name, func(c rune) bool {
+		return !unicode.IsLetter(c) && !strings.ContainsRune(" '-.", c)
+	}) >= 0:
+		errs["name_on_card"] = "may only contain letters, spaces, apostrophes, hyphens and periods"
+	}
+}
@@ -1,23 +1,541 @@
+// Package config loads the settings of the API.
+//
+// Settings are layered, each layer overriding the previous one:
+//
+//  1. the defaults of Default
+//  2. a YAML file given with -config or CONFIG_FILE
+//  3. environment variables such as DB_HOST
+//  4. command-line flags such as -db-host
+//
+// The result is validated as a whole and every problem is reported at once.
 package config
 
 import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	DbUser     string
-	DbPassword string
-	DbHost     string
-	DbName     string
-	DbPort     string
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	JWT      JWTConfig      `yaml:"jwt"`
+	CORS     CORSConfig     `yaml:"cors"`
+	Payment  PaymentConfig  `yaml:"payment"`
+	Vault    VaultConfig    `yaml:"vault"`
+	Log      LogConfig      `yaml:"log"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+}
+
+// ServerConfig configures the http.Server.
+type ServerConfig struct {
+	// ListenAddr is the address the HTTP server listens on.
+	ListenAddr string `yaml:"listen_addr"`
+	// AdminListenAddr is the address of the admin server, which serves the Prometheus metrics at /metrics
+	// apart from the API. The admin server is not started when it is empty.
+	AdminListenAddr string `yaml:"admin_listen_addr"`
+	// ReadTimeout, ReadHeaderTimeout, WriteTimeout and IdleTimeout are passed on to http.Server.
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes limits the size of the request headers.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// MaxBodyBytes limits the size of JSON request bodies, larger ones are answered with "413 Request Entity Too Large".
+	MaxBodyBytes int `yaml:"max_body_bytes"`
+	// ShutdownTimeout is how long in-flight requests may take to finish after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// DrainDelay is how long /readyz fails after SIGINT or SIGTERM before the server stops accepting connections,
+	// so that load balancers stop sending requests first.
+	DrainDelay time.Duration `yaml:"drain_delay"`
+}
+
+// DatabaseConfig describes the postgres connection and the sql.DB pool.
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+	// MaxOpenConns and MaxIdleConns size the pool, 0 max open connections means unlimited.
+	MaxOpenConns int `yaml:"max_open_conns"`
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// ConnMaxLifetime and ConnMaxIdleTime recycle connections, 0 keeps them forever.
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// ConnectTimeout is how long the server keeps retrying to reach the database at startup, 0 tries only once.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+// JWTConfig describes how tokens are signed and how long they live.
+type JWTConfig struct {
+	// Algorithm is the algorithm tokens are signed with: HS256, RS256, ES256 or EdDSA.
+	Algorithm string `yaml:"algorithm"`
+	// KeyID is put into the "kid" header of every issued token.
+	// When empty it is derived from the public key (or set to "default" for HS256).
+	KeyID string `yaml:"key_id"`
+	// SigningKey is the HMAC secret for HS256, or a PEM encoded private key for the other algorithms.
+	// SigningKeyFile names a file to read it from instead.
+	SigningKey     string `yaml:"signing_key"`
+	SigningKeyFile string `yaml:"signing_key_file"`
+	// VerificationKeys are additional kid to path pairs of PEM public keys that are still accepted
+	// but no longer used for signing, so that keys can be rotated without invalidating issued tokens.
+	VerificationKeys map[string]string `yaml:"verification_keys"`
+	// AccessTokenTTL is how long an access token is valid. It is kept short because an access token
+	// can only be revoked by listing its ID in the denylist, which every request has to check.
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl"`
+	// RefreshTokenTTL is how long a refresh token can be exchanged for a new access token.
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+}
+
+// CORSConfig lists which browser origins may call the API. CORS is disabled while AllowedOrigins is empty.
+type CORSConfig struct {
+	// AllowedOrigins are origins such as "https://shop.example.com", or "*" for any origin.
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// PaymentConfig selects the payment provider orders are charged through.
+type PaymentConfig struct {
+	// Provider is "fake", which accepts every card token except a few test tokens and never charges anyone,
+	// or "stripe".
+	Provider string `yaml:"provider"`
+	// Currency is the ISO currency code prices are charged in.
+	Currency string `yaml:"currency"`
+	// StripeAPIURL is where Stripe requests are sent, point it at stripe-mock to develop locally.
+	StripeAPIURL    string `yaml:"stripe_api_url"`
+	StripeSecretKey string `yaml:"stripe_secret_key"`
+	// Timeout limits every request to the provider.
+	Timeout time.Duration `yaml:"timeout"`
+	// PendingOrderTTL is how long an order waits for its payment before it is cancelled and its items are put
+	// back in stock. 0 keeps unpaid orders forever.
+	PendingOrderTTL time.Duration `yaml:"pending_order_ttl"`
+}
+
+// VaultConfig holds the master keys that encrypt the card numbers in the database.
+type VaultConfig struct {
+	// MasterKeys maps key IDs to base64 encoded 32 byte AES keys. Keys that are no longer current stay
+	// listed until "rotate-card-keys" has rewrapped every card number with the current one.
+	MasterKeys map[string]string `yaml:"master_keys"`
+	// CurrentKey is the ID of the master key new card numbers are encrypted with.
+	CurrentKey string `yaml:"current_key"`
+}
+
+// LogConfig selects the verbosity and output format of the logs.
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is json or text.
+	Format string `yaml:"format"`
 }
 
-func NewConfig() *Config {
+// TracingConfig selects where the OpenTelemetry spans of requests and database queries are exported to.
+type TracingConfig struct {
+	// Exporter is none, otlp, which sends spans over OTLP/HTTP to Endpoint, stdout, or file, which appends them to File.
+	// stdout and file write one JSON document per span, for offline use.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector, Insecure sends spans to it without TLS.
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// File is the path the file exporter appends to.
+	File string `yaml:"file"`
+	// SampleRatio is the share of traces starting here that are recorded, from 0 to 1.
+	// Requests that carry a traceparent header follow the sampling decision of the caller instead.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName names the service in the exported spans.
+	ServiceName string `yaml:"service_name"`
+}
+
+// Default returns the configuration used for every setting that is not given anywhere else.
+func Default() *Config {
 	return &Config{
-		DbUser:     os.Getenv("DB_USER"),
-		DbPassword: os.Getenv("DB_PASSWORD"),
-		DbHost:     os.Getenv("DB_HOST"),
-		DbName:     os.Getenv("DB_NAME"),
-		DbPort:     os.Getenv("DB_PORT"),
+		Server: ServerConfig{
+			ListenAddr:        ":8080",
+			AdminListenAddr:   ":9090",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+			ShutdownTimeout:   20 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			ConnectTimeout:  time.Minute,
+		},
+		JWT: JWTConfig{
+			Algorithm:       "HS256",
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Idempotency-Key", "X-CSRF-Token"},
+			MaxAge:         10 * time.Minute,
+		},
+		Payment: PaymentConfig{
+			Provider:        "fake",
+			Currency:        "usd",
+			StripeAPIURL:    "https://api.stripe.com",
+			Timeout:         10 * time.Second,
+			PendingOrderTTL: time.Hour,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			SampleRatio: 1,
+			ServiceName: "restapi",
+		},
+	}
+}
+
+// setting binds one configuration value to its environment variable.
+// The command-line flag is named after the variable, DB_HOST becomes -db-host.
+type setting struct {
+	env    string
+	usage  string
+	target interface{}
+}
+
+func (s setting) flag() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+func settings(c *Config) []setting {
+	return []setting{
+		{"LISTEN_ADDR", "address the HTTP server listens on", &c.Server.ListenAddr},
+		{"ADMIN_LISTEN_ADDR", "address the admin server with /metrics listens on, empty to disable it", &c.Server.AdminListenAddr},
+		{"READ_TIMEOUT", "maximum duration for reading a request", &c.Server.ReadTimeout},
+		{"READ_HEADER_TIMEOUT", "maximum duration for reading the request headers", &c.Server.ReadHeaderTimeout},
+		{"WRITE_TIMEOUT", "maximum duration for writing a response", &c.Server.WriteTimeout},
+		{"IDLE_TIMEOUT", "how long keep-alive connections stay open", &c.Server.IdleTimeout},
+		{"MAX_HEADER_BYTES", "size limit of the request headers", &c.Server.MaxHeaderBytes},
+		{"MAX_BODY_BYTES", "size limit of JSON request bodies", &c.Server.MaxBodyBytes},
+		{"SHUTDOWN_TIMEOUT", "how long in-flight requests may take to finish on shutdown", &c.Server.ShutdownTimeout},
+		{"DRAIN_DELAY", "how long /readyz fails on shutdown before connections are refused", &c.Server.DrainDelay},
+
+		{"DB_HOST", "postgres host", &c.Database.Host},
+		{"DB_PORT", "postgres port", &c.Database.Port},
+		{"DB_USER", "postgres user", &c.Database.User},
+		{"DB_PASSWORD", "postgres password", &c.Database.Password},
+		{"DB_NAME", "postgres database name", &c.Database.Name},
+		{"DB_SSLMODE", "postgres sslmode", &c.Database.SSLMode},
+		{"DB_MAX_OPEN_CONNS", "maximum open connections, 0 for unlimited", &c.Database.MaxOpenConns},
+		{"DB_MAX_IDLE_CONNS", "maximum idle connections", &c.Database.MaxIdleConns},
+		{"DB_CONN_MAX_LIFETIME", "maximum lifetime of a connection, 0 for unlimited", &c.Database.ConnMaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", "maximum idle time of a connection, 0 for unlimited", &c.Database.ConnMaxIdleTime},
+		{"DB_CONNECT_TIMEOUT", "how long to keep retrying to reach the database at startup, 0 to try once", &c.Database.ConnectTimeout},
+
+		{"JWT_ALGORITHM", "token signing algorithm: HS256, RS256, ES256 or EdDSA", &c.JWT.Algorithm},
+		{"JWT_KEY_ID", "kid header of issued tokens", &c.JWT.KeyID},
+		{"JWT_SIGNING_KEY", "HMAC secret or PEM private key", &c.JWT.SigningKey},
+		{"JWT_SIGNING_KEY_FILE", "file holding the signing key", &c.JWT.SigningKeyFile},
+		{"JWT_VERIFICATION_KEYS", "comma separated kid=path PEM public keys still accepted", &c.JWT.VerificationKeys},
+		{"JWT_ACCESS_TOKEN_TTL", "lifetime of access tokens", &c.JWT.AccessTokenTTL},
+		{"JWT_REFRESH_TOKEN_TTL", "lifetime of refresh tokens", &c.JWT.RefreshTokenTTL},
+
+		{"CORS_ALLOWED_ORIGINS", "comma separated origins allowed to call the API, * for any", &c.CORS.AllowedOrigins},
+		{"CORS_ALLOWED_METHODS", "comma separated methods allowed in CORS requests", &c.CORS.AllowedMethods},
+		{"CORS_ALLOWED_HEADERS", "comma separated headers allowed in CORS requests", &c.CORS.AllowedHeaders},
+		{"CORS_ALLOW_CREDENTIALS", "whether CORS requests may carry cookies", &c.CORS.AllowCredentials},
+		{"CORS_MAX_AGE", "how long browsers may cache a preflight response", &c.CORS.MaxAge},
+
+		{"PAYMENT_PROVIDER", "payment provider: fake or stripe", &c.Payment.Provider},
+		{"PAYMENT_CURRENCY", "ISO currency code prices are charged in", &c.Payment.Currency},
+		{"PAYMENT_TIMEOUT", "timeout of requests to the payment provider", &c.Payment.Timeout},
+		{"PENDING_ORDER_TTL", "how long an order may wait for its payment before it is cancelled, 0 to keep it", &c.Payment.PendingOrderTTL},
+		{"STRIPE_API_URL", "base URL of the Stripe API", &c.Payment.StripeAPIURL},
+		{"STRIPE_SECRET_KEY", "Stripe secret API key", &c.Payment.StripeSecretKey},
+
+		{"VAULT_MASTER_KEYS", "comma separated id=base64 master keys encrypting card numbers", &c.Vault.MasterKeys},
+		{"VAULT_CURRENT_KEY", "id of the master key new card numbers are encrypted with", &c.Vault.CurrentKey},
+
+		{"LOG_LEVEL", "log level: debug, info, warn or error", &c.Log.Level},
+		{"LOG_FORMAT", "log format: json or text", &c.Log.Format},
+
+		{"TRACING_EXPORTER", "where spans are exported to: none, otlp, stdout or file", &c.Tracing.Exporter},
+		{"TRACING_OTLP_ENDPOINT", "host:port of the OTLP/HTTP collector", &c.Tracing.Endpoint},
+		{"TRACING_OTLP_INSECURE", "whether spans are sent to the collector without TLS", &c.Tracing.Insecure},
+		{"TRACING_FILE", "file the file exporter appends spans to", &c.Tracing.File},
+		{"TRACING_SAMPLE_RATIO", "share of new traces that are recorded, from 0 to 1", &c.Tracing.SampleRatio},
+		{"TRACING_SERVICE_NAME", "service name of the exported spans", &c.Tracing.ServiceName},
+	}
+}
+
+// set parses value into the target of the setting. A value that does not parse leaves the target unchanged,
+// so that it is reported once and not again by the validation of the zero value.
+func (s setting) set(value string) error {
+	switch target := s.target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *float64:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *time.Duration:
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *[]string:
+		*target = splitList(value)
+	case *map[string]string:
+		v, err := parsePairs(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	default:
+		panic(fmt.Sprintf("config: unsupported setting type %T", s.target))
+	}
+	return nil
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the command-line
+// flags in args, in that order of precedence, and validates it.
+// It returns the arguments left over after the flags, which name the subcommand to run.
+// Every problem found is reported together in one *ValidationError.
+func Load(args []string) (*Config, []string, error) {
+	c := Default()
+	fs := flag.NewFlagSet("RestAPI", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+
+	var problems []string
+	flagValues := map[string]string{}
+	for _, s := range settings(c) {
+		s := s
+		fs.Func(s.flag(), s.usage, func(value string) error {
+			flagValues[s.env] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(c, *configFile); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, s := range settings(c) {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := s.set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid value %q", s.env, value))
+			}
+		}
+		if value, ok := flagValues[s.env]; ok {
+			if err := s.set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: invalid value %q", s.flag(), value))
+			}
+		}
+	}
+
+	problems = append(problems, c.problems()...)
+	if len(problems) > 0 {
+		return nil, nil, &ValidationError{Problems: problems}
+	}
+	return c, fs.Args(), nil
+}
+
+// loadFile overlays the settings present in the YAML file onto c. Unknown keys are rejected,
+// so that a misspelled setting does not silently fall back to its default.
+func loadFile(c *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ValidationError lists every problem found in the configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// problems checks the loaded values for consistency and returns a description of every problem found.
+func (c *Config) problems() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		problems = append(problems, fmt.Sprintf("server.listen_addr %q is not a host:port address", c.Server.ListenAddr))
+	}
+	if c.Server.AdminListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Server.AdminListenAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("server.admin_listen_addr %q is not a host:port address", c.Server.AdminListenAddr))
+		}
+		check(c.Server.AdminListenAddr != c.Server.ListenAddr, "server.admin_listen_addr must differ from server.listen_addr")
+	}
+	for name, d := range map[string]time.Duration{
+		"server.read_timeout":        c.Server.ReadTimeout,
+		"server.read_header_timeout": c.Server.ReadHeaderTimeout,
+		"server.write_timeout":       c.Server.WriteTimeout,
+		"server.idle_timeout":        c.Server.IdleTimeout,
+		"server.shutdown_timeout":    c.Server.ShutdownTimeout,
+		"jwt.access_token_ttl":       c.JWT.AccessTokenTTL,
+		"jwt.refresh_token_ttl":      c.JWT.RefreshTokenTTL,
+	} {
+		check(d > 0, "%s must be positive", name)
+	}
+	check(c.Server.MaxHeaderBytes > 0, "server.max_header_bytes must be positive")
+	check(c.Server.MaxBodyBytes > 0, "server.max_body_bytes must be positive")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay must not be negative")
+
+	check(c.Database.Host != "", "database.host is required")
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port %d is not a valid port", c.Database.Port)
+	check(c.Database.User != "", "database.user is required")
+	check(c.Database.Name != "", "database.name is required")
+	check(oneOf(c.Database.SSLMode, "disable", "allow", "prefer", "require", "verify-ca", "verify-full"),
+		"database.sslmode %q is not a valid postgres sslmode", c.Database.SSLMode)
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"database.max_idle_conns must not exceed database.max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+	check(c.Database.ConnMaxIdleTime >= 0, "database.conn_max_idle_time must not be negative")
+	check(c.Database.ConnectTimeout >= 0, "database.connect_timeout must not be negative")
+
+	check(oneOf(c.JWT.Algorithm, "HS256", "RS256", "ES256", "EdDSA"),
+		"jwt.algorithm %q must be one of HS256, RS256, ES256 or EdDSA", c.JWT.Algorithm)
+	check(c.JWT.SigningKey != "" || c.JWT.SigningKeyFile != "", "jwt.signing_key or jwt.signing_key_file is required")
+	check(c.JWT.SigningKey == "" || c.JWT.SigningKeyFile == "", "only one of jwt.signing_key and jwt.signing_key_file may be set")
+	check(c.JWT.RefreshTokenTTL > c.JWT.AccessTokenTTL, "jwt.refresh_token_ttl must be longer than jwt.access_token_ttl")
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			check(!c.CORS.AllowCredentials, "cors.allowed_origins must list explicit origins when cors.allow_credentials is set")
+			continue
+		}
+		u, err := url.Parse(origin)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "",
+			"cors.allowed_origins entry %q must look like https://example.com", origin)
+	}
+	check(c.CORS.MaxAge >= 0, "cors.max_age must not be negative")
+
+	check(oneOf(c.Payment.Provider, "fake", "stripe"), "payment.provider %q must be fake or stripe", c.Payment.Provider)
+	check(len(c.Payment.Currency) == 3, "payment.currency %q is not an ISO currency code", c.Payment.Currency)
+	check(c.Payment.Timeout > 0, "payment.timeout must be positive")
+	check(c.Payment.PendingOrderTTL >= 0, "payment.pending_order_ttl must not be negative")
+	if c.Payment.Provider == "stripe" {
+		u, err := url.Parse(c.Payment.StripeAPIURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"payment.stripe_api_url %q is not an http(s) URL", c.Payment.StripeAPIURL)
+		check(c.Payment.StripeSecretKey != "", "payment.stripe_secret_key is required for the stripe provider")
+	}
+
+	check(len(c.Vault.MasterKeys) > 0, "vault.master_keys is required")
+	for id, encoded := range c.Vault.MasterKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		check(err == nil && len(key) == 32, "vault.master_keys %q must be 32 base64 encoded bytes", id)
+	}
+	_, ok := c.Vault.MasterKeys[c.Vault.CurrentKey]
+	check(len(c.Vault.MasterKeys) == 0 || ok, "vault.current_key %q is not among vault.master_keys", c.Vault.CurrentKey)
+
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "log.level %q must be one of debug, info, warn or error", c.Log.Level)
+	check(oneOf(c.Log.Format, "json", "text"), "log.format %q must be json or text", c.Log.Format)
+
+	check(oneOf(c.Tracing.Exporter, "none", "otlp", "stdout", "file"),
+		"tracing.exporter %q must be one of none, otlp, stdout or file", c.Tracing.Exporter)
+	if c.Tracing.Exporter == "otlp" {
+		_, _, err := net.SplitHostPort(c.Tracing.Endpoint)
+		check(err == nil, "tracing.endpoint %q is not a host:port address", c.Tracing.Endpoint)
+	}
+	check(c.Tracing.Exporter != "file" || c.Tracing.File != "", "tracing.file is required with the file exporter")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	check(c.Tracing.ServiceName != "", "tracing.service_name is required")
+	return problems
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list and drops empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePairs parses a comma separated list of key=value pairs.
+func parsePairs(s string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, item := range splitList(s) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value pair", item)
+		}
+		pairs[strings.TrimSpace(key)] = strings.TrimSpace(value)
 	}
+	return pairs, nil
 }
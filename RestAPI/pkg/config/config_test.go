@@ -0,0 +1,209 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMasterKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// clearEnv hides every variable Load reads, so that the environment running the tests does not leak in.
+// Empty variables count as unset.
+func clearEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	for _, s := range settings(Default()) {
+		t.Setenv(s.env, "")
+	}
+}
+
+// setRequired sets the variables without a default, so that a configuration validates.
+func setRequired(t *testing.T) {
+	for env, value := range map[string]string{
+		"DB_HOST":           "db",
+		"DB_USER":           "api",
+		"DB_NAME":           "shop",
+		"JWT_SIGNING_KEY":   "0123456789abcdef0123456789abcdef",
+		"VAULT_MASTER_KEYS": "k1=" + testMasterKey,
+		"VAULT_CURRENT_KEY": "k1",
+	} {
+		t.Setenv(env, value)
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		file string
+		env  string
+		flag string
+		want string
+	}{
+		{"default", "", "", "", ":8080"},
+		{"file", ":1000", "", "", ":1000"},
+		{"env beats file", ":1000", ":2000", "", ":2000"},
+		{"flag beats env", ":1000", ":2000", ":3000", ":3000"},
+		{"flag beats file", ":1000", "", ":3000", ":3000"},
+		{"flag without file", "", ":2000", ":3000", ":3000"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clearEnv(t)
+			setRequired(t)
+			// The admin server must not listen on the same address as the API.
+			t.Setenv("ADMIN_LISTEN_ADDR", ":9999")
+			var args []string
+			if c.file != "" {
+				args = append(args, "-config", writeFile(t, "server:\n  listen_addr: \""+c.file+"\"\n"))
+			}
+			if c.env != "" {
+				t.Setenv("LISTEN_ADDR", c.env)
+			}
+			if c.flag != "" {
+				args = append(args, "-listen-addr", c.flag)
+			}
+			config, _, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Server.ListenAddr != c.want {
+				t.Errorf("listen address %q, want %q", config.Server.ListenAddr, c.want)
+			}
+		})
+	}
+}
+
+// TestConfigFileFromEnv reads the file named by CONFIG_FILE and leaves the settings it does not mention at their defaults.
+func TestConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "database:\n  port: 6432\n  max_idle_conns: 5\n"))
+	config, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Database.Port != 6432 || config.Database.MaxIdleConns != 5 || config.Database.MaxOpenConns != 25 {
+		t.Errorf("database config %+v", config.Database)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		env, value string
+		get        func(c *Config) interface{}
+		want       interface{}
+	}{
+		{"READ_TIMEOUT", "90s", func(c *Config) interface{} { return c.Server.ReadTimeout }, 90 * time.Second},
+		{"JWT_REFRESH_TOKEN_TTL", "1h30m", func(c *Config) interface{} { return c.JWT.RefreshTokenTTL }, 90 * time.Minute},
+		{"DRAIN_DELAY", "0", func(c *Config) interface{} { return c.Server.DrainDelay }, time.Duration(0)},
+		{"DB_PORT", "6432", func(c *Config) interface{} { return c.Database.Port }, 6432},
+		{"CORS_ALLOW_CREDENTIALS", "true", func(c *Config) interface{} { return c.CORS.AllowCredentials }, true},
+		{"TRACING_SAMPLE_RATIO", "0.25", func(c *Config) interface{} { return c.Tracing.SampleRatio }, 0.25},
+		{"CORS_ALLOWED_ORIGINS", "https://a.example.com, ,https://b.example.com,", func(c *Config) interface{} { return c.CORS.AllowedOrigins },
+			[]string{"https://a.example.com", "https://b.example.com"}},
+		{"CORS_ALLOWED_METHODS", " GET ", func(c *Config) interface{} { return c.CORS.AllowedMethods }, []string{"GET"}},
+		{"VAULT_MASTER_KEYS", "k1 = " + testMasterKey + ", k2=" + testMasterKey, func(c *Config) interface{} { return c.Vault.MasterKeys },
+			map[string]string{"k1": testMasterKey, "k2": testMasterKey}},
+	} {
+		t.Run(c.env, func(t *testing.T) {
+			clearEnv(t)
+			setRequired(t)
+			t.Setenv(c.env, c.value)
+			config, _, err := Load(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.get(config); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s=%q parsed as %#v, want %#v", c.env, c.value, got, c.want)
+			}
+		})
+	}
+}
+
+// TestValidationError sets invalid values in every layer and checks that all of them are reported at once.
+func TestValidationError(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	t.Setenv("DB_USER", "")
+	t.Setenv("DB_PORT", "postgres")
+	t.Setenv("READ_TIMEOUT", "soon")
+	t.Setenv("VAULT_MASTER_KEYS", "k1")
+	t.Setenv("JWT_ALGORITHM", "none")
+	file := writeFile(t, "log:\n  format: xml\n")
+	_, _, err := Load([]string{"-config", file, "-log-level", "loud", "-write-timeout", "-1s"})
+
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want a *ValidationError", err)
+	}
+	want := []string{
+		`DB_PORT: invalid value "postgres"`,
+		`READ_TIMEOUT: invalid value "soon"`,
+		`VAULT_MASTER_KEYS: invalid value "k1"`,
+		"database.user is required",
+		`jwt.algorithm "none" must be one of`,
+		"server.write_timeout must be positive",
+		`log.level "loud" must be one of`,
+		`log.format "xml" must be json or text`,
+		"vault.master_keys is required",
+	}
+	for _, w := range want {
+		found := false
+		for _, p := range invalid.Problems {
+			found = found || strings.Contains(p, w)
+		}
+		if !found {
+			t.Errorf("no problem mentions %q in %q", w, invalid.Problems)
+		}
+	}
+	if len(invalid.Problems) != len(want) {
+		t.Errorf("reported %d problems, want %d: %q", len(invalid.Problems), len(want), invalid.Problems)
+	}
+	if !strings.HasPrefix(err.Error(), "invalid configuration:\n  - ") {
+		t.Errorf("error reads %q", err)
+	}
+}
+
+func TestUnknownFileKey(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	_, _, err := Load([]string{"-config", writeFile(t, "server:\n  listen_adr: \":1000\"\n")})
+	if err == nil || !strings.Contains(err.Error(), "listen_adr") {
+		t.Errorf("misspelled key: %v", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	_, args, err := Load([]string{"-log-format", "text", "migrate", "down", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"migrate", "down", "1"}) {
+		t.Errorf("left over %q, want the subcommand", args)
+	}
+	if _, _, err := Load([]string{"-no-such-flag"}); err == nil {
+		t.Error("an unknown flag was accepted")
+	}
+	// -h prints the flags to stderr, which is of no interest here.
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	if _, _, err := Load([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("-h: %v, want flag.ErrHelp", err)
+	}
+}
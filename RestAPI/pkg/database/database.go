@@ -2,32 +2,196 @@ package database
 
 import (
 	"RestAPI/pkg/config"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq" // Importing the postgres driver
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var db *sql.DB
-
-func InitDb(config *config.Config) {
-	var err error
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
-		"password=%s dbname=%s sslmode=disable", config.DbHost, config.DbPort, config.DbUser, config.DbPassword, config.DbName)
-	fmt.Print(config.DbName)
+// Backoff between the attempts to reach the database at startup.
+const (
+	// firstRetryDelay is the wait after the first failed attempt, it doubles after every further one up to maxRetryDelay.
+	firstRetryDelay = 500 * time.Millisecond
+	maxRetryDelay   = 10 * time.Second
+	// pingTimeout bounds every attempt.
+	pingTimeout = 5 * time.Second
+)
 
-	db, err = sql.Open("postgres", psqlInfo)
+// InitDb opens the postgres connection pool described by config, sizes it and pings it, logging where it connected to.
+// A database that is not reachable yet, such as the docker-compose container still starting, is pinged again with
+// exponential backoff for up to config.Database.ConnectTimeout.
+// Every query made through the pool within a trace runs in a child span carrying the sanitized statement.
+// The caller owns the returned pool and is responsible for closing it.
+func InitDb(config *config.Config, logger *slog.Logger) (*sql.DB, error) {
+	c := config.Database
+	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
+		"password=%s dbname=%s sslmode=%s", c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
 
+	db, err := otelsql.Open("postgres", psqlInfo,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBName(c.Name)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			// The statement is added by statementAttributes, sanitized.
+			DisableQuery:         true,
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			// Queries outside of a trace, such as the migrations at startup, would each start a trace of their own.
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+		otelsql.WithAttributesGetter(statementAttributes),
+	)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
 
-	if err = db.Ping(); err != nil {
-		fmt.Println(err)
+	if err := retry(logger, c.ConnectTimeout, firstRetryDelay, ping(db)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database: connect to %s:%d/%s: %w", c.Host, c.Port, c.Name, err)
+	}
+	logger.Info("connected to database", "host", c.Host, "port", c.Port, "database", c.Name)
+	return db, nil
+}
+
+// ping returns an attempt to reach the database, which gives up after pingTimeout.
+func ping(db *sql.DB) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		return db.PingContext(ctx)
+	}
+}
 
+// retry calls attempt until it succeeds or the next attempt would start more than timeout after the first one,
+// and returns the error of the last attempt. It waits delay after the first failure and twice as long after every
+// further one, but never longer than maxRetryDelay.
+func retry(logger *slog.Logger, timeout, delay time.Duration, attempt func() error) error {
+	deadline := time.Now().Add(timeout)
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		logger.Warn("database not reachable, retrying", "attempt", n, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
 	}
 }
 
-func GetDb() *sql.DB {
-	return db
+// statementAttributes records the query of a span as db.statement, with its literals replaced by sanitize.
+func statementAttributes(_ context.Context, _ otelsql.Method, query string, _ []driver.NamedValue) []attribute.KeyValue {
+	if query == "" {
+		return nil
+	}
+	return []attribute.KeyValue{semconv.DBStatement(sanitize(query))}
+}
+
+var (
+	numericLiteral = regexp.MustCompile(`(^|[^\w$.])\d+(?:\.\d+)?`)
+	whitespace     = regexp.MustCompile(`\s+`)
+)
+
+// sanitize replaces the string and number literals of the query with "?" and collapses its whitespace,
+// so that values written into a query never end up in the exported spans. Placeholders such as $1 are kept,
+// the arguments bound to them are not recorded at all.
+func sanitize(query string) string {
+	query = replaceStrings(query)
+	query = numericLiteral.ReplaceAllString(query, "${1}?")
+	return strings.TrimSpace(whitespace.ReplaceAllString(query, " "))
+}
+
+// replaceStrings replaces every string literal of the query with "?": 'standard' strings, E'escape' strings,
+// in which a backslash escapes the next character, and $$dollar$$ or $tag$dollar$tag$ quoted strings.
+// Quoted identifiers are kept as they are. A literal that is not terminated is replaced up to the end of the query.
+// Dollar quotes end with the tag they started with, which no regular expression of the regexp package can match,
+// so the query is scanned once from left to right.
+func replaceStrings(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'':
+			b.WriteByte('?')
+			i = stringEnd(query, i+1, false)
+		case (c == 'E' || c == 'e') && i+1 < len(query) && query[i+1] == '\'' && !inWord(query, i):
+			b.WriteByte('?')
+			i = stringEnd(query, i+2, true)
+		case c == '"':
+			end := i + 2 + strings.IndexByte(query[i+1:], '"')
+			if end == i+1 {
+				end = len(query)
+			}
+			b.WriteString(query[i:end])
+			i = end
+		case c == '$' && !inWord(query, i) && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			b.WriteByte('?')
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				return b.String()
+			}
+			i += len(tag) + end + len(tag)
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// stringEnd returns the index just past the quote closing the string literal whose content starts at i,
+// or the length of the query when it is not closed. A quote is escaped by doubling it, and in escape strings
+// also by a backslash.
+func stringEnd(query string, i int, backslashEscapes bool) int {
+	for i < len(query) {
+		switch {
+		case backslashEscapes && query[i] == '\\':
+			i += 2
+		case query[i] != '\'':
+			i++
+		case i+1 < len(query) && query[i+1] == '\'':
+			i += 2
+		default:
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the $tag$ or $$ opening the dollar quoted string at the start of s, or "" when s starts with
+// something else, such as the placeholder $1.
+func dollarTag(s string) string {
+	j := 1
+	for j < len(s) && (s[j] == '_' || 'a' <= s[j] && s[j] <= 'z' || 'A' <= s[j] && s[j] <= 'Z' || j > 1 && '0' <= s[j] && s[j] <= '9') {
+		j++
+	}
+	if j < len(s) && s[j] == '$' {
+		return s[:j+1]
+	}
+	return ""
+}
+
+// inWord reports whether the character at i continues an identifier, like the e of "name" or the $ of "a$b".
+func inWord(query string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	c := query[i-1]
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
 }
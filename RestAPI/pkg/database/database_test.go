@@ -0,0 +1,65 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, c := range []struct{ query, want string }{
+		{"SELECT id FROM products WHERE id = $1", "SELECT id FROM products WHERE id = $1"},
+		{"SELECT *\n\t\tFROM users\n\t\tWHERE username = 'jane' AND password = 'it''s secret'", "SELECT * FROM users WHERE username = ? AND password = ?"},
+		{"UPDATE products SET quantity = quantity - 3, price = 12.50 WHERE id = 42", "UPDATE products SET quantity = quantity - ?, price = ? WHERE id = ?"},
+		{"SELECT t1.id FROM orders t1 LIMIT 10", "SELECT t1.id FROM orders t1 LIMIT ?"},
+		{"INSERT INTO cart_items VALUES ($1, $2, 1)", "INSERT INTO cart_items VALUES ($1, $2, ?)"},
+		{`SELECT 1 FROM users WHERE password = E'it\'s secret' AND name = e'a\\' OR token = 'x'`, "SELECT ? FROM users WHERE password = ? AND name = ? OR token = ?"},
+		{"SELECT id FROM users WHERE name='jane' AND type'x' = date'2024-01-01'", "SELECT id FROM users WHERE name=? AND type? = date?"},
+		{"UPDATE users SET password = $$it's secret$$, note = $note$a $$ b$note$ WHERE id = $1", "UPDATE users SET password = ?, note = ? WHERE id = $1"},
+		{"SELECT $a1$secret$a$still secret$a1$, $2", "SELECT ?, $2"},
+		{`SELECT "it's"."e'x" FROM "a$$b" WHERE x = 'y'`, `SELECT "it's"."e'x" FROM "a$$b" WHERE x = ?`},
+		{"SELECT id FROM users WHERE password = 'unterminated secret", "SELECT id FROM users WHERE password = ?"},
+		{"SELECT id FROM users WHERE password = $$unterminated secret", "SELECT id FROM users WHERE password = ?"},
+	} {
+		if got := sanitize(c.query); got != c.want {
+			t.Errorf("sanitize(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	down := errors.New("connection refused")
+
+	attempts := 0
+	err := retry(logger, time.Second, time.Millisecond, func() error {
+		if attempts++; attempts < 4 {
+			return down
+		}
+		return nil
+	})
+	if err != nil || attempts != 4 {
+		t.Errorf("got %v after %d attempts, want success after 4", err, attempts)
+	}
+
+	attempts = 0
+	start := time.Now()
+	err = retry(logger, 50*time.Millisecond, 10*time.Millisecond, func() error {
+		attempts++
+		return down
+	})
+	// Waiting 10ms, 20ms and then 40ms would end after the deadline, so the third attempt is the last.
+	if !errors.Is(err, down) || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want the error after 3", err, attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retried for %s", elapsed)
+	}
+
+	attempts = 0
+	if err := retry(logger, 0, time.Millisecond, func() error { attempts++; return down }); !errors.Is(err, down) || attempts != 1 {
+		t.Errorf("got %v after %d attempts without a timeout, want the error after 1", err, attempts)
+	}
+}
@@ -0,0 +1,21 @@
+// Package logging builds the structured logger the server and its subcommands log through.
+package logging
+
+import (
+	"RestAPI/pkg/config"
+	"io"
+	"log/slog"
+)
+
+// New returns a logger writing to w in the format and from the level config.Log asks for: one JSON object
+// per line, or logfmt style key=value pairs for the text format.
+func New(config *config.Config, w io.Writer) *slog.Logger {
+	var level slog.Level
+	// The level was validated by config.Load, an unknown one would leave it at info.
+	level.UnmarshalText([]byte(config.Log.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if config.Log.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"RestAPI/pkg/config"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cfg := config.Default()
+	cfg.Log.Level = "warn"
+	var out strings.Builder
+	logger := New(cfg, &out)
+	logger.Info("dropped")
+	logger.Warn("kept", "user_id", 7)
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &line); err != nil {
+		t.Fatalf("%v in %q", err, out.String())
+	}
+	if line["msg"] != "kept" || line["level"] != "WARN" || line["user_id"] != 7.0 {
+		t.Errorf("logged %v", line)
+	}
+
+	cfg.Log.Format, cfg.Log.Level = "text", "debug"
+	out.Reset()
+	New(cfg, &out).Debug("request", "status", 200)
+	if !strings.Contains(out.String(), "level=DEBUG msg=request status=200") {
+		t.Errorf("logged %q", out.String())
+	}
+}
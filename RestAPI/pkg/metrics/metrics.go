@@ -0,0 +1,140 @@
+// Package metrics collects the Prometheus metrics of the API: requests, the database pool,
+// business events and the Go runtime, served in the Prometheus text format by Handler.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes the name of every metric.
+const namespace = "restapi"
+
+// Metrics holds the collectors of one server. Every Metrics has a registry of its own,
+// so servers created in tests do not share their counts.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	signups         prometheus.Counter
+	logins          *prometheus.CounterVec
+	purchases       prometheus.Counter
+	outOfStock      prometheus.Counter
+	cardsAdded      prometheus.Counter
+}
+
+// New returns Metrics with the Go runtime and process collectors already registered.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests answered, by method, route pattern and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to answer HTTP requests, by method, route pattern and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		signups: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signups_total",
+			Help:      "Users who signed up.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts, by result: succeeded or failed.",
+		}, []string{"result"}),
+		purchases: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_total",
+			Help:      "Orders paid.",
+		}),
+		outOfStock: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "out_of_stock_rejections_total",
+			Help:      "Orders rejected because a product did not have enough units in stock.",
+		}),
+		cardsAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cards_added_total",
+			Help:      "Credit cards saved by users.",
+		}),
+	}
+	// Both results are exported from the start, so that a rate of failed logins exists before the first one.
+	m.logins.WithLabelValues("succeeded")
+	m.logins.WithLabelValues("failed")
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration,
+		m.signups, m.logins, m.purchases, m.outOfStock, m.cardsAdded,
+	)
+	return m
+}
+
+// RegisterDB exports the statistics of the connection pool, db.Stats(), labelled with the database name.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) error {
+	return m.registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Handler serves every registered metric.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveRequest counts a request answered with the status after the duration. The route is the pattern
+// that served the request rather than its path, which keeps the number of label values bounded.
+func (m *Metrics) ObserveRequest(method, route string, status int, duration time.Duration) {
+	labels := prometheus.Labels{"method": knownMethod(method), "route": route, "status": strconv.Itoa(status)}
+	m.requests.With(labels).Inc()
+	m.requestDuration.With(labels).Observe(duration.Seconds())
+}
+
+// Signup counts a user who signed up.
+func (m *Metrics) Signup() {
+	m.signups.Inc()
+}
+
+// Login counts a login attempt that succeeded or failed.
+func (m *Metrics) Login(succeeded bool) {
+	if succeeded {
+		m.logins.WithLabelValues("succeeded").Inc()
+	} else {
+		m.logins.WithLabelValues("failed").Inc()
+	}
+}
+
+// Purchase counts a paid order.
+func (m *Metrics) Purchase() {
+	m.purchases.Inc()
+}
+
+// OutOfStock counts an order rejected for lack of stock.
+func (m *Metrics) OutOfStock() {
+	m.outOfStock.Inc()
+}
+
+// CardAdded counts a saved credit card.
+func (m *Metrics) CardAdded() {
+	m.cardsAdded.Inc()
+}
+
+// knownMethod returns the method, or "other" for methods clients made up.
+func knownMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unreachable is a connector to a database that is never there.
+type unreachable struct{}
+
+func (unreachable) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("unreachable")
+}
+
+func (unreachable) Driver() driver.Driver { return nil }
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.ObserveRequest("GET", "/orders/", 200, 30*time.Millisecond)
+	m.ObserveRequest("GET", "/orders/", 200, 2*time.Second)
+	m.ObserveRequest("BREW", "/", 404, time.Millisecond)
+	m.Signup()
+	m.Login(true)
+	m.Login(false)
+	m.Login(false)
+	m.Purchase()
+	m.OutOfStock()
+	m.CardAdded()
+	// The pool never connects, its statistics are all zero.
+	db := sql.OpenDB(unreachable{})
+	defer db.Close()
+	if err := m.RegisterDB(db, "apis"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`restapi_http_requests_total{method="GET",route="/orders/",status="200"} 2`,
+		`restapi_http_requests_total{method="other",route="/",status="404"} 1`,
+		`restapi_http_request_duration_seconds_bucket{method="GET",route="/orders/",status="200",le="0.05"} 1`,
+		`restapi_http_request_duration_seconds_count{method="GET",route="/orders/",status="200"} 2`,
+		`restapi_signups_total 1`,
+		`restapi_logins_total{result="succeeded"} 1`,
+		`restapi_logins_total{result="failed"} 2`,
+		`restapi_purchases_total 1`,
+		`restapi_out_of_stock_rejections_total 1`,
+		`restapi_cards_added_total 1`,
+		`go_sql_open_connections{db_name="apis"} 0`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %s in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func files(names ...string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for _, name := range names {
+		fsys["migrations/"+name] = &fstest.MapFile{Data: []byte("-- " + name)}
+	}
+	return fsys
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(files(
+		"0010_tenth.up.sql", "0010_tenth.down.sql",
+		"0002_second.down.sql", "0002_second.up.sql",
+		"0001_init.up.sql", "0001_init.down.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range migrations {
+		got = append(got, fmt.Sprintf("%d %s", m.Version, m.Name))
+	}
+	if want := []string{"1 init", "2 second", "10 tenth"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+	first := migrations[0]
+	sum := sha256.Sum256([]byte("-- 0001_init.up.sql"))
+	if first.Up != "-- 0001_init.up.sql" || first.Down != "-- 0001_init.down.sql" || first.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("loaded %+v", first)
+	}
+
+	for _, c := range []struct {
+		name  string
+		fsys  fstest.MapFS
+		error string
+	}{
+		{"unexpected name", files("0001_init.up.sql", "0001_init.down.sql", "0002 second.up.sql"), "unexpected file name"},
+		{"no version", files("init.up.sql", "init.down.sql"), "unexpected file name"},
+		{"no down script", files("0001_init.up.sql", "0002_second.up.sql", "0001_init.down.sql"), "needs both an up and a down script"},
+		{"no up script", files("0001_init.down.sql"), "needs both an up and a down script"},
+		{"version used twice", files("0001_init.up.sql", "0001_other.down.sql"), "is used by both"},
+		{"no directory", fstest.MapFS{}, ""},
+	} {
+		_, err := Load(c.fsys)
+		if err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("%s: %v, want an error containing %q", c.name, err, c.error)
+		}
+	}
+}
+
+// TestEmbedded checks the migrations shipped with the binary: they load, and versions have no gaps.
+func TestEmbedded(t *testing.T) {
+	migrations, err := Load(embedded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %04d_%s is number %d", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+func testMigrations(t *testing.T, versions int) []Migration {
+	t.Helper()
+	fsys := fstest.MapFS{}
+	for v := 1; v <= versions; v++ {
+		fsys[fmt.Sprintf("migrations/%04d_v%d.up.sql", v, v)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("up %d", v))}
+		fsys[fmt.Sprintf("migrations/%04d_v%d.down.sql", v, v)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("down %d", v))}
+	}
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	m := &Migrator{db: sql.OpenDB(db), migrations: testMigrations(t, 3)}
+	defer m.db.Close()
+
+	if version, err := m.Version(ctx); err != nil || version != 0 {
+		t.Errorf("Version of an empty database: %d, %v", version, err)
+	}
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 3 || !reflect.DeepEqual(db.scripts(), []string{"up 1", "up 2", "up 3"}) {
+		t.Errorf("applied %d migrations running %v", len(applied), db.scripts())
+	}
+	if version, err := m.Version(ctx); err != nil || version != m.Latest() {
+		t.Errorf("Version after Up: %d, %v, want %d", version, err, m.Latest())
+	}
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("a second Up applied %d migrations, %v", len(applied), err)
+	}
+
+	reverted, err := m.Down(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 2 || reverted[0].Version != 3 || reverted[1].Version != 2 {
+		t.Errorf("reverted %+v, want versions 3 and 2", reverted)
+	}
+	if scripts := db.scripts(); !reflect.DeepEqual(scripts[3:], []string{"down 3", "down 2"}) {
+		t.Errorf("ran %v", scripts)
+	}
+	if version, err := m.Version(ctx); err != nil || version != 1 {
+		t.Errorf("Version after Down: %d, %v, want 1", version, err)
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil || statuses[2].AppliedAt != nil {
+		t.Errorf("Status is %+v, want only version 1 applied", statuses)
+	}
+	if db.locked() {
+		t.Error("the advisory lock is still held")
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := newFakeDB()
+	migrations := testMigrations(t, 3)
+	migrations[1].Up = "FAIL"
+	m := &Migrator{db: sql.OpenDB(db), migrations: migrations}
+	defer m.db.Close()
+
+	applied, err := m.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "apply 0002_v2") {
+		t.Errorf("Up: %v, want the failure of version 2", err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("applied %d migrations, want the one before the failure", len(applied))
+	}
+	if version, err := m.Version(context.Background()); err != nil || version != 1 {
+		t.Errorf("Version after the failure: %d, %v, want 1", version, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	m := &Migrator{db: sql.OpenDB(db), migrations: testMigrations(t, 2)}
+	defer m.db.Close()
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := testMigrations(t, 2)
+	edited[0].Up += "\n-- edited"
+	edited[0].Checksum = "edited"
+	m.migrations = edited
+	for name, run := range map[string]func() error{
+		"Up":     func() error { _, err := m.Up(ctx); return err },
+		"Down":   func() error { _, err := m.Down(ctx, 1); return err },
+		"Status": func() error { _, err := m.Status(ctx); return err },
+	} {
+		if err := run(); err == nil || !strings.Contains(err.Error(), "checksum mismatch for 0001_v1") {
+			t.Errorf("%s after editing an applied migration: %v, want a checksum mismatch", name, err)
+		}
+	}
+
+	// A database migrated by a newer build has versions this one does not know.
+	m.migrations = testMigrations(t, 1)
+	if _, err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "version 2 applied which this build does not know") {
+		t.Errorf("Up with an unknown applied version: %v", err)
+	}
+	if got := db.scripts(); len(got) != 2 {
+		t.Errorf("ran %v, want nothing after the first Up", got)
+	}
+}
+
+// TestPostgres runs every embedded migration up and down again against the database in TEST_DATABASE_URL,
+// in a schema of its own so that the tables the other tests use stay as they are.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := m.Version(ctx); err != nil || version != m.Latest() {
+		t.Fatalf("Version after Up: %d, %v, want %d", version, err, m.Latest())
+	}
+	// Every down script has to undo its up script, so that the migrations apply again afterwards.
+	if reverted, err := m.Down(ctx, m.Latest()); err != nil || len(reverted) != m.Latest() {
+		t.Fatalf("reverted %d migrations, %v", len(reverted), err)
+	}
+	if version, err := m.Version(ctx); err != nil || version != 0 {
+		t.Errorf("Version after reverting everything: %d, %v", version, err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("%04d_%s is not applied", s.Version, s.Name)
+		}
+	}
+}
+
+// withSearchPath returns the connection string dsn with the schema as search path, in URL or key=value form.
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// fakeDB is a database/sql connector that understands the queries the Migrator makes to keep track of the
+// applied migrations. Every other statement is a migration script and is recorded, a script "FAIL" fails.
+type fakeDB struct {
+	mu      sync.Mutex
+	table   bool
+	lock    bool
+	applied map[int64]fakeRow
+	ran     []string
+}
+
+type fakeRow struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{applied: map[int64]fakeRow{}}
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+// scripts returns the migration scripts run so far.
+func (db *fakeDB) scripts() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string{}, db.ran...)
+}
+
+func (db *fakeDB) locked() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.lock
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: prepared statements are not supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	db := c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	query = strings.TrimSpace(query)
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		db.table = true
+	case strings.HasPrefix(query, "SELECT pg_advisory_lock"):
+		db.lock = true
+	case strings.HasPrefix(query, "SELECT pg_advisory_unlock"):
+		db.lock = false
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		db.applied[args[0].Value.(int64)] = fakeRow{checksum: args[2].Value.(string), appliedAt: time.Now()}
+	case strings.HasPrefix(query, "DELETE FROM schema_migrations"):
+		delete(db.applied, args[0].Value.(int64))
+	case query == "FAIL":
+		return nil, errors.New("syntax error")
+	default:
+		db.ran = append(db.ran, query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	db := c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch query {
+	case "SELECT to_regclass('schema_migrations') IS NOT NULL":
+		return &fakeRows{columns: []string{"exists"}, rows: [][]driver.Value{{db.table}}}, nil
+	case "SELECT COALESCE(MAX(version), 0) FROM schema_migrations":
+		var max int64
+		for version := range db.applied {
+			if version > max {
+				max = version
+			}
+		}
+		return &fakeRows{columns: []string{"version"}, rows: [][]driver.Value{{max}}}, nil
+	case "SELECT version, checksum, applied_at FROM schema_migrations":
+		rows := &fakeRows{columns: []string{"version", "checksum", "applied_at"}}
+		for version, row := range db.applied {
+			rows.rows = append(rows.rows, []driver.Value{version, row.checksum, row.appliedAt})
+		}
+		sort.Slice(rows.rows, func(i, j int) bool { return rows.rows[i][0].(int64) < rows.rows[j][0].(int64) })
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fakeDB: unexpected query %q", query)
+}
+
+// fakeTx commits nothing of its own: statements take effect when they run, and a failed script is never recorded.
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -1,18 +1,22 @@
-CREATE TABLE products (
+CREATE TABLE IF NOT EXISTS products (
     id SERIAL PRIMARY KEY, 
     name VARCHAR(255),
     description TEXT, 
-    price NUMERIC(10,2)
+    price NUMERIC(10,2),
+    quantity INTEGER NOT NULL DEFAULT 0
 );
 
-CREATE TABLE users (
+-- Databases created from the old init.sql never got the quantity column.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS quantity INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY, 
     username TEXT NOT NULL, 
     email TEXT NOT NULL, 
     password TEXT NOT NULL
 );
 
-CREATE TABLE credit_cards (	
+CREATE TABLE IF NOT EXISTS credit_cards (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id), 
     card_number CHARACTER VARYING(16) NOT NULL,
@@ -28,6 +32,7 @@ CREATE TABLE credit_cards (
 -- name: a text column that stores the name
 -- Description: a text column that stores the product description
 -- price: a column that stores the price
+-- quantity: an integer column that stores how many units are left in stock
 
 -- USERS TABLE
 -- id: a serial primary key column that will automatically generate unique integer values for each row
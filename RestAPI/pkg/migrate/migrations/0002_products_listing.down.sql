@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS products_name_pattern_idx;
+DROP INDEX IF EXISTS products_price_id_idx;
+DROP INDEX IF EXISTS products_name_id_idx;
+
+ALTER TABLE products
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN name DROP DEFAULT,
+    ALTER COLUMN description DROP NOT NULL,
+    ALTER COLUMN description DROP DEFAULT,
+    ALTER COLUMN price DROP NOT NULL,
+    ALTER COLUMN price DROP DEFAULT;
@@ -0,0 +1,17 @@
+-- Keyset pagination compares (name, id) and (price, id) rows, which does not work with NULLs.
+UPDATE products SET name = '' WHERE name IS NULL;
+UPDATE products SET description = '' WHERE description IS NULL;
+UPDATE products SET price = 0 WHERE price IS NULL;
+ALTER TABLE products
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN name SET DEFAULT '',
+    ALTER COLUMN description SET NOT NULL,
+    ALTER COLUMN description SET DEFAULT '',
+    ALTER COLUMN price SET NOT NULL,
+    ALTER COLUMN price SET DEFAULT 0;
+
+-- products_name_id_idx and products_price_id_idx serve both the ORDER BY and the keyset seek of GET /products.
+-- products_name_pattern_idx serves the name_prefix filter (LIKE 'prefix%') independently of the collation.
+CREATE INDEX IF NOT EXISTS products_name_id_idx ON products (name, id);
+CREATE INDEX IF NOT EXISTS products_price_id_idx ON products (price, id);
+CREATE INDEX IF NOT EXISTS products_name_pattern_idx ON products (name text_pattern_ops);
@@ -0,0 +1,4 @@
+-- created_by / updated_by record which authenticated user created and last changed a product.
+ALTER TABLE products
+    ADD COLUMN created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
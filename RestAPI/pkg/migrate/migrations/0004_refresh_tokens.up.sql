@@ -0,0 +1,23 @@
+-- REFRESH TOKENS TABLE
+-- Only the SHA-256 hash of a refresh token is stored. Every token issued by rotating another one
+-- shares its family_id, so the whole chain can be revoked when a used token is replayed.
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+-- REVOKED TOKENS TABLE
+-- The jti of access tokens revoked before their expiry, checked on every authenticated request.
+-- A row can be deleted once expires_at has passed because the token is rejected as expired by then.
+CREATE TABLE revoked_tokens (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_roles_check,
+    DROP COLUMN IF EXISTS roles;
@@ -0,0 +1,4 @@
+-- roles: the roles granted to the user, see the Role constants in pkg/models.
+ALTER TABLE users
+    ADD COLUMN roles TEXT[] NOT NULL DEFAULT '{customer}',
+    ADD CONSTRAINT users_roles_check CHECK (roles <@ ARRAY['customer', 'staff', 'admin']::TEXT[]);
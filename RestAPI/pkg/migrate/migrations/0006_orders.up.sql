@@ -0,0 +1,30 @@
+-- ORDERS TABLE
+-- id: a serial primary key column
+-- user_id: the user who placed the order
+-- status: where the order is in its lifecycle, every order starts out as placed
+-- total: the sum of unit_price * quantity over the items of the order
+-- created_at: when the order was placed
+CREATE TABLE orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    status TEXT NOT NULL DEFAULT 'placed',
+    total NUMERIC(12,2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX orders_user_id_id_idx ON orders (user_id, id);
+
+-- ORDER ITEMS TABLE
+-- The name and unit_price of the product are copied into the item when the order is placed,
+-- so that changing or deleting the product later does not rewrite the order history.
+-- product_id is set to NULL when the product is deleted.
+CREATE TABLE order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    product_id INTEGER REFERENCES products(id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    unit_price NUMERIC(10,2) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0)
+);
+
+CREATE INDEX order_items_order_id_idx ON order_items (order_id);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS order_events;
+
+ALTER TABLE orders
+    DROP CONSTRAINT IF EXISTS orders_status_check,
+    ALTER COLUMN status SET DEFAULT 'placed';
@@ -0,0 +1,26 @@
+-- status: one of the order statuses in pkg/models, orders start out as pending_payment.
+-- Orders placed before the lifecycle existed were never paid for.
+UPDATE orders SET status = 'pending_payment' WHERE status = 'placed';
+
+ALTER TABLE orders
+    ALTER COLUMN status SET DEFAULT 'pending_payment',
+    ADD CONSTRAINT orders_status_check CHECK (status IN (
+        'pending_payment', 'paid', 'fulfilled', 'shipped', 'delivered', 'cancelled', 'refunded'
+    ));
+
+-- ORDER EVENTS TABLE
+-- One row for every status an order went through, starting with the one it was placed in.
+-- from_status: the previous status, NULL for the event recording the placement of the order
+-- to_status: the new status
+-- actor_id: the user who made the change, NULL once that user was deleted
+-- created_at: when the change happened
+CREATE TABLE order_events (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status TEXT,
+    to_status TEXT NOT NULL,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_events_order_id_idx ON order_events (order_id);
@@ -0,0 +1,22 @@
+-- CARTS TABLE
+-- A cart belongs either to a user or, for visitors who are not logged in, to the random token in their
+-- "cart" cookie, of which only the SHA-256 hash is stored. Anonymous carts are merged into the cart of
+-- the user on login; the ones that are never claimed are deleted once updated_at is 30 days old.
+CREATE TABLE carts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((user_id IS NULL) <> (token_hash IS NULL))
+);
+
+-- CART ITEMS TABLE
+-- Only the product and quantity are stored, name, price and availability are always read from the
+-- products table. Removing a product from the catalog removes it from every cart.
+CREATE TABLE cart_items (
+    cart_id INTEGER NOT NULL REFERENCES carts(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (cart_id, product_id)
+);
@@ -0,0 +1,3 @@
+-- payment_id: the ID of the payment at the payment provider, set once the order was paid for
+-- and used to refund it when it is cancelled or refunded.
+ALTER TABLE orders ADD COLUMN payment_id TEXT;
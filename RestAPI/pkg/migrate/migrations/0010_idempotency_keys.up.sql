@@ -0,0 +1,17 @@
+-- IDEMPOTENCY KEYS TABLE
+-- The response to every mutating request a user sent with an Idempotency-Key header, replayed when the
+-- request is retried with the same key. status_code stays NULL while the first request is still being
+-- processed. request_hash is the SHA-256 of method, path and body, a key reused for another request is rejected.
+CREATE TABLE idempotency_keys (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER,
+    header JSONB,
+    body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
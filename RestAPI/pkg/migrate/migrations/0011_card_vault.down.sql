@@ -0,0 +1,16 @@
+-- The encrypted numbers can not be decrypted by a migration, the vaulted cards are deleted.
+DELETE FROM credit_cards;
+
+DROP INDEX IF EXISTS credit_cards_key_id_idx;
+DROP INDEX IF EXISTS credit_cards_user_id_idx;
+
+ALTER TABLE credit_cards
+    DROP COLUMN token,
+    DROP COLUMN brand,
+    DROP COLUMN last4,
+    DROP COLUMN key_id,
+    DROP COLUMN wrapped_key,
+    DROP COLUMN number_ciphertext,
+    DROP COLUMN created_at,
+    ADD COLUMN card_number CHARACTER VARYING(16) NOT NULL,
+    ADD COLUMN cvv CHARACTER VARYING(3) NOT NULL;
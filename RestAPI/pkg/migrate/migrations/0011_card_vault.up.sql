@@ -0,0 +1,24 @@
+-- CARD VAULT
+-- Card numbers and CVVs used to be stored in plain text. The CVV must never be stored at all, and only the
+-- server holding the vault master keys can encrypt a card number, which a migration can not do. The plain text
+-- cards are therefore deleted and have to be added again; nothing else referenced them.
+--
+-- token: the opaque handle clients use for the card, brand and last4: what is shown to recognize it
+-- key_id: the master key that wraps the data key of the number, see pkg/vault
+-- wrapped_key: the data key of the number, encrypted by the master key
+-- number_ciphertext: the card number, encrypted by the data key
+DELETE FROM credit_cards;
+
+ALTER TABLE credit_cards
+    DROP COLUMN card_number,
+    DROP COLUMN cvv,
+    ADD COLUMN token TEXT NOT NULL UNIQUE,
+    ADD COLUMN brand TEXT NOT NULL,
+    ADD COLUMN last4 CHARACTER VARYING(4) NOT NULL,
+    ADD COLUMN key_id TEXT NOT NULL,
+    ADD COLUMN wrapped_key BYTEA NOT NULL,
+    ADD COLUMN number_ciphertext BYTEA NOT NULL,
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX credit_cards_user_id_idx ON credit_cards (user_id);
+CREATE INDEX credit_cards_key_id_idx ON credit_cards (key_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS credit_cards_default_idx;
+
+ALTER TABLE credit_cards DROP COLUMN IF EXISTS is_default;
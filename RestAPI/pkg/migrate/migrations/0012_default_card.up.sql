@@ -0,0 +1,9 @@
+-- DEFAULT CARD
+-- is_default marks the card charged when a user pays without naming a card. The partial unique index allows
+-- one default card per user. The newest card of every user who already saved cards becomes the default.
+ALTER TABLE credit_cards ADD COLUMN is_default BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE credit_cards SET is_default = true
+WHERE id IN (SELECT DISTINCT ON (user_id) id FROM credit_cards ORDER BY user_id, id DESC);
+
+CREATE UNIQUE INDEX credit_cards_default_idx ON credit_cards (user_id) WHERE is_default;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS orders_refund_pending_idx;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS refund_pending;
@@ -0,0 +1,5 @@
+-- refund_pending: the order was cancelled or refunded after it was paid for, and the payment was not paid back yet.
+-- It is set together with the status, so that a refund that failed is retried instead of forgotten.
+ALTER TABLE orders ADD COLUMN refund_pending BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX orders_refund_pending_idx ON orders (id) WHERE refund_pending;
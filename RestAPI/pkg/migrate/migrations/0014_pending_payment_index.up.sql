@@ -0,0 +1,2 @@
+-- Finds the orders that waited too long for their payment, so that they can be cancelled and restocked.
+CREATE INDEX orders_pending_payment_idx ON orders (created_at) WHERE status = 'pending_payment';
@@ -0,0 +1,3 @@
+-- failed: the request holding the key ended without a response that could be stored. It may have changed
+-- something before, so the key is kept until it expires and retries are rejected instead of processed again.
+ALTER TABLE idempotency_keys ADD COLUMN failed BOOLEAN NOT NULL DEFAULT false;
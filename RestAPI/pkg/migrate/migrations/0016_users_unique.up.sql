@@ -0,0 +1,4 @@
+-- Sign up only checked for a taken email before inserting, so two concurrent requests could both create the user.
+-- Existing duplicates have to be merged by hand before this migration can run.
+CREATE UNIQUE INDEX users_email_key ON users (email);
+CREATE UNIQUE INDEX users_username_key ON users (username);
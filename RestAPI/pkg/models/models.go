@@ -1,38 +1,252 @@
 package models
 
+import (
+	"RestAPI/pkg/validate"
+	"RestAPI/pkg/vault"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
 // """This code defines a struct called "Product"
-// The struct has five fields: ID, Name, Description, Price and Quantity.
+// The struct has seven fields: ID, Name, Description, Price, Quantity, CreatedBy and UpdatedBy.
 // Each field is of a specific type: int, string, float64,
 // and each field is also tagged with a json:"fieldname" which is used in encoding/decoding of json.
+// CreatedBy and UpdatedBy hold the IDs of the users who created and last changed the product,
+// they are set by the server and ignored when sent by a client.
 type Product struct {
 	ID          int     `json:"id"`
 	Name        string  `json:"name"`
 	Description string  `json:"description"`
 	Price       float64 `json:"price"`
 	Quantity    int     `json:"quantity"`
+	CreatedBy   int     `json:"created_by,omitempty"`
+	UpdatedBy   int     `json:"updated_by,omitempty"`
+}
+
+// Limits of the product fields, the sizes of their columns.
+const (
+	MaxProductNameLength = 255
+	MaxPrice             = 99999999.99
+)
+
+// Validate checks the fields of a product a client sets: the name is required, and neither the price
+// nor the quantity may be negative.
+func (p *Product) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(strings.TrimSpace(p.Name) != "", "name", "is required")
+	errs.Check(utf8.RuneCountInString(p.Name) <= MaxProductNameLength, "name", "must not be longer than %d characters", MaxProductNameLength)
+	errs.Check(p.Price >= 0, "price", "must not be negative")
+	errs.Check(p.Price <= MaxPrice, "price", "must not be more than %.2f", MaxPrice)
+	errs.Check(p.Quantity >= 0, "quantity", "must not be negative")
+	return errs.Err()
 }
 
 // """This code defines a struct called "USER"
-// The struct has four fields: ID, Name, Email, Password
-// Each field is of a specific type: int, string
+// The struct has five fields: ID, Name, Email, Password and Roles
+// Each field is of a specific type: int, string, []string
 // and each field is also tagged with a json:"fieldname" which is used in encoding/decoding of json.
+// Roles holds the Role constants granted to the user, every user is at least a customer.
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID       int      `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// Limits of the user fields. Passwords are hashed with bcrypt, which only looks at the first 72 bytes.
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 50
+	MaxEmailLength    = 254
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// Validate checks the fields of a user signing up: a username of letters, digits, dots, dashes and
+// underscores, a plain e-mail address and a password of MinPasswordLength to MaxPasswordLength bytes.
+func (u *User) Validate() error {
+	errs := validate.Errors{}
+	errs.Check(u.Username != "", "username", "is required")
+	errs.Check(utf8.RuneCountInString(u.Username) >= MinUsernameLength && utf8.RuneCountInString(u.Username) <= MaxUsernameLength,
+		"username", "must have %d to %d characters", MinUsernameLength, MaxUsernameLength)
+	errs.Check(strings.IndexFunc(u.Username, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c))
+	}) < 0, "username", "may only contain letters, digits, dots, dashes and underscores")
+	errs.Check(u.Email != "", "email", "is required")
+	errs.Check(len(u.Email) <= MaxEmailLength && validate.IsEmail(u.Email), "email", "is not a valid e-mail address")
+	errs.Check(u.Password != "", "password", "is required")
+	errs.Check(len(u.Password) >= MinPasswordLength, "password", "must have at least %d characters", MinPasswordLength)
+	errs.Check(len(u.Password) <= MaxPasswordLength, "password", "must not be longer than %d bytes", MaxPasswordLength)
+	return errs.Err()
+}
+
+// The roles a user can be granted.
+// Customers can shop, staff can additionally administer the catalog, and admins can also grant and revoke roles.
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// IsRole reports whether role is one of the Role constants.
+func IsRole(role string) bool {
+	return role == RoleCustomer || role == RoleStaff || role == RoleAdmin
+}
+
+// HasRole reports whether the user was granted the role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 // """This code defines a struct called "CreditCard"
-// The struct has four fields: ID, UserID, CardNumber, ExpiryMonth, ExpiryYear ,CVV and NameONCard
-// Each field is of a specific type: int string
-// and each field is also tagged with a json:"fieldname" which is used in encoding/decoding of json.
+// A saved card of a user. The card number is only kept encrypted by the vault in Number and never sent back,
+// clients identify the card by its Token and recognize it by Brand, Last4 and the Masked number. The CVV is never stored.
+// Default marks the one card of the user that is charged when no card is named.
 type CreditCard struct {
-	ID          int    `json:"id"`
-	UserID      int    `json:"user_id"`
-	CardNumber  string `json:"card_number"`
-	ExpiryMonth string `json:"expiry_month"`
-	ExpiryYear  string `json:"expiry_year"`
-	CVV         string `json:"cvv"`
-	NameOnCard  string `json:"name_on_card"`
+	ID          int          `json:"id"`
+	UserID      int          `json:"user_id"`
+	Token       string       `json:"token"`
+	Brand       string       `json:"brand"`
+	Last4       string       `json:"last4"`
+	Masked      string       `json:"masked"`
+	Default     bool         `json:"default"`
+	ExpiryMonth string       `json:"expiry_month"`
+	ExpiryYear  string       `json:"expiry_year"`
+	NameOnCard  string       `json:"name_on_card"`
+	Number      vault.Sealed `json:"-"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// """This code defines a struct called "RefreshToken"
+// A refresh token is handed out next to every access token and can be exchanged exactly once for a new pair.
+// Only the SHA-256 hash of the token is stored. All tokens descending from the same login share a FamilyID,
+// so the whole chain can be revoked when an already used token is presented again.
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	FamilyID  string     `json:"family_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// StoredResponse is the response to a request sent with an Idempotency-Key header,
+// kept so that retries of the request can be answered with it instead of being processed again.
+type StoredResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Header     map[string][]string `json:"header"`
+	Body       []byte              `json:"body"`
+}
+
+// """This code defines a struct called "Order"
+// An order is placed by one user for one or more products. Total is the sum of the items
+// and is computed by the store when the order is placed. PaymentID identifies the payment
+// at the payment provider once the order was paid for. RefundPending is set when a paid order
+// was cancelled or refunded and the payment was not paid back yet.
+type Order struct {
+	ID            int         `json:"id"`
+	UserID        int         `json:"user_id"`
+	Status        string      `json:"status"`
+	Total         float64     `json:"total"`
+	Items         []OrderItem `json:"items"`
+	PaymentID     string      `json:"payment_id,omitempty"`
+	RefundPending bool        `json:"refund_pending,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// The statuses an order moves through. Every order starts out as OrderPendingPayment.
+const (
+	OrderPendingPayment = "pending_payment"
+	OrderPaid           = "paid"
+	OrderFulfilled      = "fulfilled"
+	OrderShipped        = "shipped"
+	OrderDelivered      = "delivered"
+	OrderCancelled      = "cancelled"
+	OrderRefunded       = "refunded"
+)
+
+// orderTransitions lists the statuses an order in a given status may move to.
+// Orders can be cancelled until they are shipped; cancelled and refunded orders are final.
+var orderTransitions = map[string][]string{
+	OrderPendingPayment: {OrderPaid, OrderCancelled},
+	OrderPaid:           {OrderFulfilled, OrderCancelled, OrderRefunded},
+	OrderFulfilled:      {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:        {OrderDelivered, OrderRefunded},
+	OrderDelivered:      {OrderRefunded},
+	OrderCancelled:      {},
+	OrderRefunded:       {},
+}
+
+// IsOrderStatus reports whether status is one of the order status constants.
+func IsOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// OwesRefund reports whether an order that was paid with paymentID has to be paid back when it moves from one status to the other:
+// it was paid for and is now cancelled or refunded.
+func OwesRefund(from, to, paymentID string) bool {
+	return paymentID != "" && from != OrderPendingPayment && (to == OrderCancelled || to == OrderRefunded)
+}
+
+// CanTransition reports whether an order may move from one status to the other.
+func CanTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// """This code defines a struct called "OrderItem"
+// Name and UnitPrice are a snapshot of the product at the time the order was placed,
+// so later changes to the product do not change the order. ProductID is 0 once the product was deleted.
+type OrderItem struct {
+	ID        int     `json:"id"`
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	UnitPrice float64 `json:"unit_price"`
+	Quantity  int     `json:"quantity"`
+}
+
+// """This code defines a struct called "OrderEvent"
+// Every change of the status of an order is recorded as an event, starting with the placement of the order
+// for which From is empty. ActorID is the user who made the change, 0 once that user was deleted.
+type OrderEvent struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	ActorID   int       `json:"actor_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// """This code defines a struct called "Cart"
+// A cart collects products before they are ordered. Prices and stock are read from the products
+// table every time the cart is loaded, so they are always current. Total is the sum of the items, and
+// Available tells whether every item is in stock in the wanted quantity, which checkout requires.
+type Cart struct {
+	Items     []CartItem `json:"items"`
+	Total     float64    `json:"total"`
+	Available bool       `json:"available"`
+}
+
+// """This code defines a struct called "CartItem"
+// Name, UnitPrice and InStock are the current values of the product.
+type CartItem struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	UnitPrice float64 `json:"unit_price"`
+	Quantity  int     `json:"quantity"`
+	InStock   int     `json:"in_stock"`
+	Subtotal  float64 `json:"subtotal"`
 }
@@ -0,0 +1,226 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Card tokens with a fixed outcome on the Fake gateway, all but TokenVisa are declined.
+// They mirror the test tokens of Stripe, so the same tokens work against both.
+const (
+	TokenVisa              = "tok_visa"
+	TokenDeclined          = "tok_chargeDeclined"
+	TokenInsufficientFunds = "tok_chargeDeclinedInsufficientFunds"
+	TokenExpiredCard       = "tok_chargeDeclinedExpiredCard"
+	TokenIncorrectCVC      = "tok_chargeDeclinedIncorrectCvc"
+	TokenProcessingError   = "tok_chargeDeclinedProcessingError"
+)
+
+// Card numbers with a fixed outcome on the Fake gateway, for charging cards saved in the vault.
+// Like the tokens they are the test cards of Stripe, any other valid number is accepted.
+const (
+	CardDeclined          = "4000000000000002"
+	CardInsufficientFunds = "4000000000009995"
+	CardExpired           = "4000000000000069"
+	CardIncorrectCVC      = "4000000000000127"
+	CardProcessingError   = "4000000000000119"
+)
+
+// Fake is a deterministic in-process Gateway for tests and local development. It never talks to a network.
+// Every token and card number is accepted except the declined Token and Card constants above, and the outcome
+// of others can be scripted with DeclineSource, which also takes card numbers, and DeclineNext.
+// Payment IDs are numbered "fake_1", "fake_2" and so on.
+type Fake struct {
+	mu           sync.Mutex
+	lastID       int
+	payments     map[string]*fakePayment
+	idempotency  map[string]string
+	refunds      map[string]bool
+	declines     map[string]string
+	queued       []string
+	failRefunds  int
+	failCaptures []bool
+}
+
+type fakePayment struct {
+	authorized int64
+	captured   int64
+	refunded   int64
+	voided     bool
+}
+
+// NewFake returns a Fake gateway without any payments.
+func NewFake() *Fake {
+	return &Fake{
+		payments:    map[string]*fakePayment{},
+		idempotency: map[string]string{},
+		refunds:     map[string]bool{},
+		declines: map[string]string{
+			TokenDeclined:          "card_declined",
+			TokenInsufficientFunds: "insufficient_funds",
+			TokenExpiredCard:       "expired_card",
+			TokenIncorrectCVC:      "incorrect_cvc",
+			TokenProcessingError:   "processing_error",
+			CardDeclined:           "card_declined",
+			CardInsufficientFunds:  "insufficient_funds",
+			CardExpired:            "expired_card",
+			CardIncorrectCVC:       "incorrect_cvc",
+			CardProcessingError:    "processing_error",
+		},
+	}
+}
+
+// DeclineSource makes every authorization with the card token fail with the decline code.
+func (f *Fake) DeclineSource(source, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.declines[source] = code
+}
+
+// DeclineNext makes the next authorization fail with the decline code, whatever its token.
+// Calling it several times queues several declines.
+func (f *Fake) DeclineNext(code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued = append(f.queued, code)
+}
+
+// FailNextRefund makes the next refund fail as if the provider could not be reached, without paying anything back.
+// Calling it several times fails several refunds.
+func (f *Fake) FailNextRefund() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failRefunds++
+}
+
+// FailNextCapture makes the next capture fail as if the connection to the provider broke. With captured the payment
+// is captured all the same, as when the answer of the provider was lost. Calling it several times fails several captures.
+func (f *Fake) FailNextCapture(captured bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failCaptures = append(f.failCaptures, captured)
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.idempotency[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		return &Authorization{ID: id, Amount: f.payments[id].authorized}, nil
+	}
+	if req.Amount <= 0 {
+		return nil, errors.New("payment: amount must be positive")
+	}
+	source := req.Source
+	if req.Card != nil {
+		source = req.Card.Number
+	}
+	if source == "" {
+		return nil, &DeclineError{Code: "missing_source", Message: "no card token given"}
+	}
+	if len(f.queued) > 0 {
+		code := f.queued[0]
+		f.queued = f.queued[1:]
+		return nil, &DeclineError{Code: code}
+	}
+	if code, ok := f.declines[source]; ok {
+		return nil, &DeclineError{Code: code}
+	}
+
+	f.lastID++
+	id := fmt.Sprintf("fake_%d", f.lastID)
+	f.payments[id] = &fakePayment{authorized: req.Amount}
+	if req.IdempotencyKey != "" {
+		f.idempotency[req.IdempotencyKey] = id
+	}
+	return &Authorization{ID: id, Amount: req.Amount}, nil
+}
+
+func (f *Fake) payment(id string) (*fakePayment, error) {
+	p, ok := f.payments[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownPayment, id)
+	}
+	return p, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, id string, amount int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, err := f.payment(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.voided:
+		return fmt.Errorf("%w: %s was voided", ErrRejected, id)
+	case p.captured > 0:
+		return fmt.Errorf("%w: %s was already captured", ErrRejected, id)
+	case amount <= 0 || amount > p.authorized:
+		return fmt.Errorf("%w: can not capture %d of %d authorized", ErrRejected, amount, p.authorized)
+	}
+	if len(f.failCaptures) > 0 {
+		captured := f.failCaptures[0]
+		f.failCaptures = f.failCaptures[1:]
+		if captured {
+			p.captured = amount
+		}
+		return errors.New("payment: capture timed out")
+	}
+	p.captured = amount
+	return nil
+}
+
+func (f *Fake) Void(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, err := f.payment(id)
+	if err != nil {
+		return err
+	}
+	if p.captured > 0 {
+		return fmt.Errorf("%w: %s was already captured, refund it instead", ErrRejected, id)
+	}
+	p.voided = true
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, id string, amount int64, idempotencyKey string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, err := f.payment(id)
+	if err != nil {
+		return err
+	}
+	if idempotencyKey != "" && f.refunds[idempotencyKey] {
+		return nil
+	}
+	if f.failRefunds > 0 {
+		f.failRefunds--
+		return errors.New("payment: refund failed")
+	}
+	if amount <= 0 || p.refunded+amount > p.captured {
+		return fmt.Errorf("%w: can not refund %d, %d of %d captured are left", ErrRejected, amount, p.captured-p.refunded, p.captured)
+	}
+	p.refunded += amount
+	if idempotencyKey != "" {
+		f.refunds[idempotencyKey] = true
+	}
+	return nil
+}
+
+// Captured returns how much of the payment was captured and refunded, for tests to check against.
+func (f *Fake) Captured(id string) (captured, refunded int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p, ok := f.payments[id]; ok {
+		return p.captured, p.refunded
+	}
+	return 0, 0
+}
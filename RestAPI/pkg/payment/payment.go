@@ -0,0 +1,105 @@
+// Package payment charges customers through a payment provider.
+//
+// Payments follow the authorize and capture model of card networks: Authorize reserves the amount on the
+// card of the customer, Capture moves (part of) the reserved amount, Void releases an authorization that
+// was not captured, and Refund pays a captured amount back.
+package payment
+
+import (
+	"RestAPI/pkg/config"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// ErrDeclined is wrapped by every *DeclineError.
+var ErrDeclined = errors.New("payment declined")
+
+// ErrUnknownPayment is returned for a payment ID the gateway does not know.
+var ErrUnknownPayment = errors.New("unknown payment")
+
+// ErrRejected is wrapped by the errors of requests the provider answered and refused, such as capturing
+// more than was authorized.
+var ErrRejected = errors.New("payment rejected")
+
+// Rejected reports whether err is an answer of the provider refusing the request, which therefore had no effect.
+// Any other error, such as a timeout, leaves it open whether the provider carried the request out.
+func Rejected(err error) bool {
+	return errors.Is(err, ErrRejected) || errors.Is(err, ErrDeclined) || errors.Is(err, ErrUnknownPayment)
+}
+
+// DeclineError is returned by Authorize when the provider or the card issuer refused the payment.
+// Code is a machine readable reason such as "card_declined" or "insufficient_funds".
+type DeclineError struct {
+	Code    string
+	Message string
+}
+
+func (e *DeclineError) Error() string {
+	if e.Message == "" {
+		return "payment declined: " + e.Code
+	}
+	return "payment declined: " + e.Message
+}
+
+func (e *DeclineError) Unwrap() error { return ErrDeclined }
+
+// AuthorizeRequest describes the amount to reserve. Amount is in the smallest unit of Currency, cents for USD.
+// The card is either Source, a card token issued by the provider's client library, or Card, the details of
+// a card saved in the vault.
+// Authorizing twice with the same IdempotencyKey returns the first authorization instead of charging twice.
+type AuthorizeRequest struct {
+	Amount         int64
+	Currency       string
+	Source         string
+	Card           *Card
+	Description    string
+	IdempotencyKey string
+}
+
+// Card holds the details of a card to charge without a provider token. The CVV is never stored,
+// so saved cards are charged without it.
+type Card struct {
+	Number   string
+	ExpMonth string
+	ExpYear  string
+	Name     string
+}
+
+// Authorization is a successful authorization, ID identifies it in the later calls.
+type Authorization struct {
+	ID     string
+	Amount int64
+}
+
+// Gateway is implemented by every payment provider.
+type Gateway interface {
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error)
+	// Capture captures amount of the authorization, which must not exceed the authorized amount.
+	Capture(ctx context.Context, id string, amount int64) error
+	// Void releases an authorization that was not captured.
+	Void(ctx context.Context, id string) error
+	// Refund pays back amount of a captured payment. Refunds can be partial, but never exceed what was captured.
+	// Refunding twice with the same idempotencyKey pays back only once, so a refund can be retried safely.
+	Refund(ctx context.Context, id string, amount int64, idempotencyKey string) error
+}
+
+// NewGateway returns the gateway selected by the payment settings of config.
+func NewGateway(config *config.Config) (Gateway, error) {
+	c := config.Payment
+	switch c.Provider {
+	case "fake":
+		return NewFake(), nil
+	case "stripe":
+		return NewStripe(c.StripeAPIURL, c.StripeSecretKey, &http.Client{Timeout: c.Timeout}), nil
+	default:
+		return nil, fmt.Errorf("payment: unknown provider %q", c.Provider)
+	}
+}
+
+// Cents converts a decimal amount, as stored for prices and order totals, into the smallest currency unit.
+func Cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
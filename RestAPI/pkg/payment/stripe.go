@@ -0,0 +1,141 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Stripe is a Gateway speaking the PaymentIntents API of Stripe. Payments are authorized by creating
+// and confirming a PaymentIntent with manual capture, so they can be captured or cancelled later.
+// BaseURL can point at any server implementing the same API, such as stripe-mock for local development.
+type Stripe struct {
+	baseURL   string
+	secretKey string
+	client    *http.Client
+}
+
+// NewStripe returns a Stripe gateway sending requests to baseURL, "https://api.stripe.com" for the real API,
+// authenticated with the secret API key.
+func NewStripe(baseURL, secretKey string, client *http.Client) *Stripe {
+	return &Stripe{baseURL: strings.TrimSuffix(baseURL, "/"), secretKey: secretKey, client: client}
+}
+
+// stripeError is the error object of a failed Stripe API request.
+type stripeError struct {
+	Error struct {
+		Type        string `json:"type"`
+		Code        string `json:"code"`
+		DeclineCode string `json:"decline_code"`
+		Message     string `json:"message"`
+	} `json:"error"`
+}
+
+// post sends a form encoded POST request to the API path and decodes the JSON response into out, if not nil.
+// Card errors are returned as *DeclineError and other refusals of the API wrap ErrRejected. Server errors
+// and failed connections are returned as plain errors, since the request may have been carried out.
+func (s *Stripe) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("payment: stripe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body stripeError
+		json.NewDecoder(resp.Body).Decode(&body)
+		e := body.Error
+		if e.Type == "card_error" {
+			code := e.DeclineCode
+			if code == "" {
+				code = e.Code
+			}
+			return &DeclineError{Code: code, Message: e.Message}
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: stripe: %s", ErrUnknownPayment, resp.Status)
+		}
+		// A conflict means a request with the same idempotency key is still running, which may yet succeed.
+		// Server errors leave the outcome open as well.
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusConflict {
+			if e.Message == "" {
+				return fmt.Errorf("payment: stripe: %s", resp.Status)
+			}
+			return fmt.Errorf("payment: stripe: %s: %s", resp.Status, e.Message)
+		}
+		if e.Message == "" {
+			return fmt.Errorf("%w: stripe: %s", ErrRejected, resp.Status)
+		}
+		return fmt.Errorf("%w: stripe: %s: %s", ErrRejected, resp.Status, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// paymentIntent holds the fields of a PaymentIntent the gateway reads.
+type paymentIntent struct {
+	ID     string `json:"id"`
+	Amount int64  `json:"amount"`
+	Status string `json:"status"`
+}
+
+func (s *Stripe) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	form := url.Values{
+		"amount":                           {strconv.FormatInt(req.Amount, 10)},
+		"currency":                         {req.Currency},
+		"description":                      {req.Description},
+		"capture_method":                   {"manual"},
+		"confirm":                          {"true"},
+		"payment_method_data[type]":        {"card"},
+		"payment_method_data[card][token]": {req.Source},
+	}
+	if c := req.Card; c != nil {
+		// Sending card numbers to Stripe requires raw card data access to be enabled on the account.
+		form.Del("payment_method_data[card][token]")
+		form.Set("payment_method_data[card][number]", c.Number)
+		form.Set("payment_method_data[card][exp_month]", c.ExpMonth)
+		form.Set("payment_method_data[card][exp_year]", c.ExpYear)
+		form.Set("payment_method_data[billing_details][name]", c.Name)
+	}
+	var intent paymentIntent
+	if err := s.post(ctx, "/v1/payment_intents", form, req.IdempotencyKey, &intent); err != nil {
+		return nil, err
+	}
+	if intent.Status != "requires_capture" {
+		return nil, &DeclineError{Code: intent.Status, Message: "payment intent is " + intent.Status}
+	}
+	return &Authorization{ID: intent.ID, Amount: intent.Amount}, nil
+}
+
+func (s *Stripe) Capture(ctx context.Context, id string, amount int64) error {
+	form := url.Values{"amount_to_capture": {strconv.FormatInt(amount, 10)}}
+	return s.post(ctx, "/v1/payment_intents/"+url.PathEscape(id)+"/capture", form, "capture-"+id, nil)
+}
+
+func (s *Stripe) Void(ctx context.Context, id string) error {
+	return s.post(ctx, "/v1/payment_intents/"+url.PathEscape(id)+"/cancel", url.Values{}, "cancel-"+id, nil)
+}
+
+func (s *Stripe) Refund(ctx context.Context, id string, amount int64, idempotencyKey string) error {
+	form := url.Values{
+		"payment_intent": {id},
+		"amount":         {strconv.FormatInt(amount, 10)},
+	}
+	return s.post(ctx, "/v1/refunds", form, idempotencyKey, nil)
+}
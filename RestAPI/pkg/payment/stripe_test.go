@@ -0,0 +1,121 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStripeMock serves the PaymentIntents endpoints the Stripe gateway uses and records every request.
+func newStripeMock(t *testing.T) (*Stripe, *[]string) {
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/payment_intents", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if user, _, _ := r.BasicAuth(); user != "sk_test_123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"type": "invalid_request_error", "message": "Invalid API Key"}}`)
+			return
+		}
+		requests = append(requests, "authorize "+r.Form.Get("amount")+" "+r.Form.Get("capture_method")+" "+r.Header.Get("Idempotency-Key"))
+		if r.Form.Get("payment_method_data[card][token]") == TokenInsufficientFunds {
+			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Fprint(w, `{"error": {"type": "card_error", "code": "card_declined", "decline_code": "insufficient_funds", "message": "Your card has insufficient funds."}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id": "pi_1", "amount": %s, "status": "requires_capture"}`, r.Form.Get("amount"))
+	})
+	mux.HandleFunc("/v1/payment_intents/pi_1/capture", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, "capture "+r.Form.Get("amount_to_capture"))
+		fmt.Fprint(w, `{"id": "pi_1", "status": "succeeded"}`)
+	})
+	mux.HandleFunc("/v1/refunds", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, "refund "+r.Form.Get("payment_intent")+" "+r.Form.Get("amount")+" "+r.Header.Get("Idempotency-Key"))
+		fmt.Fprint(w, `{"id": "re_1", "status": "succeeded"}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return NewStripe(server.URL, "sk_test_123", server.Client()), &requests
+}
+
+func TestStripe(t *testing.T) {
+	stripe, requests := newStripeMock(t)
+	ctx := context.Background()
+
+	auth, err := stripe.Authorize(ctx, AuthorizeRequest{Amount: 1250, Currency: "usd", Source: TokenVisa, IdempotencyKey: "order-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.ID != "pi_1" || auth.Amount != 1250 {
+		t.Errorf("got authorization %+v", auth)
+	}
+	if err := stripe.Capture(ctx, auth.ID, 1250); err != nil {
+		t.Fatal(err)
+	}
+	if err := stripe.Refund(ctx, auth.ID, 1250, "refund-order-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stripe.Void(ctx, "pi_unknown"); !errors.Is(err, ErrUnknownPayment) {
+		t.Errorf("voiding an unknown payment: got %v", err)
+	}
+
+	_, err = stripe.Authorize(ctx, AuthorizeRequest{Amount: 1250, Currency: "usd", Source: TokenInsufficientFunds})
+	var declined *DeclineError
+	if !errors.As(err, &declined) || declined.Code != "insufficient_funds" || !errors.Is(err, ErrDeclined) {
+		t.Errorf("declined card: got %v", err)
+	}
+
+	want := []string{"authorize 1250 manual order-1", "capture 1250", "refund pi_1 1250 refund-order-1", "authorize 1250 manual "}
+	if fmt.Sprint(*requests) != fmt.Sprint(want) {
+		t.Errorf("requests\n got %q\nwant %q", *requests, want)
+	}
+}
+
+func TestFakeScriptedDeclines(t *testing.T) {
+	fake := NewFake()
+	ctx := context.Background()
+	fake.DeclineSource("tok_custom", "do_not_honor")
+	fake.DeclineNext("try_again_later")
+
+	if _, err := fake.Authorize(ctx, AuthorizeRequest{Amount: 100, Source: TokenVisa}); !isDecline(err, "try_again_later") {
+		t.Errorf("queued decline: got %v", err)
+	}
+	if _, err := fake.Authorize(ctx, AuthorizeRequest{Amount: 100, Source: "tok_custom"}); !isDecline(err, "do_not_honor") {
+		t.Errorf("scripted source: got %v", err)
+	}
+
+	auth, err := fake.Authorize(ctx, AuthorizeRequest{Amount: 100, Source: TokenVisa, IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := fake.Authorize(ctx, AuthorizeRequest{Amount: 100, Source: TokenVisa, IdempotencyKey: "k"})
+	if err != nil || again.ID != auth.ID {
+		t.Errorf("idempotent retry: got %+v, %v, want %s", again, err, auth.ID)
+	}
+	if err := fake.Capture(ctx, auth.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Refund(ctx, auth.ID, 60, "refund-1"); err != nil {
+		t.Fatal(err)
+	}
+	// Retrying with the same key does not pay back twice.
+	if err := fake.Refund(ctx, auth.ID, 60, "refund-1"); err != nil {
+		t.Errorf("retried refund: %v", err)
+	}
+	if err := fake.Refund(ctx, auth.ID, 60, "refund-2"); err == nil {
+		t.Error("refunding more than was captured succeeded")
+	}
+	if captured, refunded := fake.Captured(auth.ID); captured != 100 || refunded != 60 {
+		t.Errorf("captured %d, refunded %d", captured, refunded)
+	}
+}
+
+func isDecline(err error, code string) bool {
+	var declined *DeclineError
+	return errors.As(err, &declined) && declined.Code == code
+}
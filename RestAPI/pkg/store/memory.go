@@ -0,0 +1,881 @@
+package store
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/vault"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDB holds every table of the in-memory implementation behind one mutex,
+// so that operations spanning several stores stay consistent just like they would inside a SQL transaction.
+type memoryDB struct {
+	mu sync.Mutex
+
+	products    map[int]models.Product
+	users       map[int]models.User
+	creditCards map[int]models.CreditCard
+	orders      map[int]models.Order
+	orderEvents []models.OrderEvent
+	carts       map[CartKey]*memCart
+	idempotency map[idempotencyKey]*memIdempotencyEntry
+
+	refreshTokens map[string]*models.RefreshToken
+	revokedTokens map[string]time.Time
+
+	lastProductID      int
+	lastUserID         int
+	lastCreditCardID   int
+	lastOrderID        int
+	lastOrderItemID    int
+	lastOrderEventID   int
+	lastRefreshTokenID int
+}
+
+// NewMemory returns Stores that keep everything in process memory.
+// It is intended for unit tests and local development without a Postgres instance.
+func NewMemory() *Stores {
+	db := &memoryDB{
+		products:    map[int]models.Product{},
+		users:       map[int]models.User{},
+		creditCards: map[int]models.CreditCard{},
+		orders:      map[int]models.Order{},
+		carts:       map[CartKey]*memCart{},
+		idempotency: map[idempotencyKey]*memIdempotencyEntry{},
+
+		refreshTokens: map[string]*models.RefreshToken{},
+		revokedTokens: map[string]time.Time{},
+	}
+	return &Stores{
+		Products:    &memProducts{db: db},
+		Users:       &memUsers{db: db},
+		CreditCards: &memCreditCards{db: db},
+		Orders:      &memOrders{db: db},
+		Carts:       &memCarts{db: db},
+		Tokens:      &memTokens{db: db},
+		Idempotency: &memIdempotency{db: db},
+	}
+}
+
+type memProducts struct {
+	db *memoryDB
+}
+
+func (s *memProducts) Create(ctx context.Context, product *models.Product) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.lastProductID++
+	product.ID = s.db.lastProductID
+	s.db.products[product.ID] = *product
+	return nil
+}
+
+func (s *memProducts) Get(ctx context.Context, id int) (*models.Product, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	p, ok := s.db.products[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (s *memProducts) List(ctx context.Context, q ProductQuery) (*ProductPage, error) {
+	if err := checkCursor(q); err != nil {
+		return nil, err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	matching := []models.Product{}
+	for _, p := range s.db.products {
+		if q.MinPrice != nil && p.Price < *q.MinPrice {
+			continue
+		}
+		if q.MaxPrice != nil && p.Price > *q.MaxPrice {
+			continue
+		}
+		if !strings.HasPrefix(p.Name, q.NamePrefix) {
+			continue
+		}
+		matching = append(matching, p)
+	}
+	sort.Slice(matching, func(i, j int) bool { return productLess(q, matching[i], matching[j]) })
+
+	page := &ProductPage{Products: []models.Product{}, Total: len(matching)}
+	start := 0
+	if q.Cursor != nil {
+		start = sort.Search(len(matching), func(i int) bool {
+			return productLess(q, *q.Cursor.product(), matching[i])
+		})
+	}
+	end := start + q.Limit
+	if end < len(matching) {
+		page.Next = cursorAfter(q, matching[end-1])
+	} else {
+		end = len(matching)
+	}
+	page.Products = append(page.Products, matching[start:end]...)
+	return page, nil
+}
+
+// productLess orders products the way the ORDER BY of the postgres implementation does.
+func productLess(q ProductQuery, a, b models.Product) bool {
+	if q.Descending {
+		a, b = b, a
+	}
+	switch {
+	case q.Sort == SortByName && a.Name != b.Name:
+		return a.Name < b.Name
+	case q.Sort == SortByPrice && a.Price != b.Price:
+		return a.Price < b.Price
+	}
+	return a.ID < b.ID
+}
+
+// product returns the sort key stored in the cursor as a product, so it can be compared with productLess.
+func (c *Cursor) product() *models.Product {
+	return &models.Product{ID: c.ID, Name: c.Name, Price: c.Price}
+}
+
+func (s *memProducts) Update(ctx context.Context, product *models.Product) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.products[product.ID]; !ok {
+		return ErrNotFound
+	}
+	s.db.products[product.ID] = *product
+	return nil
+}
+
+func (s *memProducts) Delete(ctx context.Context, id int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.products[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.db.products, id)
+	// Like the cascade in Postgres, deleting a product takes it out of every cart.
+	for _, cart := range s.db.carts {
+		cart.remove(id)
+	}
+	return nil
+}
+
+type memUsers struct {
+	db *memoryDB
+}
+
+func (s *memUsers) Create(ctx context.Context, user *models.User) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, u := range s.db.users {
+		if u.Email == user.Email || u.Username == user.Username {
+			return ErrConflict
+		}
+	}
+	s.db.lastUserID++
+	user.ID = s.db.lastUserID
+	s.db.users[user.ID] = copyUser(*user)
+	return nil
+}
+
+// copyUser returns a user that does not share its Roles with u, so callers cannot modify stored users.
+func copyUser(u models.User) models.User {
+	u.Roles = append([]string{}, u.Roles...)
+	return u
+}
+
+func (s *memUsers) Get(ctx context.Context, id int) (*models.User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	u, ok := s.db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u = copyUser(u)
+	return &u, nil
+}
+
+func (s *memUsers) GetByUsername(ctx context.Context, username string) (*models.User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, u := range s.db.users {
+		if u.Username == username {
+			u = copyUser(u)
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memUsers) GrantRole(ctx context.Context, id int, role string) (*models.User, error) {
+	return s.updateRoles(id, func(u *models.User) {
+		if !u.HasRole(role) {
+			u.Roles = append(u.Roles, role)
+		}
+	})
+}
+
+func (s *memUsers) RevokeRole(ctx context.Context, id int, role string) (*models.User, error) {
+	return s.updateRoles(id, func(u *models.User) {
+		roles := []string{}
+		for _, r := range u.Roles {
+			if r != role {
+				roles = append(roles, r)
+			}
+		}
+		u.Roles = roles
+	})
+}
+
+func (s *memUsers) updateRoles(id int, update func(u *models.User)) (*models.User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	u, ok := s.db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u = copyUser(u)
+	update(&u)
+	s.db.users[id] = u
+	u = copyUser(u)
+	return &u, nil
+}
+
+type memCreditCards struct {
+	db *memoryDB
+}
+
+func (s *memCreditCards) Create(ctx context.Context, card *models.CreditCard) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, c := range s.db.creditCards {
+		if c.Token == card.Token {
+			return ErrConflict
+		}
+	}
+	s.db.lastCreditCardID++
+	card.ID = s.db.lastCreditCardID
+	card.CreatedAt = time.Now()
+	card.Default = len(s.userCards(card.UserID)) == 0
+	s.db.creditCards[card.ID] = *card
+	return nil
+}
+
+// userCards returns the cards of the user in the order of ListByUser.
+func (s *memCreditCards) userCards(userID int) []models.CreditCard {
+	cards := []models.CreditCard{}
+	for _, c := range s.db.creditCards {
+		if c.UserID == userID {
+			cards = append(cards, c)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].Default != cards[j].Default {
+			return cards[i].Default
+		}
+		return cards[i].ID > cards[j].ID
+	})
+	return cards
+}
+
+func (s *memCreditCards) Get(ctx context.Context, userID, id int) (*models.CreditCard, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	c, ok := s.db.creditCards[id]
+	if !ok || c.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (s *memCreditCards) GetDefault(ctx context.Context, userID int) (*models.CreditCard, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	cards := s.userCards(userID)
+	if len(cards) == 0 || !cards[0].Default {
+		return nil, ErrNotFound
+	}
+	return &cards[0], nil
+}
+
+func (s *memCreditCards) ListByUser(ctx context.Context, userID int) ([]models.CreditCard, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.userCards(userID), nil
+}
+
+func (s *memCreditCards) Update(ctx context.Context, card *models.CreditCard) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	c, ok := s.db.creditCards[card.ID]
+	if !ok || c.UserID != card.UserID {
+		return ErrNotFound
+	}
+	c.ExpiryMonth, c.ExpiryYear, c.NameOnCard = card.ExpiryMonth, card.ExpiryYear, card.NameOnCard
+	s.db.creditCards[c.ID] = c
+	*card = c
+	return nil
+}
+
+func (s *memCreditCards) SetDefault(ctx context.Context, userID, id int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if c, ok := s.db.creditCards[id]; !ok || c.UserID != userID {
+		return ErrNotFound
+	}
+	for _, c := range s.userCards(userID) {
+		c.Default = c.ID == id
+		s.db.creditCards[c.ID] = c
+	}
+	return nil
+}
+
+func (s *memCreditCards) Delete(ctx context.Context, userID, id int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	c, ok := s.db.creditCards[id]
+	if !ok || c.UserID != userID {
+		return ErrNotFound
+	}
+	delete(s.db.creditCards, id)
+	if remaining := s.userCards(userID); c.Default && len(remaining) > 0 {
+		remaining[0].Default = true
+		s.db.creditCards[remaining[0].ID] = remaining[0]
+	}
+	return nil
+}
+
+func (s *memCreditCards) GetByToken(ctx context.Context, token string) (*models.CreditCard, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, c := range s.db.creditCards {
+		if c.Token == token {
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memCreditCards) ListNotWrappedBy(ctx context.Context, keyID string) ([]models.CreditCard, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	cards := []models.CreditCard{}
+	for _, c := range s.db.creditCards {
+		if c.Number.KeyID != keyID {
+			cards = append(cards, c)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool { return cards[i].ID < cards[j].ID })
+	return cards, nil
+}
+
+func (s *memCreditCards) SetNumber(ctx context.Context, id int, number vault.Sealed) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	c, ok := s.db.creditCards[id]
+	if !ok {
+		return ErrNotFound
+	}
+	c.Number = number
+	s.db.creditCards[id] = c
+	return nil
+}
+
+type memOrders struct {
+	db *memoryDB
+}
+
+// copyOrder copies the items slice so that callers can not change stored orders.
+func copyOrder(o models.Order) models.Order {
+	o.Items = append([]models.OrderItem{}, o.Items...)
+	return o
+}
+
+func (s *memOrders) Create(ctx context.Context, order *models.Order) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.db.createOrder(order)
+}
+
+// createOrder does the work of OrderStore.Create, the caller must hold the lock.
+func (db *memoryDB) createOrder(order *models.Order) error {
+	// Check every item before touching the stock, so that a failed order leaves it unchanged.
+	for _, id := range sortedProductIDs(order.Items) {
+		p, ok := db.products[id]
+		if !ok {
+			return ErrNotFound
+		}
+		for _, item := range order.Items {
+			if item.ProductID == id && p.Quantity < item.Quantity {
+				return &OutOfStockError{ProductID: id, Available: p.Quantity}
+			}
+		}
+	}
+	for i := range order.Items {
+		item := &order.Items[i]
+		p := db.products[item.ProductID]
+		p.Quantity -= item.Quantity
+		db.products[p.ID] = p
+
+		db.lastOrderItemID++
+		item.ID = db.lastOrderItemID
+		item.Name, item.UnitPrice = p.Name, p.Price
+	}
+
+	db.lastOrderID++
+	order.ID = db.lastOrderID
+	order.Status = models.OrderPendingPayment
+	order.Total = orderTotal(order.Items)
+	order.CreatedAt = time.Now()
+	db.orders[order.ID] = copyOrder(*order)
+	db.addEvent(order.ID, "", order.Status, order.UserID)
+	return nil
+}
+
+func (s *memOrders) Transition(ctx context.Context, id int, to string, actorID int) (*models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	o, ok := s.db.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !models.CanTransition(o.Status, to) {
+		return nil, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, o.Status, to)
+	}
+
+	s.db.addEvent(id, o.Status, to, actorID)
+	if models.OwesRefund(o.Status, to, o.PaymentID) {
+		o.RefundPending = true
+	}
+	o.Status = to
+	s.db.orders[id] = o
+	if to == models.OrderCancelled {
+		for _, item := range o.Items {
+			if p, ok := s.db.products[item.ProductID]; ok {
+				p.Quantity += item.Quantity
+				s.db.products[p.ID] = p
+			}
+		}
+	}
+	o = copyOrder(o)
+	return &o, nil
+}
+
+func (s *memOrders) MarkPaid(ctx context.Context, id int, paymentID string, actorID int) (*models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	o, ok := s.db.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if o.Status != models.OrderPendingPayment {
+		return nil, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, o.Status, models.OrderPaid)
+	}
+
+	s.db.addEvent(id, o.Status, models.OrderPaid, actorID)
+	o.Status, o.PaymentID = models.OrderPaid, paymentID
+	s.db.orders[id] = o
+	o = copyOrder(o)
+	return &o, nil
+}
+
+func (s *memOrders) SetRefunded(ctx context.Context, id int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	o, ok := s.db.orders[id]
+	if !ok {
+		return ErrNotFound
+	}
+	o.RefundPending = false
+	s.db.orders[id] = o
+	return nil
+}
+
+func (s *memOrders) ListRefundPending(ctx context.Context) ([]models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	orders := []models.Order{}
+	for _, o := range s.db.orders {
+		if o.RefundPending {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders, nil
+}
+
+func (s *memOrders) ListPendingPayment(ctx context.Context, placedBefore time.Time) ([]models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	orders := []models.Order{}
+	for _, o := range s.db.orders {
+		if o.Status == models.OrderPendingPayment && o.CreatedAt.Before(placedBefore) {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders, nil
+}
+
+// addEvent records a status change, the caller must hold the lock.
+func (db *memoryDB) addEvent(orderID int, from, to string, actorID int) {
+	db.lastOrderEventID++
+	db.orderEvents = append(db.orderEvents, models.OrderEvent{
+		ID:        db.lastOrderEventID,
+		OrderID:   orderID,
+		From:      from,
+		To:        to,
+		ActorID:   actorID,
+		CreatedAt: time.Now(),
+	})
+}
+
+func (s *memOrders) Events(ctx context.Context, orderID int) ([]models.OrderEvent, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	events := []models.OrderEvent{}
+	for _, e := range s.db.orderEvents {
+		if e.OrderID == orderID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memOrders) Get(ctx context.Context, id int) (*models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	o, ok := s.db.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	o = copyOrder(o)
+	return &o, nil
+}
+
+func (s *memOrders) ListByUser(ctx context.Context, userID int) ([]models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	orders := []models.Order{}
+	for _, o := range s.db.orders {
+		if o.UserID == userID {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID > orders[j].ID })
+	return orders, nil
+}
+
+type memCarts struct {
+	db *memoryDB
+}
+
+// memCart holds the items of a cart in the order they were added.
+type memCart struct {
+	items     []models.OrderItem
+	updatedAt time.Time
+}
+
+func (c *memCart) remove(productID int) {
+	for i, item := range c.items {
+		if item.ProductID == productID {
+			c.items = append(c.items[:i], c.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *memCarts) Get(ctx context.Context, key CartKey) (*models.Cart, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	items := []models.CartItem{}
+	if cart, ok := s.db.carts[key]; ok {
+		for _, item := range cart.items {
+			p := s.db.products[item.ProductID]
+			items = append(items, models.CartItem{
+				ProductID: p.ID,
+				Name:      p.Name,
+				UnitPrice: p.Price,
+				Quantity:  item.Quantity,
+				InStock:   p.Quantity,
+			})
+		}
+	}
+	return newCart(items), nil
+}
+
+// putItem sets the quantity of the product in the cart of the key to update(current quantity),
+// the caller must hold the lock.
+func (db *memoryDB) putItem(key CartKey, productID int, update func(int) int) error {
+	if _, ok := db.products[productID]; !ok {
+		return ErrNotFound
+	}
+	cart, ok := db.carts[key]
+	if !ok {
+		if key.UserID == 0 {
+			for k, c := range db.carts {
+				if k.UserID == 0 && time.Since(c.updatedAt) > AnonymousCartTTL {
+					delete(db.carts, k)
+				}
+			}
+		}
+		cart = &memCart{}
+		db.carts[key] = cart
+	}
+	cart.updatedAt = time.Now()
+	for i := range cart.items {
+		if cart.items[i].ProductID == productID {
+			cart.items[i].Quantity = update(cart.items[i].Quantity)
+			return nil
+		}
+	}
+	cart.items = append(cart.items, models.OrderItem{ProductID: productID, Quantity: update(0)})
+	return nil
+}
+
+func (s *memCarts) AddItem(ctx context.Context, key CartKey, productID, quantity int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.db.putItem(key, productID, func(current int) int { return current + quantity })
+}
+
+func (s *memCarts) SetItem(ctx context.Context, key CartKey, productID, quantity int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if quantity > 0 {
+		return s.db.putItem(key, productID, func(int) int { return quantity })
+	}
+	if cart, ok := s.db.carts[key]; ok {
+		cart.remove(productID)
+	}
+	return nil
+}
+
+func (s *memCarts) Clear(ctx context.Context, key CartKey) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if cart, ok := s.db.carts[key]; ok {
+		cart.items = nil
+	}
+	return nil
+}
+
+func (s *memCarts) Merge(ctx context.Context, tokenHash string, userID int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	anonymous, ok := s.db.carts[CartKey{TokenHash: tokenHash}]
+	if !ok {
+		return nil
+	}
+	delete(s.db.carts, CartKey{TokenHash: tokenHash})
+	for _, item := range anonymous.items {
+		quantity := item.Quantity
+		// A product deleted in the meantime is dropped, like the cascade does in Postgres.
+		s.db.putItem(CartKey{UserID: userID}, item.ProductID, func(current int) int { return current + quantity })
+	}
+	return nil
+}
+
+func (s *memCarts) Checkout(ctx context.Context, userID int) (*models.Order, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	cart, ok := s.db.carts[CartKey{UserID: userID}]
+	if !ok || len(cart.items) == 0 {
+		return nil, ErrEmptyCart
+	}
+	order := &models.Order{UserID: userID, Items: append([]models.OrderItem{}, cart.items...)}
+	if err := s.db.createOrder(order); err != nil {
+		return nil, err
+	}
+	cart.items = nil
+	return order, nil
+}
+
+type memTokens struct {
+	db *memoryDB
+}
+
+func (s *memTokens) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.insertRefreshToken(token)
+	return nil
+}
+
+func (s *memTokens) insertRefreshToken(token *models.RefreshToken) {
+	s.db.lastRefreshTokenID++
+	token.ID = s.db.lastRefreshTokenID
+	stored := *token
+	s.db.refreshTokens[token.TokenHash] = &stored
+}
+
+func (s *memTokens) RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	current, ok := s.db.refreshTokens[hash]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	if current.UsedAt != nil || current.RevokedAt != nil {
+		s.revokeFamily(current.FamilyID, now)
+		return ErrTokenReused
+	}
+	if !current.ExpiresAt.After(now) {
+		return ErrNotFound
+	}
+
+	current.UsedAt = &now
+	next.UserID, next.FamilyID = current.UserID, current.FamilyID
+	s.insertRefreshToken(next)
+	return nil
+}
+
+func (s *memTokens) RevokeRefreshFamily(ctx context.Context, hash string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if current, ok := s.db.refreshTokens[hash]; ok {
+		s.revokeFamily(current.FamilyID, time.Now())
+	}
+	return nil
+}
+
+func (s *memTokens) revokeFamily(familyID string, now time.Time) {
+	for _, token := range s.db.refreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+}
+
+func (s *memTokens) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+	for id, expiry := range s.db.revokedTokens {
+		if expiry.Before(now) {
+			delete(s.db.revokedTokens, id)
+		}
+	}
+	s.db.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *memTokens) IsAccessTokenDenied(ctx context.Context, jti string) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	_, denied := s.db.revokedTokens[jti]
+	return denied, nil
+}
+
+type memIdempotency struct {
+	db *memoryDB
+}
+
+type idempotencyKey struct {
+	userID int
+	key    string
+}
+
+// memIdempotencyEntry is a claimed key. Response stays nil until the request holding the key completes,
+// failed is set when it ended without one.
+type memIdempotencyEntry struct {
+	requestHash string
+	response    *models.StoredResponse
+	failed      bool
+	expiresAt   time.Time
+}
+
+func (s *memIdempotency) Claim(ctx context.Context, userID int, key, requestHash string) (*models.StoredResponse, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range s.db.idempotency {
+		if !entry.expiresAt.After(now) {
+			delete(s.db.idempotency, k)
+		}
+	}
+	k := idempotencyKey{userID, key}
+	entry, ok := s.db.idempotency[k]
+	switch {
+	case !ok:
+		s.db.idempotency[k] = &memIdempotencyEntry{requestHash: requestHash, expiresAt: now.Add(IdempotencyKeyTTL)}
+		return nil, nil
+	case entry.requestHash != requestHash:
+		return nil, ErrKeyMismatch
+	case entry.failed:
+		return nil, ErrKeyFailed
+	case entry.response == nil:
+		return nil, ErrKeyInProgress
+	}
+	return entry.response, nil
+}
+
+func (s *memIdempotency) Complete(ctx context.Context, userID int, key string, response *models.StoredResponse) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry, ok := s.db.idempotency[idempotencyKey{userID, key}]
+	if !ok {
+		return ErrNotFound
+	}
+	stored := *response
+	entry.response = &stored
+	return nil
+}
+
+func (s *memIdempotency) Fail(ctx context.Context, userID int, key string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if entry, ok := s.db.idempotency[idempotencyKey{userID, key}]; ok && entry.response == nil {
+		entry.failed = true
+	}
+	return nil
+}
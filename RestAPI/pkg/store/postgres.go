@@ -0,0 +1,1057 @@
+package store
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/vault"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// NewPostgres returns Stores backed by the given lib/pq connection pool.
+func NewPostgres(db *sql.DB) *Stores {
+	return &Stores{
+		Products:    &pgProducts{db: db},
+		Users:       &pgUsers{db: db},
+		CreditCards: &pgCreditCards{db: db},
+		Orders:      &pgOrders{db: db},
+		Carts:       &pgCarts{db: db},
+		Tokens:      &pgTokens{db: db},
+		Idempotency: &pgIdempotency{db: db},
+	}
+}
+
+// isUniqueViolation reports whether err is the postgres "unique_violation" error (SQLSTATE 23505).
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// notFound translates sql.ErrNoRows into ErrNotFound and leaves every other error untouched.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// checkAffected returns ErrNotFound when an UPDATE or DELETE did not touch any row.
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pgProducts struct {
+	db *sql.DB
+}
+
+const productColumns = "id, name, description, price, quantity, COALESCE(created_by, 0), COALESCE(updated_by, 0)"
+
+func scanProduct(row interface{ Scan(...interface{}) error }, p *models.Product) error {
+	return row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Quantity, &p.CreatedBy, &p.UpdatedBy)
+}
+
+// nullID stores the zero ID as NULL, so that foreign key columns may be left unset.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func (s *pgProducts) Create(ctx context.Context, product *models.Product) error {
+	query := `
+		INSERT INTO products (name, description, price, quantity, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, query, product.Name, product.Description, product.Price, product.Quantity,
+		nullID(product.CreatedBy), nullID(product.UpdatedBy)).Scan(&product.ID)
+}
+
+func (s *pgProducts) Get(ctx context.Context, id int) (*models.Product, error) {
+	query := "SELECT " + productColumns + " FROM products WHERE id = $1"
+	var p models.Product
+	if err := scanProduct(s.db.QueryRowContext(ctx, query, id), &p); err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+// List runs two queries: a count over the filtered rows and a keyset query that seeks past the cursor
+// using a row comparison on (sort column, id), which the (name, id) and (price, id) indexes can serve directly.
+func (s *pgProducts) List(ctx context.Context, q ProductQuery) (*ProductPage, error) {
+	if err := checkCursor(q); err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.MinPrice != nil {
+		where = append(where, "price >= "+arg(*q.MinPrice))
+	}
+	if q.MaxPrice != nil {
+		where = append(where, "price <= "+arg(*q.MaxPrice))
+	}
+	if q.NamePrefix != "" {
+		where = append(where, "name LIKE "+arg(escapeLike(q.NamePrefix)+"%"))
+	}
+
+	page := &ProductPage{Products: []models.Product{}}
+	countQuery := "SELECT count(*) FROM products" + whereClause(where)
+	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	column, direction, cmp := "id", "ASC", ">"
+	if q.Descending {
+		direction, cmp = "DESC", "<"
+	}
+	if c := q.Cursor; c != nil {
+		switch q.Sort {
+		case SortByName:
+			where = append(where, fmt.Sprintf("(name, id) %s (%s, %s)", cmp, arg(c.Name), arg(c.ID)))
+		case SortByPrice:
+			where = append(where, fmt.Sprintf("(price, id) %s (%s, %s)", cmp, arg(c.Price), arg(c.ID)))
+		default:
+			where = append(where, fmt.Sprintf("id %s %s", cmp, arg(c.ID)))
+		}
+	}
+	switch q.Sort {
+	case SortByName:
+		column = "name"
+	case SortByPrice:
+		column = "price"
+	}
+	orderBy := fmt.Sprintf(" ORDER BY %s %s", column, direction)
+	if column != "id" {
+		orderBy += ", id " + direction
+	}
+
+	// Fetch one row more than asked for to find out whether there is a next page.
+	query := "SELECT " + productColumns + " FROM products" + whereClause(where) + orderBy + " LIMIT " + arg(q.Limit+1)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Product
+		if err := scanProduct(rows, &p); err != nil {
+			return nil, err
+		}
+		page.Products = append(page.Products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Products) > q.Limit {
+		page.Products = page.Products[:q.Limit]
+		page.Next = cursorAfter(q, page.Products[q.Limit-1])
+	}
+	return page, nil
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// escapeLike escapes the LIKE wildcards in s so it only ever matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (s *pgProducts) Update(ctx context.Context, product *models.Product) error {
+	query := `
+		UPDATE products
+		SET name = $2, description = $3, price = $4, quantity = $5, updated_by = $6
+		WHERE id = $1
+	`
+	res, err := s.db.ExecContext(ctx, query, product.ID, product.Name, product.Description, product.Price, product.Quantity, nullID(product.UpdatedBy))
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+func (s *pgProducts) Delete(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM products WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+type pgUsers struct {
+	db *sql.DB
+}
+
+// Create inserts the user unless the email is already registered, in which case it returns ErrConflict.
+func (s *pgUsers) Create(ctx context.Context, user *models.User) error {
+	query := `
+		INSERT INTO users (username, email, password, roles)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE email = $2 OR username = $1)
+		RETURNING id
+	`
+	err := s.db.QueryRowContext(ctx, query, user.Username, user.Email, user.Password, pq.Array(user.Roles)).Scan(&user.ID)
+	if errors.Is(err, sql.ErrNoRows) || isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+const userColumns = "id, username, email, password, roles"
+
+func (s *pgUsers) Get(ctx context.Context, id int) (*models.User, error) {
+	return s.scanOne(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id)
+}
+
+func (s *pgUsers) GetByUsername(ctx context.Context, username string) (*models.User, error) {
+	return s.scanOne(ctx, "SELECT "+userColumns+" FROM users WHERE username = $1", username)
+}
+
+func (s *pgUsers) GrantRole(ctx context.Context, id int, role string) (*models.User, error) {
+	query := `
+		UPDATE users SET roles = array_append(roles, $2)
+		WHERE id = $1 AND NOT ($2 = ANY (roles))
+	`
+	if _, err := s.db.ExecContext(ctx, query, id, role); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *pgUsers) RevokeRole(ctx context.Context, id int, role string) (*models.User, error) {
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET roles = array_remove(roles, $2) WHERE id = $1", id, role); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *pgUsers) scanOne(ctx context.Context, query string, arg interface{}) (*models.User, error) {
+	var u models.User
+	if err := s.db.QueryRowContext(ctx, query, arg).Scan(&u.ID, &u.Username, &u.Email, &u.Password, pq.Array(&u.Roles)); err != nil {
+		return nil, notFound(err)
+	}
+	return &u, nil
+}
+
+type pgCreditCards struct {
+	db *sql.DB
+}
+
+const creditCardColumns = "id, user_id, token, brand, last4, is_default, expiry_month, expiry_year, name_on_card, key_id, wrapped_key, number_ciphertext, created_at"
+
+func scanCreditCard(row interface{ Scan(...interface{}) error }, c *models.CreditCard) error {
+	return row.Scan(&c.ID, &c.UserID, &c.Token, &c.Brand, &c.Last4, &c.Default, &c.ExpiryMonth, &c.ExpiryYear, &c.NameOnCard,
+		&c.Number.KeyID, &c.Number.WrappedKey, &c.Number.Ciphertext, &c.CreatedAt)
+}
+
+// lockCards serializes the changes to the cards of the user by locking the user row until the transaction ends,
+// so that two concurrent requests can not both decide which card is the default.
+func lockCards(ctx context.Context, tx *sql.Tx, userID int) error {
+	var id int
+	return notFound(tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&id))
+}
+
+func (s *pgCreditCards) Create(ctx context.Context, card *models.CreditCard) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockCards(ctx, tx, card.UserID); err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO credit_cards (user_id, token, brand, last4, is_default, expiry_month, expiry_year, name_on_card, key_id, wrapped_key, number_ciphertext)
+		VALUES ($1, $2, $3, $4, NOT EXISTS (SELECT 1 FROM credit_cards WHERE user_id = $1), $5, $6, $7, $8, $9, $10)
+		RETURNING id, is_default, created_at
+	`
+	err = tx.QueryRowContext(ctx, query, card.UserID, card.Token, card.Brand, card.Last4, card.ExpiryMonth, card.ExpiryYear, card.NameOnCard,
+		card.Number.KeyID, card.Number.WrappedKey, card.Number.Ciphertext).Scan(&card.ID, &card.Default, &card.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgCreditCards) Get(ctx context.Context, userID, id int) (*models.CreditCard, error) {
+	var card models.CreditCard
+	query := "SELECT " + creditCardColumns + " FROM credit_cards WHERE user_id = $1 AND id = $2"
+	if err := scanCreditCard(s.db.QueryRowContext(ctx, query, userID, id), &card); err != nil {
+		return nil, notFound(err)
+	}
+	return &card, nil
+}
+
+func (s *pgCreditCards) GetDefault(ctx context.Context, userID int) (*models.CreditCard, error) {
+	var card models.CreditCard
+	query := "SELECT " + creditCardColumns + " FROM credit_cards WHERE user_id = $1 AND is_default"
+	if err := scanCreditCard(s.db.QueryRowContext(ctx, query, userID), &card); err != nil {
+		return nil, notFound(err)
+	}
+	return &card, nil
+}
+
+func (s *pgCreditCards) ListByUser(ctx context.Context, userID int) ([]models.CreditCard, error) {
+	return s.list(ctx, "SELECT "+creditCardColumns+" FROM credit_cards WHERE user_id = $1 ORDER BY is_default DESC, id DESC", userID)
+}
+
+func (s *pgCreditCards) list(ctx context.Context, query string, args ...interface{}) ([]models.CreditCard, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []models.CreditCard{}
+	for rows.Next() {
+		var card models.CreditCard
+		if err := scanCreditCard(rows, &card); err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+func (s *pgCreditCards) Update(ctx context.Context, card *models.CreditCard) error {
+	query := `
+		UPDATE credit_cards SET expiry_month = $3, expiry_year = $4, name_on_card = $5
+		WHERE user_id = $1 AND id = $2
+		RETURNING ` + creditCardColumns
+	row := s.db.QueryRowContext(ctx, query, card.UserID, card.ID, card.ExpiryMonth, card.ExpiryYear, card.NameOnCard)
+	return notFound(scanCreditCard(row, card))
+}
+
+// SetDefault clears the old default before setting the new one, the unique index allows only one default per user
+// at any moment, also within a statement.
+func (s *pgCreditCards) SetDefault(ctx context.Context, userID, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockCards(ctx, tx, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE credit_cards SET is_default = false WHERE user_id = $1 AND is_default AND id <> $2", userID, id); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE credit_cards SET is_default = true WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgCreditCards) Delete(ctx context.Context, userID, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockCards(ctx, tx, userID); err != nil {
+		return err
+	}
+	var wasDefault bool
+	err = tx.QueryRowContext(ctx, "DELETE FROM credit_cards WHERE user_id = $1 AND id = $2 RETURNING is_default", userID, id).Scan(&wasDefault)
+	if err != nil {
+		return notFound(err)
+	}
+	if wasDefault {
+		query := `
+			UPDATE credit_cards SET is_default = true
+			WHERE id = (SELECT id FROM credit_cards WHERE user_id = $1 ORDER BY id DESC LIMIT 1)
+		`
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *pgCreditCards) GetByToken(ctx context.Context, token string) (*models.CreditCard, error) {
+	var card models.CreditCard
+	if err := scanCreditCard(s.db.QueryRowContext(ctx, "SELECT "+creditCardColumns+" FROM credit_cards WHERE token = $1", token), &card); err != nil {
+		return nil, notFound(err)
+	}
+	return &card, nil
+}
+
+func (s *pgCreditCards) ListNotWrappedBy(ctx context.Context, keyID string) ([]models.CreditCard, error) {
+	return s.list(ctx, "SELECT "+creditCardColumns+" FROM credit_cards WHERE key_id <> $1 ORDER BY id", keyID)
+}
+
+func (s *pgCreditCards) SetNumber(ctx context.Context, id int, number vault.Sealed) error {
+	query := "UPDATE credit_cards SET key_id = $2, wrapped_key = $3, number_ciphertext = $4 WHERE id = $1"
+	res, err := s.db.ExecContext(ctx, query, id, number.KeyID, number.WrappedKey, number.Ciphertext)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+type pgOrders struct {
+	db *sql.DB
+}
+
+// Create locks the ordered product rows in ascending ID order, so that two orders sharing products
+// can not deadlock, and holds the locks until the order is committed. A concurrent order for the same
+// product waits and then sees the decremented quantity.
+func (s *pgOrders) Create(ctx context.Context, order *models.Order) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createOrder(ctx, tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createOrder does the work of Create inside the transaction tx.
+func createOrder(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+	byProduct := make(map[int]*models.OrderItem, len(order.Items))
+	for i := range order.Items {
+		byProduct[order.Items[i].ProductID] = &order.Items[i]
+	}
+	for _, id := range sortedProductIDs(order.Items) {
+		item := byProduct[id]
+		var available int
+		err := tx.QueryRowContext(ctx, "SELECT name, price, quantity FROM products WHERE id = $1 FOR UPDATE", id).
+			Scan(&item.Name, &item.UnitPrice, &available)
+		if err != nil {
+			return notFound(err)
+		}
+		if available < item.Quantity {
+			return &OutOfStockError{ProductID: id, Available: available}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE products SET quantity = quantity - $2 WHERE id = $1", id, item.Quantity); err != nil {
+			return err
+		}
+	}
+
+	order.Status = models.OrderPendingPayment
+	order.Total = orderTotal(order.Items)
+	query := "INSERT INTO orders (user_id, status, total) VALUES ($1, $2, $3) RETURNING id, created_at"
+	if err := tx.QueryRowContext(ctx, query, order.UserID, order.Status, order.Total).Scan(&order.ID, &order.CreatedAt); err != nil {
+		return err
+	}
+	if err := insertOrderEvent(ctx, tx, order.ID, "", order.Status, order.UserID); err != nil {
+		return err
+	}
+	for i := range order.Items {
+		item := &order.Items[i]
+		query := `
+			INSERT INTO order_items (order_id, product_id, name, unit_price, quantity)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`
+		if err := tx.QueryRowContext(ctx, query, order.ID, item.ProductID, item.Name, item.UnitPrice, item.Quantity).Scan(&item.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transition locks the order row, so that two concurrent transitions of the same order are checked one
+// after the other against the status the previous one left behind.
+func (s *pgOrders) Transition(ctx context.Context, id int, to string, actorID int) (*models.Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var o models.Order
+	row := tx.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1 FOR UPDATE", id)
+	if err := scanOrder(row, &o); err != nil {
+		return nil, notFound(err)
+	}
+	if !models.CanTransition(o.Status, to) {
+		return nil, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, o.Status, to)
+	}
+
+	query := "UPDATE orders SET status = $2, refund_pending = refund_pending OR $3 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, query, id, to, models.OwesRefund(o.Status, to, o.PaymentID)); err != nil {
+		return nil, err
+	}
+	if err := insertOrderEvent(ctx, tx, id, o.Status, to, actorID); err != nil {
+		return nil, err
+	}
+	if to == models.OrderCancelled {
+		// Deleted products have no stock to return to.
+		query := `
+			UPDATE products p SET quantity = p.quantity + i.quantity
+			FROM order_items i
+			WHERE i.order_id = $1 AND p.id = i.product_id
+		`
+		if _, err := tx.ExecContext(ctx, query, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func insertOrderEvent(ctx context.Context, tx *sql.Tx, orderID int, from, to string, actorID int) error {
+	var fromStatus interface{}
+	if from != "" {
+		fromStatus = from
+	}
+	query := "INSERT INTO order_events (order_id, from_status, to_status, actor_id) VALUES ($1, $2, $3, $4)"
+	_, err := tx.ExecContext(ctx, query, orderID, fromStatus, to, nullID(actorID))
+	return err
+}
+
+func (s *pgOrders) Events(ctx context.Context, orderID int) ([]models.OrderEvent, error) {
+	query := `
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, COALESCE(actor_id, 0), created_at
+		FROM order_events WHERE order_id = $1
+		ORDER BY id
+	`
+	rows, err := s.db.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.OrderEvent{}
+	for rows.Next() {
+		var e models.OrderEvent
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.From, &e.To, &e.ActorID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+const orderColumns = "id, user_id, status, total, COALESCE(payment_id, ''), refund_pending, created_at"
+
+func scanOrder(row interface{ Scan(...interface{}) error }, o *models.Order) error {
+	return row.Scan(&o.ID, &o.UserID, &o.Status, &o.Total, &o.PaymentID, &o.RefundPending, &o.CreatedAt)
+}
+
+// MarkPaid locks the order row like Transition, so that a concurrent payment or cancellation of the same
+// order waits and then sees it paid.
+func (s *pgOrders) MarkPaid(ctx context.Context, id int, paymentID string, actorID int) (*models.Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", id).Scan(&status); err != nil {
+		return nil, notFound(err)
+	}
+	if status != models.OrderPendingPayment {
+		return nil, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, status, models.OrderPaid)
+	}
+
+	query := "UPDATE orders SET status = $2, payment_id = $3 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, query, id, models.OrderPaid, paymentID); err != nil {
+		return nil, err
+	}
+	if err := insertOrderEvent(ctx, tx, id, status, models.OrderPaid, actorID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *pgOrders) SetRefunded(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE orders SET refund_pending = false WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+func (s *pgOrders) ListRefundPending(ctx context.Context) ([]models.Order, error) {
+	return s.list(ctx, "SELECT "+orderColumns+" FROM orders WHERE refund_pending ORDER BY id")
+}
+
+func (s *pgOrders) ListPendingPayment(ctx context.Context, placedBefore time.Time) ([]models.Order, error) {
+	query := "SELECT " + orderColumns + " FROM orders WHERE status = $1 AND created_at < $2 ORDER BY id"
+	return s.list(ctx, query, models.OrderPendingPayment, placedBefore)
+}
+
+func (s *pgOrders) Get(ctx context.Context, id int) (*models.Order, error) {
+	var o models.Order
+	if err := scanOrder(s.db.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1", id), &o); err != nil {
+		return nil, notFound(err)
+	}
+	orders := []models.Order{o}
+	if err := s.loadItems(ctx, orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+func (s *pgOrders) ListByUser(ctx context.Context, userID int) ([]models.Order, error) {
+	return s.list(ctx, "SELECT "+orderColumns+" FROM orders WHERE user_id = $1 ORDER BY id DESC", userID)
+}
+
+// list returns the orders the query selects, with their items.
+func (s *pgOrders) list(ctx context.Context, query string, args ...interface{}) ([]models.Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []models.Order{}
+	for rows.Next() {
+		var o models.Order
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.loadItems(ctx, orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// loadItems fills in the items of the given orders with a single query.
+func (s *pgOrders) loadItems(ctx context.Context, orders []models.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Order, len(orders))
+	ids := make([]int64, len(orders))
+	for i := range orders {
+		orders[i].Items = []models.OrderItem{}
+		index[orders[i].ID] = &orders[i]
+		ids[i] = int64(orders[i].ID)
+	}
+
+	query := `
+		SELECT order_id, id, COALESCE(product_id, 0), name, unit_price, quantity
+		FROM order_items WHERE order_id = ANY($1)
+		ORDER BY id
+	`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderID int
+		var item models.OrderItem
+		if err := rows.Scan(&orderID, &item.ID, &item.ProductID, &item.Name, &item.UnitPrice, &item.Quantity); err != nil {
+			return err
+		}
+		o := index[orderID]
+		o.Items = append(o.Items, item)
+	}
+	return rows.Err()
+}
+
+type pgCarts struct {
+	db *sql.DB
+}
+
+// cartCondition returns the condition on the carts table selecting the cart of the key, and its argument.
+func cartCondition(key CartKey) (string, interface{}) {
+	if key.UserID != 0 {
+		return "user_id = $1", key.UserID
+	}
+	return "token_hash = $1", key.TokenHash
+}
+
+func (s *pgCarts) Get(ctx context.Context, key CartKey) (*models.Cart, error) {
+	condition, arg := cartCondition(key)
+	query := `
+		SELECT i.product_id, p.name, p.price, i.quantity, p.quantity
+		FROM cart_items i
+		JOIN products p ON p.id = i.product_id
+		WHERE i.cart_id = (SELECT id FROM carts WHERE ` + condition + `)
+		ORDER BY i.added_at, i.product_id
+	`
+	rows, err := s.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []models.CartItem{}
+	for rows.Next() {
+		var item models.CartItem
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.UnitPrice, &item.Quantity, &item.InStock); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newCart(items), nil
+}
+
+// cartID returns the ID of the cart of the key, creating the cart if it does not exist yet.
+// Creating an anonymous cart also deletes the anonymous carts that were abandoned for AnonymousCartTTL.
+func cartID(ctx context.Context, db execQueryRower, key CartKey) (int, error) {
+	column, arg := "user_id", interface{}(key.UserID)
+	if key.UserID == 0 {
+		column, arg = "token_hash", key.TokenHash
+	}
+	query := `
+		INSERT INTO carts (` + column + `) VALUES ($1)
+		ON CONFLICT (` + column + `) DO UPDATE SET updated_at = now()
+		RETURNING id, xmax = 0
+	`
+	// xmax is 0 for a freshly inserted row and set for a row that was updated on conflict.
+	var id int
+	var created bool
+	if err := db.QueryRowContext(ctx, query, arg).Scan(&id, &created); err != nil {
+		return 0, err
+	}
+	if created && key.UserID == 0 {
+		purge := "DELETE FROM carts WHERE user_id IS NULL AND updated_at < $1"
+		if _, err := db.ExecContext(ctx, purge, time.Now().Add(-AnonymousCartTTL)); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// putItem inserts the product into the cart, or updates the quantity of an existing item with
+// the expression given in onConflict.
+func (s *pgCarts) putItem(ctx context.Context, key CartKey, productID, quantity int, onConflict string) error {
+	id, err := cartID(ctx, s.db, key)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO cart_items (cart_id, product_id, quantity)
+		SELECT $1, id, $3 FROM products WHERE id = $2
+		ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = ` + onConflict
+	res, err := s.db.ExecContext(ctx, query, id, productID, quantity)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+func (s *pgCarts) AddItem(ctx context.Context, key CartKey, productID, quantity int) error {
+	return s.putItem(ctx, key, productID, quantity, "cart_items.quantity + EXCLUDED.quantity")
+}
+
+func (s *pgCarts) SetItem(ctx context.Context, key CartKey, productID, quantity int) error {
+	if quantity > 0 {
+		return s.putItem(ctx, key, productID, quantity, "EXCLUDED.quantity")
+	}
+	condition, arg := cartCondition(key)
+	query := "DELETE FROM cart_items WHERE product_id = $2 AND cart_id = (SELECT id FROM carts WHERE " + condition + ")"
+	_, err := s.db.ExecContext(ctx, query, arg, productID)
+	return err
+}
+
+func (s *pgCarts) Clear(ctx context.Context, key CartKey) error {
+	condition, arg := cartCondition(key)
+	_, err := s.db.ExecContext(ctx, "DELETE FROM cart_items WHERE cart_id = (SELECT id FROM carts WHERE "+condition+")", arg)
+	return err
+}
+
+func (s *pgCarts) Merge(ctx context.Context, tokenHash string, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var anonymous int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM carts WHERE token_hash = $1 FOR UPDATE", tokenHash).Scan(&anonymous)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id, err := cartID(ctx, tx, CartKey{UserID: userID})
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO cart_items (cart_id, product_id, quantity, added_at)
+		SELECT $1, product_id, quantity, added_at FROM cart_items WHERE cart_id = $2
+		ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
+	`
+	if _, err := tx.ExecContext(ctx, query, id, anonymous); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM carts WHERE id = $1", anonymous); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Checkout locks the cart of the user, so that items added while the order is placed either make it
+// into the order or stay in the cart afterwards.
+func (s *pgCarts) Checkout(ctx context.Context, userID int) (*models.Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM carts WHERE user_id = $1 FOR UPDATE", userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEmptyCart
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT product_id, quantity FROM cart_items WHERE cart_id = $1 ORDER BY added_at, product_id", id)
+	if err != nil {
+		return nil, err
+	}
+	order := &models.Order{UserID: userID}
+	for rows.Next() {
+		var item models.OrderItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		order.Items = append(order.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(order.Items) == 0 {
+		return nil, ErrEmptyCart
+	}
+
+	if err := createOrder(ctx, tx, order); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM cart_items WHERE cart_id = $1", id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+type pgTokens struct {
+	db *sql.DB
+}
+
+func (s *pgTokens) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	return insertRefreshToken(ctx, s.db, token)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// execQueryRower is implemented by both *sql.DB and *sql.Tx.
+type execQueryRower interface {
+	queryRower
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertRefreshToken(ctx context.Context, db queryRower, token *models.RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	return db.QueryRowContext(ctx, query, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt).Scan(&token.ID)
+}
+
+// RotateRefreshToken locks the presented token row, so that two concurrent refreshes with the same
+// token cannot both succeed: the second one waits, then sees used_at set and revokes the family.
+func (s *pgTokens) RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current models.RefreshToken
+	query := `
+		SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens WHERE token_hash = $1
+		FOR UPDATE
+	`
+	err = tx.QueryRowContext(ctx, query, hash).Scan(&current.ID, &current.UserID, &current.FamilyID, &current.ExpiresAt, &current.UsedAt, &current.RevokedAt)
+	if err != nil {
+		return notFound(err)
+	}
+
+	if current.UsedAt != nil || current.RevokedAt != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", current.FamilyID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrTokenReused
+	}
+	if !current.ExpiresAt.After(time.Now()) {
+		return ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", current.ID); err != nil {
+		return err
+	}
+	next.UserID, next.FamilyID = current.UserID, current.FamilyID
+	if err := insertRefreshToken(ctx, tx, next); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgTokens) RevokeRefreshFamily(ctx context.Context, hash string) error {
+	query := `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE revoked_at IS NULL
+		AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)
+	`
+	_, err := s.db.ExecContext(ctx, query, hash)
+	return err
+}
+
+// DenyAccessToken also purges denylist entries whose tokens have expired by now, which keeps the table small.
+func (s *pgTokens) DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < now()"); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING", jti, expiresAt)
+	return err
+}
+
+func (s *pgTokens) IsAccessTokenDenied(ctx context.Context, jti string) (bool, error) {
+	var denied bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)", jti).Scan(&denied)
+	return denied, err
+}
+
+type pgIdempotency struct {
+	db *sql.DB
+}
+
+// Claim relies on the primary key of idempotency_keys: of several concurrent requests with the same key
+// exactly one inserts the row, all others find it. Expired keys are purged first, like the token denylist.
+func (s *pgIdempotency) Claim(ctx context.Context, userID int, key, requestHash string) (*models.StoredResponse, error) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()"); err != nil {
+		return nil, err
+	}
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO NOTHING
+	`
+	res, err := s.db.ExecContext(ctx, query, userID, key, requestHash, time.Now().Add(IdempotencyKeyTTL))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+
+	var (
+		storedHash string
+		failed     bool
+		status     sql.NullInt64
+		header     []byte
+		response   models.StoredResponse
+	)
+	query = "SELECT request_hash, failed, status_code, header, body FROM idempotency_keys WHERE user_id = $1 AND key = $2"
+	err = s.db.QueryRowContext(ctx, query, userID, key).Scan(&storedHash, &failed, &status, &header, &response.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The key expired and was deleted between the insert and the select.
+		return nil, ErrKeyInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, ErrKeyMismatch
+	}
+	if failed {
+		return nil, ErrKeyFailed
+	}
+	if !status.Valid {
+		return nil, ErrKeyInProgress
+	}
+	response.StatusCode = int(status.Int64)
+	if err := json.Unmarshal(header, &response.Header); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (s *pgIdempotency) Complete(ctx context.Context, userID int, key string, response *models.StoredResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE idempotency_keys SET status_code = $3, header = $4, body = $5
+		WHERE user_id = $1 AND key = $2
+	`
+	res, err := s.db.ExecContext(ctx, query, userID, key, response.StatusCode, header, response.Body)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+func (s *pgIdempotency) Fail(ctx context.Context, userID int, key string) error {
+	query := "UPDATE idempotency_keys SET failed = true WHERE user_id = $1 AND key = $2 AND status_code IS NULL"
+	_, err := s.db.ExecContext(ctx, query, userID, key)
+	return err
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/vault"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned by every store when the requested row does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a write would violate a uniqueness rule,
+// for example signing up with an email that is already registered.
+var ErrConflict = errors.New("conflict")
+
+// ErrTokenReused is returned by TokenStore.RotateRefreshToken when the presented refresh token was
+// already exchanged or revoked. The store has revoked the whole token family by the time it returns it.
+var ErrTokenReused = errors.New("refresh token reused")
+
+// ErrOutOfStock is returned by OrderStore.Create when fewer units of a product are in stock than ordered.
+// It is wrapped in an *OutOfStockError naming the product.
+var ErrOutOfStock = errors.New("out of stock")
+
+// OutOfStockError tells which product of an order could not be supplied.
+type OutOfStockError struct {
+	ProductID int
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("product %d: only %d left in stock", e.ProductID, e.Available)
+}
+
+func (e *OutOfStockError) Unwrap() error { return ErrOutOfStock }
+
+// ErrInvalidTransition is returned by OrderStore.Transition when the order can not move from its
+// current status to the requested one.
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// ErrEmptyCart is returned by CartStore.Checkout when there is nothing in the cart.
+var ErrEmptyCart = errors.New("cart is empty")
+
+// ErrKeyInProgress is returned by IdempotencyStore.Claim while the request that first used the key is still being processed.
+var ErrKeyInProgress = errors.New("idempotency key in use by a request in progress")
+
+// ErrKeyMismatch is returned by IdempotencyStore.Claim when the key was first used for a different request.
+var ErrKeyMismatch = errors.New("idempotency key used for a different request")
+
+// ErrKeyFailed is returned by IdempotencyStore.Claim when the request that first used the key ended without
+// a response that could be stored, so whether it changed anything is unknown.
+var ErrKeyFailed = errors.New("idempotency key used by a request that failed")
+
+// IdempotencyKeyTTL is how long the response to a request with an Idempotency-Key is kept for retries.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// AnonymousCartTTL is how long an anonymous cart is kept after it was last changed.
+const AnonymousCartTTL = 30 * 24 * time.Hour
+
+// ErrInvalidCursor is returned by DecodeCursor and List when a pagination cursor is malformed
+// or was issued for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Sort orders accepted by ProductQuery.Sort.
+const (
+	SortByID    = "id"
+	SortByName  = "name"
+	SortByPrice = "price"
+)
+
+// ProductQuery selects one page of products.
+// MinPrice, MaxPrice and NamePrefix filter the result and are ignored when left at their zero value.
+// Products are ordered by Sort (one of the SortBy constants) with the ID as tie breaker, so that
+// every row has a unique position and keyset pagination never skips or repeats a product.
+type ProductQuery struct {
+	Limit      int
+	Cursor     *Cursor
+	MinPrice   *float64
+	MaxPrice   *float64
+	NamePrefix string
+	Sort       string
+	Descending bool
+}
+
+// ProductPage is one page of a product listing.
+// Next is nil on the last page; Total is the number of products matching the filters across all pages.
+type ProductPage struct {
+	Products []models.Product
+	Next     *Cursor
+	Total    int
+}
+
+// Cursor is the position of the last product of a page, in the sort order the page was requested with.
+type Cursor struct {
+	Sort       string  `json:"s"`
+	Descending bool    `json:"d,omitempty"`
+	ID         int     `json:"id"`
+	Name       string  `json:"n,omitempty"`
+	Price      float64 `json:"p,omitempty"`
+}
+
+// cursorAfter returns the cursor pointing just past the given product.
+func cursorAfter(q ProductQuery, p models.Product) *Cursor {
+	c := &Cursor{Sort: q.Sort, Descending: q.Descending, ID: p.ID}
+	switch q.Sort {
+	case SortByName:
+		c.Name = p.Name
+	case SortByPrice:
+		c.Price = p.Price
+	}
+	return c
+}
+
+// Encode returns the opaque string handed to clients as next_cursor.
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a string produced by Cursor.Encode.
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// checkCursor makes sure the cursor of q was issued for the same ordering as q itself.
+func checkCursor(q ProductQuery) error {
+	if q.Cursor != nil && (q.Cursor.Sort != q.Sort || q.Cursor.Descending != q.Descending) {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// ProductStore is the persistence contract for the products table.
+// Create and Update write back the stored values (including the generated ID) into the given product.
+type ProductStore interface {
+	Create(ctx context.Context, product *models.Product) error
+	Get(ctx context.Context, id int) (*models.Product, error)
+	List(ctx context.Context, query ProductQuery) (*ProductPage, error)
+	Update(ctx context.Context, product *models.Product) error
+	Delete(ctx context.Context, id int) error
+}
+
+// UserStore is the persistence contract for the users table.
+// Create returns ErrConflict if the email or the username is already taken.
+// GrantRole and RevokeRole are idempotent and return the user with its updated roles.
+type UserStore interface {
+	Create(ctx context.Context, user *models.User) error
+	Get(ctx context.Context, id int) (*models.User, error)
+	GetByUsername(ctx context.Context, username string) (*models.User, error)
+	GrantRole(ctx context.Context, id int, role string) (*models.User, error)
+	RevokeRole(ctx context.Context, id int, role string) (*models.User, error)
+}
+
+// CreditCardStore is the persistence contract for the credit_cards table.
+// Every method but GetByToken and the ones used for key rotation takes the ID of the user the card must belong to,
+// and the cards of other users are as unknown to it as cards that do not exist, yielding ErrNotFound.
+// A user has at most one default card. The first card of a user becomes the default.
+type CreditCardStore interface {
+	// Create stores the card and fills in its ID, Default and CreatedAt. A token that is already taken yields ErrConflict.
+	Create(ctx context.Context, card *models.CreditCard) error
+	// Get returns the card of the user.
+	Get(ctx context.Context, userID, id int) (*models.CreditCard, error)
+	// GetDefault returns the default card of the user, or ErrNotFound if the user has no cards.
+	GetDefault(ctx context.Context, userID int) (*models.CreditCard, error)
+	// GetByToken returns the card with the token, including its sealed number.
+	GetByToken(ctx context.Context, token string) (*models.CreditCard, error)
+	// ListByUser returns the cards of the user, the default card first and the others newest first.
+	ListByUser(ctx context.Context, userID int) ([]models.CreditCard, error)
+	// Update replaces the expiry and the name of the card card.ID of card.UserID and fills in the rest of the stored card.
+	Update(ctx context.Context, card *models.CreditCard) error
+	// SetDefault makes the card the default card of the user instead of the previous one.
+	SetDefault(ctx context.Context, userID, id int) error
+	// Delete removes the card of the user. When it was the default card the newest remaining card becomes the default.
+	Delete(ctx context.Context, userID, id int) error
+	// ListNotWrappedBy returns the cards whose number has its data key wrapped by another master key than keyID.
+	ListNotWrappedBy(ctx context.Context, keyID string) ([]models.CreditCard, error)
+	// SetNumber replaces the sealed number of the card, after it was rewrapped with another master key.
+	SetNumber(ctx context.Context, id int, number vault.Sealed) error
+}
+
+// OrderStore is the persistence contract for the orders and order_items tables.
+type OrderStore interface {
+	// Create places the order for order.UserID. Only ProductID and Quantity of the items are read,
+	// every item must name a different product. In one transaction the store takes the quantities out of
+	// stock, copies the current name and price of each product into its item and computes the total, then
+	// fills in the stored order, which starts out as pending_payment with one event recording its placement. Concurrent orders can never take more units than there are: if a product has
+	// fewer units in stock than ordered nothing is changed and an error wrapping ErrOutOfStock is returned.
+	// An unknown product yields ErrNotFound.
+	Create(ctx context.Context, order *models.Order) error
+	// Get returns the order with its items.
+	Get(ctx context.Context, id int) (*models.Order, error)
+	// ListByUser returns the orders of the user with their items, newest first.
+	ListByUser(ctx context.Context, userID int) ([]models.Order, error)
+	// Transition moves the order to the status to on behalf of the actor and records the change as an event.
+	// The current status is checked against models.CanTransition while the order is locked, an illegal move
+	// yields an error wrapping ErrInvalidTransition. Cancelling an order puts its items back in stock.
+	// When the move owes the customer a refund, see models.OwesRefund, the order is marked RefundPending
+	// in the same step, so the refund is never lost even when paying it back fails.
+	Transition(ctx context.Context, id int, to string, actorID int) (*models.Order, error)
+	// SetRefunded clears RefundPending once the payment of the order was paid back.
+	SetRefunded(ctx context.Context, id int) error
+	// ListRefundPending returns the orders marked RefundPending, oldest first.
+	ListRefundPending(ctx context.Context) ([]models.Order, error)
+	// ListPendingPayment returns the orders still awaiting payment that were placed before the given time, oldest first.
+	ListPendingPayment(ctx context.Context, placedBefore time.Time) ([]models.Order, error)
+	// MarkPaid records the ID of the payment at the payment provider the order is paid with and moves the order
+	// to paid on behalf of the actor, in one step while the order is locked. An order that is not pending_payment
+	// any more is left unchanged and yields an error wrapping ErrInvalidTransition, so of two concurrent payments
+	// only one is recorded.
+	MarkPaid(ctx context.Context, id int, paymentID string, actorID int) (*models.Order, error)
+	// Events returns the status history of the order, oldest first.
+	Events(ctx context.Context, orderID int) ([]models.OrderEvent, error)
+}
+
+// CartKey identifies a cart: the cart of the user with UserID, or when UserID is 0
+// the anonymous cart whose cookie token hashes to TokenHash.
+type CartKey struct {
+	UserID    int
+	TokenHash string
+}
+
+// CartStore is the persistence contract for the carts and cart_items tables.
+// Carts are created on demand by the first item put into them.
+type CartStore interface {
+	// Get returns the cart with the current name, price and stock of every product, in the order
+	// the products were added. A cart that does not exist yet is returned empty.
+	Get(ctx context.Context, key CartKey) (*models.Cart, error)
+	// AddItem adds quantity units of the product to the cart, on top of any already in it.
+	// An unknown product yields ErrNotFound.
+	AddItem(ctx context.Context, key CartKey, productID, quantity int) error
+	// SetItem sets the quantity of the product in the cart. Setting it to 0 removes the product,
+	// and is not an error if it was not in the cart. Adding an unknown product yields ErrNotFound.
+	SetItem(ctx context.Context, key CartKey, productID, quantity int) error
+	// Clear removes every item from the cart.
+	Clear(ctx context.Context, key CartKey) error
+	// Merge moves the items of the anonymous cart with the token hash into the cart of the user, adding up the
+	// quantities of products that are in both, and deletes the anonymous cart. An unknown token is ignored.
+	Merge(ctx context.Context, tokenHash string, userID int) error
+	// Checkout places an order for everything in the cart of the user and empties the cart in the same
+	// transaction, with the same guarantees and errors as OrderStore.Create. An empty cart yields ErrEmptyCart.
+	Checkout(ctx context.Context, userID int) (*models.Order, error)
+}
+
+// TokenStore persists refresh tokens and the denylist of revoked access token IDs.
+type TokenStore interface {
+	// CreateRefreshToken stores a new refresh token and fills in its ID.
+	CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	// RotateRefreshToken marks the unexpired token with the given hash as used and stores next in the same family
+	// for the same user. An unknown or expired token yields ErrNotFound, a used or revoked one ErrTokenReused.
+	RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken) error
+	// RevokeRefreshFamily revokes every token in the family of the token with the given hash.
+	RevokeRefreshFamily(ctx context.Context, hash string) error
+	// DenyAccessToken adds an access token ID to the denylist until the token would have expired anyway.
+	DenyAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// IsAccessTokenDenied reports whether the access token ID is on the denylist.
+	IsAccessTokenDenied(ctx context.Context, jti string) (bool, error)
+}
+
+// IdempotencyStore remembers the responses to requests sent with an Idempotency-Key header.
+// Keys are scoped to a user, two users can use the same key without interfering.
+type IdempotencyStore interface {
+	// Claim reserves the key of the user for the request whose method, path and body hash to requestHash.
+	// It returns nil when the caller now holds the key, and must process the request and then call Complete or Fail.
+	// When the key was used before, the stored response is returned instead, or ErrKeyInProgress while the
+	// first request has not completed yet, ErrKeyFailed when it failed and ErrKeyMismatch when the key was used
+	// for a different request. Keys are forgotten IdempotencyKeyTTL after they were claimed, never earlier.
+	Claim(ctx context.Context, userID int, key, requestHash string) (*models.StoredResponse, error)
+	// Complete stores the response to the request holding the key.
+	Complete(ctx context.Context, userID int, key string, response *models.StoredResponse) error
+	// Fail records that the request holding the key ended without a response that could be stored. The request
+	// may have changed something before, so the key is not given up: Claim returns ErrKeyFailed for it until it expires.
+	Fail(ctx context.Context, userID int, key string) error
+}
+
+// Stores groups one implementation of every store so it can be handed to the api package in one piece.
+type Stores struct {
+	Products    ProductStore
+	Users       UserStore
+	CreditCards CreditCardStore
+	Orders      OrderStore
+	Carts       CartStore
+	Tokens      TokenStore
+	Idempotency IdempotencyStore
+}
+
+// sortedProductIDs returns the product IDs of the items in ascending order,
+// the order in which stores lock products while placing an order.
+func sortedProductIDs(items []models.OrderItem) []int {
+	ids := make([]int, len(items))
+	for i, item := range items {
+		ids[i] = item.ProductID
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// orderTotal sums up the items, rounded to cents like the NUMERIC column it is stored in.
+func orderTotal(items []models.OrderItem) float64 {
+	var total float64
+	for _, item := range items {
+		total += item.UnitPrice * float64(item.Quantity)
+	}
+	return math.Round(total*100) / 100
+}
+
+// newCart computes the totals of a cart from its items.
+func newCart(items []models.CartItem) *models.Cart {
+	cart := &models.Cart{Items: items, Available: true}
+	var total float64
+	for i := range items {
+		item := &cart.Items[i]
+		item.Subtotal = math.Round(item.UnitPrice*float64(item.Quantity)*100) / 100
+		total += item.UnitPrice * float64(item.Quantity)
+		if item.Quantity > item.InStock {
+			cart.Available = false
+		}
+	}
+	cart.Total = math.Round(total*100) / 100
+	return cart
+}
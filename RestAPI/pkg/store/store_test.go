@@ -0,0 +1,486 @@
+package store
+
+import (
+	"RestAPI/pkg/migrate"
+	"RestAPI/pkg/models"
+	"RestAPI/pkg/vault"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// contractStores returns the implementations every store test runs against: always the in-memory stores, and
+// additionally Postgres when TEST_DATABASE_URL points at a scratch database the test may migrate and write to.
+func contractStores(t *testing.T) map[string]*Stores {
+	stores := map[string]*Stores{"memory": NewMemory()}
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		return stores
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stores["postgres"] = NewPostgres(db)
+	return stores
+}
+
+// unique returns name made unique for this run, since the Postgres database outlives the test.
+func unique(name string) string {
+	return fmt.Sprintf("%s_%d", name, time.Now().UnixNano())
+}
+
+// TestStores runs the same cases against every implementation, so that they keep behaving alike.
+func TestStores(t *testing.T) {
+	for name, stores := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Run("products", func(t *testing.T) { testProducts(t, stores) })
+			t.Run("users", func(t *testing.T) { testUsers(t, stores) })
+			t.Run("credit cards", func(t *testing.T) { testCreditCards(t, stores) })
+			t.Run("orders", func(t *testing.T) { testOrders(t, stores) })
+			t.Run("refresh tokens", func(t *testing.T) { testRefreshTokens(t, stores) })
+		})
+	}
+}
+
+func newUser(t *testing.T, stores *Stores, name string) *models.User {
+	t.Helper()
+	name = unique(name)
+	user := &models.User{Username: name, Email: name + "@example.com", Password: "hash", Roles: []string{models.RoleCustomer}}
+	if err := stores.Users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func newProduct(t *testing.T, stores *Stores, price float64, quantity int) *models.Product {
+	t.Helper()
+	product := &models.Product{Name: unique("product"), Price: price, Quantity: quantity}
+	if err := stores.Products.Create(context.Background(), product); err != nil {
+		t.Fatal(err)
+	}
+	return product
+}
+
+func testProducts(t *testing.T, stores *Stores) {
+	ctx := context.Background()
+	product := newProduct(t, stores, 9.99, 3)
+	if product.ID == 0 {
+		t.Fatal("Create did not fill in the ID")
+	}
+
+	product.Description, product.Quantity = "Updated", 7
+	if err := stores.Products.Update(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	got, err := stores.Products.Get(ctx, product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != product.Name || got.Description != "Updated" || got.Price != 9.99 || got.Quantity != 7 {
+		t.Errorf("got %+v after updating to %+v", got, product)
+	}
+
+	if err := stores.Products.Delete(ctx, product.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Products.Get(ctx, product.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted product: %v, want ErrNotFound", err)
+	}
+	if err := stores.Products.Update(ctx, product); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update of a deleted product: %v, want ErrNotFound", err)
+	}
+	if err := stores.Products.Delete(ctx, product.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a deleted product: %v, want ErrNotFound", err)
+	}
+}
+
+func testUsers(t *testing.T, stores *Stores) {
+	ctx := context.Background()
+	user := newUser(t, stores, "user")
+
+	got, err := stores.Users.GetByUsername(ctx, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || got.Email != user.Email || !got.HasRole(models.RoleCustomer) {
+		t.Errorf("got %+v, want %+v", got, user)
+	}
+	if _, err := stores.Users.GetByUsername(ctx, unique("nobody")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByUsername of an unknown user: %v, want ErrNotFound", err)
+	}
+	if _, err := stores.Users.Get(ctx, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an unknown user: %v, want ErrNotFound", err)
+	}
+
+	taken := &models.User{Username: unique("other"), Email: user.Email, Password: "hash", Roles: []string{models.RoleCustomer}}
+	if err := stores.Users.Create(ctx, taken); !errors.Is(err, ErrConflict) {
+		t.Errorf("Create with a taken email: %v, want ErrConflict", err)
+	}
+	taken = &models.User{Username: user.Username, Email: unique("other") + "@example.com", Password: "hash", Roles: []string{models.RoleCustomer}}
+	if err := stores.Users.Create(ctx, taken); !errors.Is(err, ErrConflict) {
+		t.Errorf("Create with a taken username: %v, want ErrConflict", err)
+	}
+
+	// Granting twice keeps one role.
+	for i := 0; i < 2; i++ {
+		if got, err = stores.Users.GrantRole(ctx, user.ID, models.RoleStaff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got.Roles) != 2 || !got.HasRole(models.RoleStaff) {
+		t.Errorf("roles after granting staff twice: %v", got.Roles)
+	}
+	if got, err = stores.Users.RevokeRole(ctx, user.ID, models.RoleStaff); err != nil {
+		t.Fatal(err)
+	}
+	if got.HasRole(models.RoleStaff) {
+		t.Errorf("roles after revoking staff: %v", got.Roles)
+	}
+	if _, err := stores.Users.GrantRole(ctx, -1, models.RoleStaff); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GrantRole of an unknown user: %v, want ErrNotFound", err)
+	}
+}
+
+func newCard(t *testing.T, stores *Stores, userID int) *models.CreditCard {
+	t.Helper()
+	card := &models.CreditCard{
+		UserID:      userID,
+		Token:       unique("card"),
+		Brand:       "visa",
+		Last4:       "4242",
+		ExpiryMonth: "12",
+		ExpiryYear:  "2040",
+		NameOnCard:  "Jane Doe",
+		Number:      vault.Sealed{KeyID: "test", WrappedKey: []byte("key"), Ciphertext: []byte("number")},
+	}
+	if err := stores.CreditCards.Create(context.Background(), card); err != nil {
+		t.Fatal(err)
+	}
+	return card
+}
+
+// defaults returns the IDs of the default cards of the user.
+func defaults(t *testing.T, stores *Stores, userID int) []int {
+	t.Helper()
+	cards, err := stores.CreditCards.ListByUser(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, c := range cards {
+		if c.Default {
+			ids = append(ids, c.ID)
+		}
+	}
+	return ids
+}
+
+func testCreditCards(t *testing.T, stores *Stores) {
+	ctx := context.Background()
+	owner, other := newUser(t, stores, "cardholder"), newUser(t, stores, "stranger")
+	if _, err := stores.CreditCards.GetDefault(ctx, owner.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetDefault without cards: %v, want ErrNotFound", err)
+	}
+
+	first, second, third := newCard(t, stores, owner.ID), newCard(t, stores, owner.ID), newCard(t, stores, owner.ID)
+	if !first.Default || second.Default || third.Default {
+		t.Errorf("default flags %t %t %t, want only the first card", first.Default, second.Default, third.Default)
+	}
+	cards, err := stores.CreditCards.ListByUser(ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 3 || cards[0].ID != first.ID || cards[1].ID != third.ID || cards[2].ID != second.ID {
+		t.Errorf("ListByUser returned %+v, want the default card first and the others newest first", cards)
+	}
+
+	duplicate := *first
+	if err := stores.CreditCards.Create(ctx, &duplicate); !errors.Is(err, ErrConflict) {
+		t.Errorf("Create with a taken token: %v, want ErrConflict", err)
+	}
+	got, err := stores.CreditCards.GetByToken(ctx, first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != first.ID || string(got.Number.Ciphertext) != "number" {
+		t.Errorf("GetByToken returned %+v", got)
+	}
+
+	// The cards of another user are unknown to every method taking a user ID.
+	if _, err := stores.CreditCards.Get(ctx, other.ID, first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get by another user: %v, want ErrNotFound", err)
+	}
+	stolen := *first
+	stolen.UserID, stolen.NameOnCard = other.ID, "Thief"
+	if err := stores.CreditCards.Update(ctx, &stolen); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update by another user: %v, want ErrNotFound", err)
+	}
+	if err := stores.CreditCards.SetDefault(ctx, other.ID, second.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetDefault by another user: %v, want ErrNotFound", err)
+	}
+	if err := stores.CreditCards.Delete(ctx, other.ID, first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete by another user: %v, want ErrNotFound", err)
+	}
+	if cards, err := stores.CreditCards.ListByUser(ctx, other.ID); err != nil || len(cards) != 0 {
+		t.Errorf("another user lists %d cards, %v", len(cards), err)
+	}
+
+	update := models.CreditCard{ID: second.ID, UserID: owner.ID, ExpiryMonth: "01", ExpiryYear: "2041", NameOnCard: "J. Doe"}
+	if err := stores.CreditCards.Update(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Token != second.Token || update.ExpiryYear != "2041" || update.NameOnCard != "J. Doe" {
+		t.Errorf("Update returned %+v", update)
+	}
+
+	// There is always exactly one default card.
+	if err := stores.CreditCards.SetDefault(ctx, owner.ID, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := defaults(t, stores, owner.ID); len(ids) != 1 || ids[0] != second.ID {
+		t.Errorf("default cards %v after SetDefault, want [%d]", ids, second.ID)
+	}
+	if err := stores.CreditCards.Delete(ctx, owner.ID, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := defaults(t, stores, owner.ID); len(ids) != 1 || ids[0] != third.ID {
+		t.Errorf("default cards %v after deleting the default, want the newest remaining [%d]", ids, third.ID)
+	}
+	if got, err := stores.CreditCards.GetDefault(ctx, owner.ID); err != nil || got.ID != third.ID {
+		t.Errorf("GetDefault returned %+v, %v", got, err)
+	}
+
+	// Rewrapping moves the card off the list of cards wrapped by other keys.
+	stale, err := stores.CreditCards.ListNotWrappedBy(ctx, "current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsCard(stale, first.ID) {
+		t.Errorf("ListNotWrappedBy misses the card wrapped by another key")
+	}
+	if err := stores.CreditCards.SetNumber(ctx, first.ID, vault.Sealed{KeyID: "current", WrappedKey: []byte("rewrapped"), Ciphertext: []byte("number")}); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := stores.CreditCards.ListNotWrappedBy(ctx, "current"); err != nil || containsCard(stale, first.ID) {
+		t.Errorf("ListNotWrappedBy still lists the rewrapped card, %v", err)
+	}
+	if got, err := stores.CreditCards.GetByToken(ctx, first.Token); err != nil || got.Number.KeyID != "current" || string(got.Number.WrappedKey) != "rewrapped" {
+		t.Errorf("GetByToken after SetNumber returned %+v, %v", got, err)
+	}
+}
+
+func containsOrder(orders []models.Order, id int) bool {
+	for _, o := range orders {
+		if o.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCard(cards []models.CreditCard, id int) bool {
+	for _, c := range cards {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func testOrders(t *testing.T, stores *Stores) {
+	ctx := context.Background()
+	user := newUser(t, stores, "customer")
+	cheap, dear := newProduct(t, stores, 2.5, 5), newProduct(t, stores, 10, 1)
+	stock := func(p *models.Product) int {
+		t.Helper()
+		got, err := stores.Products.Get(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Quantity
+	}
+	place := func(items ...models.OrderItem) (*models.Order, error) {
+		order := &models.Order{UserID: user.ID, Items: items}
+		return order, stores.Orders.Create(ctx, order)
+	}
+
+	var outOfStock *OutOfStockError
+	_, err := place(models.OrderItem{ProductID: cheap.ID, Quantity: 1}, models.OrderItem{ProductID: dear.ID, Quantity: 2})
+	if !errors.As(err, &outOfStock) || !errors.Is(err, ErrOutOfStock) || outOfStock.ProductID != dear.ID || outOfStock.Available != 1 {
+		t.Errorf("ordering more than in stock: %v", err)
+	}
+	if _, err := place(models.OrderItem{ProductID: -1, Quantity: 1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ordering an unknown product: %v, want ErrNotFound", err)
+	}
+	if stock(cheap) != 5 || stock(dear) != 1 {
+		t.Fatalf("failed orders changed the stock to %d and %d", stock(cheap), stock(dear))
+	}
+
+	order, err := place(models.OrderItem{ProductID: cheap.ID, Quantity: 2}, models.OrderItem{ProductID: dear.ID, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != models.OrderPendingPayment || order.Total != 15 || order.Items[0].Name != cheap.Name || order.Items[0].UnitPrice != 2.5 {
+		t.Errorf("placed %+v", order)
+	}
+	if stock(cheap) != 3 || stock(dear) != 0 {
+		t.Errorf("stock is %d and %d after ordering, want 3 and 0", stock(cheap), stock(dear))
+	}
+	if _, err := stores.Orders.Get(ctx, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an unknown order: %v, want ErrNotFound", err)
+	}
+
+	// Orders move only along the lifecycle, and are paid only once.
+	if _, err := stores.Orders.Transition(ctx, order.ID, models.OrderShipped, user.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("shipping an unpaid order: %v, want ErrInvalidTransition", err)
+	}
+	paid, err := stores.Orders.MarkPaid(ctx, order.ID, "pay_1", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.Status != models.OrderPaid || paid.PaymentID != "pay_1" {
+		t.Errorf("MarkPaid returned %+v", paid)
+	}
+	if _, err := stores.Orders.MarkPaid(ctx, order.ID, "pay_2", user.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("paying twice: %v, want ErrInvalidTransition", err)
+	}
+	if got, err := stores.Orders.Get(ctx, order.ID); err != nil || got.PaymentID != "pay_1" {
+		t.Errorf("the second payment replaced the first: %+v, %v", got, err)
+	}
+
+	// Cancelling a paid order restocks it and marks it as owing a refund.
+	cancelled, err := stores.Orders.Transition(ctx, order.ID, models.OrderCancelled, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status != models.OrderCancelled || !cancelled.RefundPending {
+		t.Errorf("cancelled %+v", cancelled)
+	}
+	if stock(cheap) != 5 || stock(dear) != 1 {
+		t.Errorf("stock is %d and %d after cancelling, want 5 and 1", stock(cheap), stock(dear))
+	}
+	if _, err := stores.Orders.Transition(ctx, order.ID, models.OrderCancelled, user.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("cancelling twice: %v, want ErrInvalidTransition", err)
+	}
+	if stock(cheap) != 5 {
+		t.Errorf("cancelling twice restocked twice")
+	}
+	pending, err := stores.Orders.ListRefundPending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsOrder(pending, order.ID) {
+		t.Errorf("ListRefundPending misses the cancelled order")
+	}
+	if err := stores.Orders.SetRefunded(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := stores.Orders.ListRefundPending(ctx); err != nil || containsOrder(pending, order.ID) {
+		t.Errorf("the order is still waiting for its refund, %v", err)
+	}
+
+	// An unpaid order owes nothing when it is cancelled.
+	unpaid, err := place(models.OrderItem{ProductID: cheap.ID, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only orders placed before the cutoff wait too long for their payment.
+	if waiting, err := stores.Orders.ListPendingPayment(ctx, time.Now().Add(time.Hour)); err != nil || !containsOrder(waiting, unpaid.ID) || containsOrder(waiting, order.ID) {
+		t.Errorf("ListPendingPayment returned %+v, %v, want the unpaid order only", waiting, err)
+	}
+	if waiting, err := stores.Orders.ListPendingPayment(ctx, unpaid.CreatedAt); err != nil || containsOrder(waiting, unpaid.ID) {
+		t.Errorf("ListPendingPayment returned an order placed at the cutoff, %v", err)
+	}
+	if cancelled, err := stores.Orders.Transition(ctx, unpaid.ID, models.OrderCancelled, user.ID); err != nil || cancelled.RefundPending {
+		t.Errorf("cancelling an unpaid order: %+v, %v", cancelled, err)
+	}
+	if waiting, err := stores.Orders.ListPendingPayment(ctx, time.Now().Add(time.Hour)); err != nil || containsOrder(waiting, unpaid.ID) {
+		t.Errorf("ListPendingPayment returned the cancelled order, %v", err)
+	}
+
+	events, err := stores.Orders.Events(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"", models.OrderPendingPayment}, {models.OrderPendingPayment, models.OrderPaid}, {models.OrderPaid, models.OrderCancelled}}
+	if len(events) != len(want) {
+		t.Fatalf("recorded %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.From != want[i][0] || e.To != want[i][1] || e.ActorID != user.ID {
+			t.Errorf("event %d is %+v, want %s to %s", i, e, want[i][0], want[i][1])
+		}
+	}
+	orders, err := stores.Orders.ListByUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].ID != unpaid.ID || len(orders[1].Items) != 2 {
+		t.Errorf("ListByUser returned %+v, want both orders with their items, newest first", orders)
+	}
+}
+
+func testRefreshTokens(t *testing.T, stores *Stores) {
+	ctx := context.Background()
+	user := newUser(t, stores, "refresher")
+	family := unique("family")
+	first := &models.RefreshToken{UserID: user.ID, FamilyID: family, TokenHash: unique("first"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := stores.Tokens.CreateRefreshToken(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &models.RefreshToken{TokenHash: unique("second"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := stores.Tokens.RotateRefreshToken(ctx, first.TokenHash, second); err != nil {
+		t.Fatal(err)
+	}
+	if second.ID == 0 || second.UserID != user.ID || second.FamilyID != family {
+		t.Errorf("rotated into %+v, want a token of the same user and family", second)
+	}
+
+	// Replaying the used token revokes the family, including the token it was exchanged for.
+	replay := &models.RefreshToken{TokenHash: unique("replay"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := stores.Tokens.RotateRefreshToken(ctx, first.TokenHash, replay); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("replaying a used token: %v, want ErrTokenReused", err)
+	}
+	third := &models.RefreshToken{TokenHash: unique("third"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := stores.Tokens.RotateRefreshToken(ctx, second.TokenHash, third); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("rotating a token of a revoked family: %v, want ErrTokenReused", err)
+	}
+
+	if err := stores.Tokens.RotateRefreshToken(ctx, unique("unknown"), third); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rotating an unknown token: %v, want ErrNotFound", err)
+	}
+	expired := &models.RefreshToken{UserID: user.ID, FamilyID: unique("family"), TokenHash: unique("expired"), ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := stores.Tokens.CreateRefreshToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Tokens.RotateRefreshToken(ctx, expired.TokenHash, third); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rotating an expired token: %v, want ErrNotFound", err)
+	}
+
+	jti := unique("jti")
+	if denied, err := stores.Tokens.IsAccessTokenDenied(ctx, jti); err != nil || denied {
+		t.Errorf("a new access token is denied: %t, %v", denied, err)
+	}
+	if err := stores.Tokens.DenyAccessToken(ctx, jti, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if denied, err := stores.Tokens.IsAccessTokenDenied(ctx, jti); err != nil || !denied {
+		t.Errorf("a revoked access token is not denied: %t, %v", denied, err)
+	}
+}
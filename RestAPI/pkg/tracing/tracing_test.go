@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"RestAPI/pkg/config"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+
+	c := config.Default()
+	c.Tracing.Exporter = "file"
+	c.Tracing.File = filepath.Join(t.TempDir(), "spans.json")
+	c.Tracing.ServiceName = "tracing-test"
+	shutdown, err := Setup(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The span continues the trace of the caller in the traceparent header.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	carrier := propagation.HeaderCarrier{}
+	carrier.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+	_, span := otel.Tracer("test").Start(ctx, "GET /orders/")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(c.Tracing.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Name        string
+		SpanContext struct{ TraceID string }
+		Resource    []struct {
+			Key   string
+			Value struct{ Value interface{} }
+		}
+	}
+	if err := json.NewDecoder(strings.NewReader(string(data))).Decode(&exported); err != nil {
+		t.Fatalf("%v in %s", err, data)
+	}
+	if exported.Name != "GET /orders/" || exported.SpanContext.TraceID != traceID {
+		t.Errorf("exported %s", data)
+	}
+	service := ""
+	for _, attr := range exported.Resource {
+		if attr.Key == "service.name" {
+			service, _ = attr.Value.Value.(string)
+		}
+	}
+	if service != "tracing-test" {
+		t.Errorf("service.name is %q, want tracing-test", service)
+	}
+}
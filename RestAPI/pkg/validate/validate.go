@@ -0,0 +1,50 @@
+// Package validate collects what is wrong with the fields of a request, so that every invalid field
+// can be reported at once instead of one per round trip.
+package validate
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// Errors maps the JSON name of every invalid field to what is wrong with it.
+type Errors map[string]string
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + " " + e[field]
+	}
+	return "invalid fields: " + strings.Join(fields, ", ")
+}
+
+// Check records what is wrong with the field unless ok holds. Only the first problem of a field is kept,
+// so checks can go from the basic to the specific.
+func (e Errors) Check(ok bool, field, format string, args ...interface{}) {
+	if ok {
+		return
+	}
+	if _, found := e[field]; !found {
+		e[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// Err returns e as an error, or nil when no field is invalid.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// IsEmail reports whether s is a plain e-mail address such as jane@example.com, without a display name.
+func IsEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && strings.Contains(s[strings.LastIndex(s, "@"):], ".")
+}
@@ -0,0 +1,34 @@
+package validate
+
+import "testing"
+
+func TestErrors(t *testing.T) {
+	errs := Errors{}
+	if errs.Err() != nil {
+		t.Error("no errors must be a nil error")
+	}
+	errs.Check(true, "name", "is required")
+	errs.Check(false, "price", "must not be negative")
+	errs.Check(false, "price", "is too high")
+	errs.Check(false, "name", "is required")
+	if err := errs.Err(); err == nil || err.Error() != "invalid fields: name is required, price must not be negative" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestIsEmail(t *testing.T) {
+	for s, want := range map[string]bool{
+		"jane@example.com":          true,
+		"jane.doe+shop@example.com": true,
+		"":                          false,
+		"jane":                      false,
+		"jane@":                     false,
+		"jane@localhost":            false,
+		"Jane <jane@example.com>":   false,
+		"jane@example.com ":         false,
+	} {
+		if got := IsEmail(s); got != want {
+			t.Errorf("IsEmail(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
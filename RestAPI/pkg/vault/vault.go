@@ -0,0 +1,188 @@
+// Package vault encrypts card numbers at rest with envelope encryption.
+//
+// Every value is encrypted with AES-256-GCM under a data key of its own. The data key is in turn
+// encrypted ("wrapped") by a master key and stored next to the ciphertext, together with the ID of the
+// master key. Master keys never touch the database. Rotating the master key only rewraps the small
+// data keys, the encrypted values themselves stay as they are.
+package vault
+
+import (
+	"RestAPI/pkg/config"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeySize is the size of master and data keys in bytes, for AES-256.
+const KeySize = 32
+
+// TokenPrefix starts every card token, telling them apart from the tokens of the payment provider.
+const TokenPrefix = "card_"
+
+// ErrUnknownKey is returned when a value was sealed with a master key that is not configured.
+var ErrUnknownKey = errors.New("vault: unknown master key")
+
+// ErrDecrypt is returned when a sealed value does not decrypt, because it was tampered with
+// or is opened with different associated data than it was sealed with.
+var ErrDecrypt = errors.New("vault: decryption failed")
+
+// Sealed is an encrypted value. WrappedKey is its data key encrypted by the master key KeyID.
+// Both WrappedKey and Ciphertext start with their GCM nonce.
+type Sealed struct {
+	KeyID      string
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+// Vault seals new values with its current master key and opens values sealed with any of its master keys.
+type Vault struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// New returns the Vault described by the vault settings of config.
+func New(config *config.Config) (*Vault, error) {
+	c := config.Vault
+	if len(c.MasterKeys) == 0 {
+		return nil, errors.New("vault: no master keys configured, set VAULT_MASTER_KEYS")
+	}
+	v := &Vault{current: c.CurrentKey, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range c.MasterKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("vault: master key %q must be %d base64 encoded bytes", id, KeySize)
+		}
+		if v.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := v.keys[v.current]; !ok {
+		return nil, fmt.Errorf("vault: current master key %q is not among the master keys", v.current)
+	}
+	return v, nil
+}
+
+// CurrentKeyID returns the ID of the master key new values are sealed with.
+func (v *Vault) CurrentKeyID() string {
+	return v.current
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext and prepends the random nonce.
+func seal(aead cipher.AEAD, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, sealed, associatedData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts plaintext under a new data key wrapped by the current master key.
+// The associated data is not stored, but Open must be given the same to succeed. Passing the ID the value
+// is stored under binds the ciphertext to it, so it can not be copied over to another row.
+func (v *Vault) Seal(plaintext, associatedData []byte) (*Sealed, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(aead, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(v.keys[v.current], dataKey, []byte(v.current))
+	if err != nil {
+		return nil, err
+	}
+	return &Sealed{KeyID: v.current, WrappedKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+// unwrap decrypts the data key of s with the master key it was wrapped with.
+func (v *Vault) unwrap(s *Sealed) ([]byte, error) {
+	master, ok := v.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, s.KeyID)
+	}
+	return open(master, s.WrappedKey, []byte(s.KeyID))
+}
+
+// Open decrypts a value sealed by Seal.
+func (v *Vault) Open(s *Sealed, associatedData []byte) ([]byte, error) {
+	dataKey, err := v.unwrap(s)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, s.Ciphertext, associatedData)
+}
+
+// Rewrap returns s with its data key wrapped by the current master key, so that the master key it was
+// sealed with can be retired. The ciphertext is left untouched.
+func (v *Vault) Rewrap(s *Sealed) (*Sealed, error) {
+	if s.KeyID == v.current {
+		return s, nil
+	}
+	dataKey, err := v.unwrap(s)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(v.keys[v.current], dataKey, []byte(v.current))
+	if err != nil {
+		return nil, err
+	}
+	return &Sealed{KeyID: v.current, WrappedKey: wrapped, Ciphertext: s.Ciphertext}, nil
+}
+
+// NewToken returns a random card token, the opaque handle clients use in place of the card number.
+func NewToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IsToken reports whether s looks like a token returned by NewToken.
+func IsToken(s string) bool {
+	return strings.HasPrefix(s, TokenPrefix) && len(s) > len(TokenPrefix)
+}
+
+// GenerateKey returns a new random master key, base64 encoded as VAULT_MASTER_KEYS expects it.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
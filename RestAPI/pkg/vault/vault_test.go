@@ -0,0 +1,76 @@
+package vault
+
+import (
+	"RestAPI/pkg/config"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newVault(t *testing.T, current string, keys map[string]string) *Vault {
+	cfg := config.Default()
+	cfg.Vault.MasterKeys = keys
+	cfg.Vault.CurrentKey = current
+	v, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+const (
+	oldKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func TestSealOpen(t *testing.T) {
+	v := newVault(t, "k1", map[string]string{"k1": oldKey})
+	sealed, err := v.Seal([]byte("4242424242424242"), []byte("card_a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Ciphertext, []byte("4242")) || sealed.KeyID != "k1" {
+		t.Fatalf("sealed value %+v", sealed)
+	}
+	number, err := v.Open(sealed, []byte("card_a"))
+	if err != nil || string(number) != "4242424242424242" {
+		t.Fatalf("Open = %q, %v", number, err)
+	}
+	if _, err := v.Open(sealed, []byte("card_b")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("opening with other associated data: %v", err)
+	}
+	tampered := *sealed
+	tampered.Ciphertext = append([]byte{}, sealed.Ciphertext...)
+	tampered.Ciphertext[len(tampered.Ciphertext)-1] ^= 1
+	if _, err := v.Open(&tampered, []byte("card_a")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("opening a tampered value: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	before := newVault(t, "k1", map[string]string{"k1": oldKey})
+	sealed, err := before.Seal([]byte("4242424242424242"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	during := newVault(t, "k2", map[string]string{"k1": oldKey, "k2": newKey})
+	if _, err := during.Open(sealed, nil); err != nil {
+		t.Fatalf("old values must still open while the old key is configured: %v", err)
+	}
+	rewrapped, err := during.Rewrap(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.KeyID != "k2" || !bytes.Equal(rewrapped.Ciphertext, sealed.Ciphertext) {
+		t.Fatalf("rewrapped value %+v", rewrapped)
+	}
+
+	after := newVault(t, "k2", map[string]string{"k2": newKey})
+	if _, err := after.Open(sealed, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("opening a value of a retired key: %v", err)
+	}
+	if number, err := after.Open(rewrapped, nil); err != nil || string(number) != "4242424242424242" {
+		t.Errorf("Open after rotation = %q, %v", number, err)
+	}
+}